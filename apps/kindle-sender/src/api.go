@@ -0,0 +1,747 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pagination limits for list endpoints
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// SentFileRecord is a sent_files row as returned by the admin API
+type SentFileRecord struct {
+	ID        int64      `json:"id"`
+	FilePath  string     `json:"file_path"`
+	FileSize  int64      `json:"file_size"`
+	FileHash  string     `json:"file_hash,omitempty"`
+	Status    string     `json:"status"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	MovedFrom string     `json:"moved_from,omitempty"`
+	Title     string     `json:"title,omitempty"`
+	Author    string     `json:"author,omitempty"`
+	Language  string     `json:"language,omitempty"`
+	ISBN      string     `json:"isbn,omitempty"`
+
+	// SupersededBy is the preferred format sent instead of this file
+	SupersededBy string `json:"superseded_by,omitempty"`
+}
+
+// OversizedFileRecord is an oversized_files row as returned by the admin API
+type OversizedFileRecord struct {
+	ID         int64      `json:"id"`
+	FilePath   string     `json:"file_path"`
+	FileName   string     `json:"file_name"`
+	FileSize   int64      `json:"file_size"`
+	MaxSize    int64      `json:"max_size"`
+	Reason     string     `json:"reason,omitempty"`
+	DetectedAt *time.Time `json:"detected_at,omitempty"`
+}
+
+// DeliveryRecord is a deliveries row as returned by the admin API
+type DeliveryRecord struct {
+	ID        int64      `json:"id"`
+	FilePath  string     `json:"file_path"`
+	Recipient string     `json:"recipient"`
+	Profile   string     `json:"profile"`
+	Status    string     `json:"status"`
+	Version   int        `json:"version"`
+	BatchID   string     `json:"batch_id,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+
+	RejectionReason string `json:"rejection_reason,omitempty"`
+}
+
+// FileVersionRecord is a file_versions row as returned by the admin API, with
+// the recipients whose latest delivery of the file was this version
+type FileVersionRecord struct {
+	ID         int64      `json:"id"`
+	FilePath   string     `json:"file_path"`
+	Version    int        `json:"version"`
+	FileHash   string     `json:"file_hash"`
+	FileSize   int64      `json:"file_size"`
+	DetectedAt *time.Time `json:"detected_at,omitempty"`
+	Recipients []string   `json:"recipients"`
+}
+
+// QueueRecord is a send_queue row as returned by the admin API
+type QueueRecord struct {
+	ID            int64     `json:"id"`
+	FilePath      string    `json:"file_path"`
+	Recipient     string    `json:"recipient,omitempty"`
+	Profile       string    `json:"profile"`
+	FileSize      int64     `json:"file_size"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error,omitempty"`
+	SMTPCode      int       `json:"smtp_code,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	VolumesSent   int       `json:"volumes_sent,omitempty"`
+	Title         string    `json:"title,omitempty"`
+	Author        string    `json:"author,omitempty"`
+}
+
+type pageResponse struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// pathRequest is the body accepted by the per-file actions. Recipient
+// optionally limits resend and forget to one address; Profile picks the
+// account a resend goes out from.
+type pathRequest struct {
+	Path      string `json:"path"`
+	Recipient string `json:"recipient,omitempty"`
+	Profile   string `json:"profile,omitempty"`
+}
+
+// adminAPI serves the JSON admin endpoints on the metrics mux. Reads go
+// straight to the database; actions that write run on the worker.
+type adminAPI struct {
+	config      *Config
+	db          *sql.DB
+	worker      *Worker
+	scanTrigger chan<- struct{}
+}
+
+func registerAdminAPI(mux *http.ServeMux, config *Config, db *sql.DB, worker *Worker, scanTrigger chan<- struct{}) {
+	api := &adminAPI{config: config, db: db, worker: worker, scanTrigger: scanTrigger}
+	if config.AdminToken == "" {
+		log.Printf("ADMIN_TOKEN is not set: the admin API is read-only")
+	}
+	if config.BookshelfToken == "" {
+		log.Printf("WEBHOOK_TOKEN is not set: the Bookshelf webhook is disabled")
+	}
+
+	mux.HandleFunc("/api/sent", api.auth("GET", api.listSent))
+	mux.HandleFunc("/api/deliveries", api.auth("GET", api.listDeliveries))
+	mux.HandleFunc("/api/versions", api.auth("GET", api.listVersions))
+	mux.HandleFunc("/api/oversized", api.auth("GET", api.listOversized))
+	mux.HandleFunc("/api/pending", api.auth("GET", api.listPending))
+	mux.HandleFunc("/api/files/resend", api.auth("POST", api.resendFile))
+	mux.HandleFunc("/api/files/forget", api.auth("POST", api.forgetFile))
+	mux.HandleFunc("/api/files/approve", api.auth("POST", api.decide(approvalApprove)))
+	mux.HandleFunc("/api/files/reject", api.auth("POST", api.decide(approvalReject)))
+	mux.HandleFunc("/api/oversized/clear", api.auth("POST", api.clearOversized))
+	mux.HandleFunc("/api/scan", api.auth("POST", api.triggerScan))
+	mux.HandleFunc("/api/webhooks/bookshelf", api.webhookAuth(api.bookshelfWebhook))
+}
+
+// deliveryWindowStatus is a profile's delivery window state in /health
+type deliveryWindowStatus struct {
+	Open       bool       `json:"open"`
+	Schedule   string     `json:"schedule"`
+	NextChange *time.Time `json:"next_change,omitempty"`
+}
+
+// healthHandler reports the service as up, with whether each profile is
+// currently inside its delivery windows
+func healthHandler(profiles *Profiles) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		windows := make(map[string]deliveryWindowStatus)
+		for _, profile := range profiles.All() {
+			status := deliveryWindowStatus{Open: profile.Schedule.Open(now), Schedule: profile.Schedule.String()}
+			if next := profile.Schedule.NextChange(now); !next.IsZero() {
+				status.NextChange = &next
+			}
+			windows[profile.Name] = status
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "delivery_windows": windows})
+	}
+}
+
+// auth enforces the HTTP method and, when ADMIN_TOKEN is set, a matching
+// bearer token. Without ADMIN_TOKEN only reads are allowed, so the port
+// can't be used to send, forget or approve books.
+func (a *adminAPI) auth(method string, next http.HandlerFunc) http.HandlerFunc {
+	return requireToken(method, a.config.AdminToken, "ADMIN_TOKEN", next)
+}
+
+// webhookAuth guards the Bookshelf webhook with its own WEBHOOK_TOKEN, so
+// Bookshelf can queue imports but can't use the admin actions
+func (a *adminAPI) webhookAuth(next http.HandlerFunc) http.HandlerFunc {
+	return requireToken(http.MethodPost, a.config.BookshelfToken, "WEBHOOK_TOKEN", next)
+}
+
+// requireToken enforces the HTTP method and, when secret is set, a matching
+// bearer token. The token is also accepted as a basic auth password, since
+// Bookshelf's webhook connection can only send a username and password.
+// Anything but a read is refused while the secret, named by setting, is unset.
+func requireToken(method, secret, setting string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+			return
+		}
+		if method != http.MethodGet && secret == "" {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("disabled until %s is set", setting))
+			return
+		}
+		if secret != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, password, ok := r.BasicAuth(); ok {
+				token = password
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+				writeError(w, http.StatusUnauthorized, "invalid or missing token")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (a *adminAPI) listSent(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+	where, args := searchClause(r, "file_path", "title", "author", "isbn")
+	if status := r.URL.Query().Get("status"); status != "" {
+		where, args = appendCondition(where, args, "status = ?", status)
+	}
+
+	var total int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM sent_files"+where, args...).Scan(&total); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := a.db.Query(
+		`SELECT id, file_path, file_size, file_hash, status, sent_at, moved_from, superseded_by, title, author, language, isbn
+		FROM sent_files`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	items := make([]SentFileRecord, 0)
+	for rows.Next() {
+		var rec SentFileRecord
+		var fileHash, movedFrom, supersededBy, title, author, language, isbn sql.NullString
+		var sentAt sql.NullTime
+		if err := rows.Scan(&rec.ID, &rec.FilePath, &rec.FileSize, &fileHash, &rec.Status, &sentAt,
+			&movedFrom, &supersededBy, &title, &author, &language, &isbn); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rec.FileHash = fileHash.String
+		rec.MovedFrom = movedFrom.String
+		rec.SupersededBy = supersededBy.String
+		rec.Title = title.String
+		rec.Author = author.String
+		rec.Language = language.String
+		rec.ISBN = isbn.String
+		if sentAt.Valid {
+			rec.SentAt = &sentAt.Time
+		}
+		items = append(items, rec)
+	}
+	writeJSON(w, http.StatusOK, pageResponse{Items: items, Total: total, Limit: limit, Offset: offset})
+}
+
+func (a *adminAPI) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+	where, args := searchClause(r, "file_path", "recipient")
+	if recipient := r.URL.Query().Get("recipient"); recipient != "" {
+		where, args = appendCondition(where, args, "recipient = ?", recipient)
+	}
+	if profile := r.URL.Query().Get("profile"); profile != "" {
+		where, args = appendCondition(where, args, "profile = ?", profile)
+	}
+	if batchID := r.URL.Query().Get("batch_id"); batchID != "" {
+		where, args = appendCondition(where, args, "batch_id = ?", batchID)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		where, args = appendCondition(where, args, "status = ?", status)
+	}
+
+	var total int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM deliveries"+where, args...).Scan(&total); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := a.db.Query(
+		`SELECT id, file_path, recipient, profile, status, version, batch_id, sent_at, rejection_reason
+		FROM deliveries`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	items := make([]DeliveryRecord, 0)
+	for rows.Next() {
+		var rec DeliveryRecord
+		var batchID, rejectionReason sql.NullString
+		var sentAt sql.NullTime
+		if err := rows.Scan(&rec.ID, &rec.FilePath, &rec.Recipient, &rec.Profile, &rec.Status, &rec.Version, &batchID, &sentAt, &rejectionReason); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rec.BatchID = batchID.String
+		rec.RejectionReason = rejectionReason.String
+		if sentAt.Valid {
+			rec.SentAt = &sentAt.Time
+		}
+		items = append(items, rec)
+	}
+	writeJSON(w, http.StatusOK, pageResponse{Items: items, Total: total, Limit: limit, Offset: offset})
+}
+
+func (a *adminAPI) listVersions(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+	where, args := searchClause(r, "file_path")
+	if path := r.URL.Query().Get("path"); path != "" {
+		where, args = appendCondition(where, args, "file_path = ?", path)
+	}
+
+	var total int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM file_versions"+where, args...).Scan(&total); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := a.db.Query(
+		`SELECT id, file_path, version, file_hash, file_size, detected_at,
+			(SELECT GROUP_CONCAT(recipient, ',') FROM deliveries d
+			WHERE d.file_path = file_versions.file_path AND d.version = file_versions.version AND d.status NOT IN (?, ?))
+		FROM file_versions`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(append([]interface{}{deliveryStatusDeclined, fileStatusRejected}, args...), limit, offset)...,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	items := make([]FileVersionRecord, 0)
+	for rows.Next() {
+		var rec FileVersionRecord
+		var recipients sql.NullString
+		var detectedAt sql.NullTime
+		if err := rows.Scan(&rec.ID, &rec.FilePath, &rec.Version, &rec.FileHash, &rec.FileSize, &detectedAt, &recipients); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rec.Recipients = splitList(recipients.String)
+		if rec.Recipients == nil {
+			rec.Recipients = []string{}
+		}
+		if detectedAt.Valid {
+			rec.DetectedAt = &detectedAt.Time
+		}
+		items = append(items, rec)
+	}
+	writeJSON(w, http.StatusOK, pageResponse{Items: items, Total: total, Limit: limit, Offset: offset})
+}
+
+func (a *adminAPI) listOversized(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+	where, args := searchClause(r, "file_path", "file_name")
+
+	var total int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM oversized_files"+where, args...).Scan(&total); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := a.db.Query(
+		`SELECT id, file_path, file_name, file_size, max_size, reason, detected_at
+		FROM oversized_files`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	items := make([]OversizedFileRecord, 0)
+	for rows.Next() {
+		var rec OversizedFileRecord
+		var reason sql.NullString
+		var detectedAt sql.NullTime
+		if err := rows.Scan(&rec.ID, &rec.FilePath, &rec.FileName, &rec.FileSize, &rec.MaxSize, &reason, &detectedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rec.Reason = reason.String
+		if detectedAt.Valid {
+			rec.DetectedAt = &detectedAt.Time
+		}
+		items = append(items, rec)
+	}
+	writeJSON(w, http.StatusOK, pageResponse{Items: items, Total: total, Limit: limit, Offset: offset})
+}
+
+func (a *adminAPI) listPending(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+	where, args := searchClause(r, "file_path", "recipient", "title", "author")
+	if status := r.URL.Query().Get("status"); status != "" {
+		where, args = appendCondition(where, args, "status = ?", status)
+	}
+	if profile := r.URL.Query().Get("profile"); profile != "" {
+		where, args = appendCondition(where, args, "profile = ?", profile)
+	}
+
+	var total int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM send_queue"+where, args...).Scan(&total); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rows, err := a.db.Query(
+		`SELECT id, file_path, recipient, profile, file_size, status, attempts, last_error, smtp_code, next_attempt_at, volumes_sent, title, author
+		FROM send_queue`+where+` ORDER BY next_attempt_at, id LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	items := make([]QueueRecord, 0)
+	for rows.Next() {
+		var rec QueueRecord
+		var lastError, title, author sql.NullString
+		var smtpCode sql.NullInt64
+		var nextAttempt int64
+		if err := rows.Scan(&rec.ID, &rec.FilePath, &rec.Recipient, &rec.Profile, &rec.FileSize, &rec.Status, &rec.Attempts, &lastError,
+			&smtpCode, &nextAttempt, &rec.VolumesSent, &title, &author); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rec.LastError = lastError.String
+		rec.SMTPCode = int(smtpCode.Int64)
+		rec.NextAttemptAt = time.Unix(nextAttempt, 0).UTC()
+		rec.Title = title.String
+		rec.Author = author.String
+		items = append(items, rec)
+	}
+	writeJSON(w, http.StatusOK, pageResponse{Items: items, Total: total, Limit: limit, Offset: offset})
+}
+
+// resendFile queues a file for delivery even if it was sent, baselined or
+// dead-lettered before. It goes to the given recipient or profile, or to
+// every recipient its routes select.
+func (a *adminAPI) resendFile(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.readPathRequest(w, r)
+	if !ok {
+		return
+	}
+	filePath := req.Path
+	targets, err := a.resendTargets(req)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("file not found: %v", err))
+		return
+	}
+	// Oversized books are accepted when the profile can shrink them
+	recipients := make([]string, len(targets))
+	for i, target := range targets {
+		if ok, reason := target.Profile.acceptsFile(filepath.Base(filePath), info.Size()); !ok {
+			if reason == "" {
+				reason = "format not accepted by profile " + target.Profile.Name
+			}
+			writeError(w, http.StatusConflict, "cannot resend: "+reason)
+			return
+		}
+		recipients[i] = target.Recipient
+	}
+
+	err = a.worker.Do(func() error {
+		fileHash, err := hashFile(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to hash file: %w", err)
+		}
+		meta, err := extractMetadata(filePath)
+		if err != nil {
+			log.Printf("Error extracting metadata from %s: %v", filepath.Base(filePath), err)
+		}
+		for _, target := range targets {
+			if err := requeueFile(a.db, filePath, target, info.Size(), fileHash, meta); err != nil {
+				return err
+			}
+		}
+		updateQueueMetrics(a.db)
+		log.Printf("Admin API: queued %s for resend", meta.DisplayName(filepath.Base(filePath)))
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"status": "queued", "path": filePath, "recipients": recipients})
+}
+
+// resendTargets resolves where a resend goes. A profile without a recipient
+// means its own Kindle address; a recipient without a profile is sent from
+// the profile that routes the file to it, or the default profile.
+func (a *adminAPI) resendTargets(req pathRequest) ([]Target, error) {
+	profiles := a.worker.profiles
+	if req.Profile != "" {
+		profile := profiles.Get(strings.ToLower(req.Profile))
+		if profile == nil {
+			return nil, fmt.Errorf("unknown profile %q", req.Profile)
+		}
+		recipient := req.Recipient
+		if recipient == "" {
+			recipient = profile.Config.KindleEmail
+		}
+		return []Target{{Profile: profile, Recipient: recipient}}, nil
+	}
+
+	targets := a.worker.router.Targets(req.Path)
+	if req.Recipient == "" {
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no route matches the file and KINDLE_EMAIL is not set")
+		}
+		return targets, nil
+	}
+	for _, target := range targets {
+		if strings.EqualFold(target.Recipient, req.Recipient) {
+			return []Target{target}, nil
+		}
+	}
+	profile := profiles.Get(defaultProfile)
+	if profile == nil {
+		return nil, fmt.Errorf("no profile sends to %s; pass a profile", req.Recipient)
+	}
+	return []Target{{Profile: profile, Recipient: req.Recipient}}, nil
+}
+
+// forgetFile removes a file from the send history so the next scan sends it
+// again. Rows sharing its content hash are removed too, otherwise the
+// content-based deduplication would still treat it as sent. With a
+// recipient, only their deliveries are forgotten.
+func (a *adminAPI) forgetFile(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.readPathRequest(w, r)
+	if !ok {
+		return
+	}
+	filePath := req.Path
+
+	var forgotten int64
+	err := a.worker.Do(func() error {
+		if req.Recipient != "" {
+			result, err := a.db.Exec(
+				`DELETE FROM deliveries WHERE recipient = ? AND (file_path = ? OR file_path IN (
+					SELECT file_path FROM sent_files WHERE file_hash IN (
+						SELECT file_hash FROM sent_files WHERE file_path = ? AND file_hash IS NOT NULL)))`,
+				req.Recipient, filePath, filePath,
+			)
+			if err != nil {
+				return err
+			}
+			forgotten, _ = result.RowsAffected()
+			if _, err := a.db.Exec("DELETE FROM send_queue WHERE file_path = ? AND recipient = ?", filePath, req.Recipient); err != nil {
+				return err
+			}
+			updateQueueMetrics(a.db)
+			return nil
+		}
+
+		if _, err := a.db.Exec(
+			`DELETE FROM deliveries WHERE file_path = ? OR file_path IN (
+				SELECT file_path FROM sent_files WHERE file_hash IN (
+					SELECT file_hash FROM sent_files WHERE file_path = ? AND file_hash IS NOT NULL))`,
+			filePath, filePath,
+		); err != nil {
+			return err
+		}
+		result, err := a.db.Exec(
+			`DELETE FROM sent_files WHERE file_path = ?
+			OR file_hash IN (SELECT file_hash FROM sent_files WHERE file_path = ? AND file_hash IS NOT NULL)`,
+			filePath, filePath,
+		)
+		if err != nil {
+			return err
+		}
+		forgotten, _ = result.RowsAffected()
+		if _, err := a.db.Exec("DELETE FROM file_versions WHERE file_path = ?", filePath); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec("DELETE FROM send_queue WHERE file_path = ?", filePath); err != nil {
+			return err
+		}
+		updateQueueMetrics(a.db)
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if forgotten == 0 {
+		writeError(w, http.StatusNotFound, "file is not in the send history")
+		return
+	}
+
+	log.Printf("Admin API: forgot %s (%d history rows removed)", filePath, forgotten)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "forgotten", "path": filePath, "rows_removed": forgotten})
+}
+
+// decide approves or rejects a file held for approval, for every recipient
+// or the given one
+func (a *adminAPI) decide(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := a.readPathRequest(w, r)
+		if !ok {
+			return
+		}
+		decided, err := decideHeld(a.worker, action, req.Path, req.Recipient)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if decided == 0 {
+			writeError(w, http.StatusNotFound, "file is not waiting for approval")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": approvalLabels[action][1], "path": req.Path, "recipients": decided})
+	}
+}
+
+func (a *adminAPI) clearOversized(w http.ResponseWriter, r *http.Request) {
+	filePath, ok := a.requestPath(w, r)
+	if !ok {
+		return
+	}
+
+	var fileName string
+	err := a.worker.Do(func() error {
+		var fileSize int64
+		err := a.db.QueryRow("SELECT file_name, file_size FROM oversized_files WHERE file_path = ?", filePath).Scan(&fileName, &fileSize)
+		if err != nil {
+			return err
+		}
+		return clearFileOversized(a.db, filePath, fileName, fileSize)
+	})
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "file is not tracked as oversized")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Admin API: cleared oversized entry for %s", fileName)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "cleared", "path": filePath})
+}
+
+func (a *adminAPI) triggerScan(w http.ResponseWriter, r *http.Request) {
+	select {
+	case a.scanTrigger <- struct{}{}:
+		log.Println("Admin API: scan requested")
+	default:
+		// A scan is already pending
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "scan requested"})
+}
+
+// requestPath reads the target path from a JSON body or the path query
+// parameter and checks that it lies under the watch path
+func (a *adminAPI) requestPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	req, ok := a.readPathRequest(w, r)
+	return req.Path, ok
+}
+
+// readPathRequest is requestPath for actions that also take a recipient or
+// profile, from the body or the query parameters of the same name
+func (a *adminAPI) readPathRequest(w http.ResponseWriter, r *http.Request) (pathRequest, bool) {
+	query := r.URL.Query()
+	req := pathRequest{Path: query.Get("path"), Recipient: query.Get("recipient"), Profile: query.Get("profile")}
+	if req.Path == "" && r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return req, false
+		}
+	}
+	if req.Path == "" {
+		writeError(w, http.StatusBadRequest, "path is required")
+		return req, false
+	}
+
+	req.Path = filepath.Clean(req.Path)
+	rel, err := filepath.Rel(filepath.Clean(a.config.WatchPath), req.Path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("path must be under %s", a.config.WatchPath))
+		return req, false
+	}
+	return req, true
+}
+
+func pagination(r *http.Request) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// searchClause builds a WHERE clause matching the q parameter against the
+// given columns
+func searchClause(r *http.Request, columns ...string) (string, []interface{}) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		return "", nil
+	}
+	pattern := "%" + q + "%"
+	conditions := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		conditions[i] = column + " LIKE ?"
+		args[i] = pattern
+	}
+	return " WHERE (" + strings.Join(conditions, " OR ") + ")", args
+}
+
+func appendCondition(where string, args []interface{}, condition string, arg interface{}) (string, []interface{}) {
+	if where == "" {
+		return " WHERE " + condition, append(args, arg)
+	}
+	return where + " AND " + condition, append(args, arg)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
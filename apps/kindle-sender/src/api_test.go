@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAPIAuth(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		header string
+		want   int
+	}{
+		{name: "read without token", method: http.MethodGet, want: http.StatusNoContent},
+		{name: "action without token", method: http.MethodPost, want: http.StatusForbidden},
+		{name: "wrong method", method: http.MethodPut, want: http.StatusMethodNotAllowed},
+		{name: "read missing bearer", token: "secret", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "action wrong bearer", token: "secret", method: http.MethodPost, header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "action with bearer", token: "secret", method: http.MethodPost, header: "Bearer secret", want: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &adminAPI{config: &Config{AdminToken: tt.token}}
+			method := http.MethodGet
+			if tt.method != http.MethodGet {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(tt.method, "/api/test", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			api.auth(method, ok)(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	// Bookshelf sends the token as a basic auth password
+	api := &adminAPI{config: &Config{AdminToken: "secret"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/webhooks/bookshelf", nil)
+	req.SetBasicAuth("bookshelf", "secret")
+	rec := httptest.NewRecorder()
+	api.auth(http.MethodPost, ok)(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("basic auth status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+}
+
+func TestWebhookAuthUsesOwnToken(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	tests := []struct {
+		name     string
+		admin    string
+		webhook  string
+		password string
+		want     int
+	}{
+		{name: "no webhook token", admin: "admin", password: "admin", want: http.StatusForbidden},
+		{name: "admin token refused", admin: "admin", webhook: "hook", password: "admin", want: http.StatusUnauthorized},
+		{name: "webhook token", admin: "admin", webhook: "hook", password: "hook", want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &adminAPI{config: &Config{AdminToken: tt.admin, BookshelfToken: tt.webhook}}
+			req := httptest.NewRequest(http.MethodPost, "/api/webhooks/bookshelf", nil)
+			req.SetBasicAuth("bookshelf", tt.password)
+			rec := httptest.NewRecorder()
+			api.webhookAuth(ok)(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	// The webhook token doesn't open the admin actions
+	api := &adminAPI{config: &Config{AdminToken: "admin", BookshelfToken: "hook"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/files/forget", nil)
+	req.Header.Set("Authorization", "Bearer hook")
+	rec := httptest.NewRecorder()
+	api.auth(http.MethodPost, ok)(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("admin action with webhook token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Approval decisions, also the actions of the signed links
+const (
+	approvalApprove = "approve"
+	approvalReject  = "reject"
+)
+
+// approvalLabels holds the button and past tense wording of each action
+var approvalLabels = map[string][2]string{
+	approvalApprove: {"Approve", "approved"},
+	approvalReject:  {"Reject", "rejected"},
+}
+
+// deliveryStatusDeclined marks a recipient whose copy of a book was rejected,
+// so later scans don't hold it again
+const deliveryStatusDeclined = "declined"
+
+// Approver decides which books wait for a human before they are sent, and
+// tells someone about them. With REQUIRE_APPROVAL unset every book is sent
+// straight away.
+type Approver struct {
+	config    *Config
+	autoPaths []pathPattern
+	client    *http.Client
+}
+
+func newApprover(config *Config) (*Approver, error) {
+	a := &Approver{config: config, client: &http.Client{Timeout: 30 * time.Second}}
+	for _, pattern := range config.ApprovalAutoPaths {
+		compiled, err := parsePathPattern(filepath.Clean(config.WatchPath), pattern)
+		if err != nil {
+			return nil, fmt.Errorf("APPROVAL_AUTO_PATHS: %w", err)
+		}
+		a.autoPaths = append(a.autoPaths, compiled)
+	}
+	if config.ApprovalBaseURL != "" && config.ApprovalSecret == "" {
+		return nil, errors.New("APPROVAL_BASE_URL is set but APPROVAL_SECRET is not; links can't be signed")
+	}
+	return a, nil
+}
+
+// NeedsApproval reports whether a book is held rather than sent. Books in an
+// auto-approved folder, of an auto-approved format or within the
+// auto-approved size range go out as usual.
+func (a *Approver) NeedsApproval(filePath string, fileSize int64) bool {
+	if !a.config.RequireApproval {
+		return false
+	}
+	if segments, ok := relativeSegments(filepath.Clean(a.config.WatchPath), filePath); ok {
+		for _, pattern := range a.autoPaths {
+			if pattern.matches(segments) {
+				return false
+			}
+		}
+	}
+	if isSupportedFile(filePath, a.config.ApprovalAutoExtensions) {
+		return false
+	}
+	minSize := int64(a.config.ApprovalAutoMinSizeKB) * 1024
+	maxSize := int64(a.config.ApprovalAutoMaxSizeMB) * 1024 * 1024
+	if (minSize > 0 || maxSize > 0) && fileSize >= minSize && (maxSize <= 0 || fileSize <= maxSize) {
+		return false
+	}
+	return true
+}
+
+// heldNotification is the JSON body POSTed to APPROVAL_NOTIFY_URL
+type heldNotification struct {
+	Event      string     `json:"event"`
+	Message    string     `json:"message"`
+	Path       string     `json:"path"`
+	FileName   string     `json:"file_name"`
+	FileSize   int64      `json:"file_size"`
+	Title      string     `json:"title,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Recipients []string   `json:"recipients"`
+	ApproveURL string     `json:"approve_url,omitempty"`
+	RejectURL  string     `json:"reject_url,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// Notify tells APPROVAL_NOTIFY_URL that a book is held, with signed links to
+// approve or reject it when APPROVAL_BASE_URL is set. It returns straight
+// away so the worker isn't held up by a slow endpoint.
+func (a *Approver) Notify(filePath string, fileSize int64, meta BookMetadata, targets []Target) {
+	if a.config.ApprovalNotifyURL == "" {
+		return
+	}
+	fileName := filepath.Base(filePath)
+	n := heldNotification{
+		Event:    "held",
+		Message:  fmt.Sprintf("%s is waiting for approval", meta.DisplayName(fileName)),
+		Path:     filePath,
+		FileName: fileName,
+		FileSize: fileSize,
+		Title:    meta.Title,
+		Author:   meta.Author,
+	}
+	for _, target := range targets {
+		n.Recipients = append(n.Recipients, target.Recipient)
+	}
+	if a.config.ApprovalBaseURL != "" {
+		expires := time.Now().Add(time.Duration(a.config.ApprovalLinkTTL) * time.Hour).UTC().Truncate(time.Second)
+		n.ExpiresAt = &expires
+		n.ApproveURL = a.signedURL(approvalApprove, filePath, expires)
+		n.RejectURL = a.signedURL(approvalReject, filePath, expires)
+	}
+
+	go func() {
+		if err := a.post(n); err != nil {
+			log.Printf("Error sending approval notification for %s: %v", fileName, err)
+		}
+	}()
+}
+
+func (a *Approver) post(n heldNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", a.config.ApprovalNotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.config.ApprovalNotifyToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.config.ApprovalNotifyToken))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("notification request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("notification endpoint returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// signedURL builds a one-click link for action on every held recipient of
+// filePath, valid until expires
+func (a *Approver) signedURL(action, filePath string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("path", filePath)
+	query.Set("exp", exp)
+	query.Set("sig", a.signature(action, filePath, exp))
+	return strings.TrimRight(a.config.ApprovalBaseURL, "/") + "/approval/" + action + "?" + query.Encode()
+}
+
+func (a *Approver) signature(action, filePath, exp string) string {
+	mac := hmac.New(sha256.New, []byte(a.config.ApprovalSecret))
+	mac.Write([]byte(action + "\n" + filePath + "\n" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLink checks a link's signature and expiry
+func (a *Approver) verifyLink(action string, query url.Values) (int, error) {
+	if a.config.ApprovalSecret == "" {
+		return http.StatusNotFound, errors.New("approval links are disabled")
+	}
+	filePath, exp, sig := query.Get("path"), query.Get("exp"), query.Get("sig")
+	if !hmac.Equal([]byte(sig), []byte(a.signature(action, filePath, exp))) {
+		return http.StatusForbidden, errors.New("invalid link signature")
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return http.StatusGone, errors.New("this link has expired; use the admin API instead")
+	}
+	return http.StatusOK, nil
+}
+
+// approveHeld releases the held queue items of filePath, or only the one for
+// recipient if given, and returns how many were released
+func approveHeld(db *sql.DB, filePath, recipient string) (int64, error) {
+	query := "UPDATE send_queue SET status = ?, next_attempt_at = ?, updated_at = CURRENT_TIMESTAMP WHERE file_path = ? AND status = ?"
+	args := []interface{}{queueStatusPending, time.Now().Unix(), filePath, queueStatusHeld}
+	if recipient != "" {
+		query += " AND recipient = ?"
+		args = append(args, recipient)
+	}
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	approved, err := result.RowsAffected()
+	approvalDecisions.WithLabelValues(approvalApprove).Add(float64(approved))
+	return approved, err
+}
+
+// rejectHeld drops the held queue items of filePath, or only the one for
+// recipient if given, and records the recipients as declined so the book
+// isn't held again. Forgetting the file through the admin API undoes this.
+func rejectHeld(db *sql.DB, filePath, recipient string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	where := " WHERE file_path = ? AND status = ?"
+	args := []interface{}{filePath, queueStatusHeld}
+	if recipient != "" {
+		where += " AND recipient = ?"
+		args = append(args, recipient)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO deliveries (file_path, recipient, profile, status, version)
+		SELECT file_path, recipient, profile, ?, `+currentVersionSQL+` FROM send_queue`+where+`
+		ON CONFLICT(file_path, recipient) DO UPDATE SET
+			profile = excluded.profile, status = excluded.status, version = excluded.version, rejection_reason = NULL, sent_at = CURRENT_TIMESTAMP`,
+		append([]interface{}{deliveryStatusDeclined, filePath}, args...)...,
+	); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM send_queue"+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	rejected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	approvalDecisions.WithLabelValues(approvalReject).Add(float64(rejected))
+	return rejected, nil
+}
+
+// decideHeld applies an approval decision on the worker
+func decideHeld(worker *Worker, action, filePath, recipient string) (int64, error) {
+	var decided int64
+	err := worker.Do(func() error {
+		var err error
+		if action == approvalApprove {
+			decided, err = approveHeld(worker.db, filePath, recipient)
+		} else {
+			decided, err = rejectHeld(worker.db, filePath, recipient)
+		}
+		updateQueueMetrics(worker.db)
+		return err
+	})
+	if err == nil && decided > 0 {
+		log.Printf("Approval: %s %s for %d recipients", approvalLabels[action][1], filePath, decided)
+	}
+	return decided, err
+}
+
+var approvalPage = template.Must(template.New("approval").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>Kindle Sender</title></head>
+<body>
+{{if .Confirm}}<form method="post">
+<p>{{.Message}}</p>
+<button type="submit">{{.Button}}</button>
+</form>
+{{else}}<p>{{.Message}}</p>{{end}}
+</body></html>
+`))
+
+type approvalPageData struct {
+	Confirm bool
+	Message string
+	Button  string
+}
+
+// registerApprovalLinks serves the signed links sent in notifications. They
+// need no admin token; the signature authorises the one action on the one
+// book. Opening a link shows a page whose button submits the decision as a
+// POST, so link scanners that fetch it, even ones running its scripts, don't
+// approve or reject anything.
+func registerApprovalLinks(mux *http.ServeMux, approver *Approver, worker *Worker) {
+	for _, action := range []string{approvalApprove, approvalReject} {
+		action := action
+		mux.HandleFunc("/approval/"+action, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" && r.Method != "POST" {
+				w.Header().Set("Allow", "GET, POST")
+				http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+				return
+			}
+			query := r.URL.Query()
+			if status, err := approver.verifyLink(action, query); err != nil {
+				renderApprovalPage(w, status, approvalPageData{Message: err.Error()})
+				return
+			}
+			filePath := query.Get("path")
+			fileName := filepath.Base(filePath)
+
+			if r.Method == "GET" {
+				renderApprovalPage(w, http.StatusOK, approvalPageData{
+					Confirm: true,
+					Message: fmt.Sprintf("%s %s?", approvalLabels[action][0], fileName),
+					Button:  approvalLabels[action][0],
+				})
+				return
+			}
+
+			decided, err := decideHeld(worker, action, filePath, "")
+			if err != nil {
+				renderApprovalPage(w, http.StatusInternalServerError, approvalPageData{Message: err.Error()})
+				return
+			}
+			if decided == 0 {
+				renderApprovalPage(w, http.StatusNotFound, approvalPageData{Message: fmt.Sprintf("%s is not waiting for approval", fileName)})
+				return
+			}
+			renderApprovalPage(w, http.StatusOK, approvalPageData{Message: fmt.Sprintf("%s %s", fileName, approvalLabels[action][1])})
+		})
+	}
+}
+
+func renderApprovalPage(w http.ResponseWriter, status int, data approvalPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := approvalPage.Execute(w, data); err != nil {
+		log.Printf("Error writing approval page: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// deliveryStatus returns the delivery status of filePath for recipient, or
+// "" when there is none
+func deliveryStatus(t *testing.T, db *sql.DB, filePath, recipient string) string {
+	t.Helper()
+	var status string
+	err := db.QueryRow("SELECT status FROM deliveries WHERE file_path = ? AND recipient = ?", filePath, recipient).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestApprovalLinkVerification(t *testing.T) {
+	config := newTestConfig(t)
+	config.ApprovalBaseURL = "https://books.example.com/"
+	config.ApprovalSecret = "secret"
+	approver, err := newApprover(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(config.WatchPath, "Dune.epub")
+
+	linkQuery := func(action string, expires time.Time) url.Values {
+		link, err := url.Parse(approver.signedURL(action, path, expires))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Path != "/approval/"+action {
+			t.Fatalf("link path = %q, want /approval/%s", link.Path, action)
+		}
+		return link.Query()
+	}
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		action string
+		query  func() url.Values
+		want   int
+	}{
+		{name: "valid", action: approvalApprove, query: func() url.Values { return linkQuery(approvalApprove, later) }, want: http.StatusOK},
+		{name: "other action", action: approvalReject, query: func() url.Values { return linkQuery(approvalApprove, later) }, want: http.StatusForbidden},
+		{name: "tampered path", action: approvalApprove, query: func() url.Values {
+			q := linkQuery(approvalApprove, later)
+			q.Set("path", filepath.Join(config.WatchPath, "Other.epub"))
+			return q
+		}, want: http.StatusForbidden},
+		{name: "extended expiry", action: approvalApprove, query: func() url.Values {
+			q := linkQuery(approvalApprove, later)
+			q.Set("exp", "99999999999")
+			return q
+		}, want: http.StatusForbidden},
+		{name: "expired", action: approvalApprove, query: func() url.Values { return linkQuery(approvalApprove, time.Now().Add(-time.Minute)) }, want: http.StatusGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := approver.verifyLink(tt.action, tt.query())
+			if status != tt.want {
+				t.Errorf("verifyLink() = %d, %v, want %d", status, err, tt.want)
+			}
+			if (err == nil) != (tt.want == http.StatusOK) {
+				t.Errorf("verifyLink() error = %v", err)
+			}
+		})
+	}
+
+	// Without a secret no link is accepted
+	config.ApprovalSecret = ""
+	if status, _ := approver.verifyLink(approvalApprove, linkQuery(approvalApprove, later)); status != http.StatusNotFound {
+		t.Errorf("verifyLink() without a secret = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestApprovalLinks(t *testing.T) {
+	config := newTestConfig(t)
+	config.RequireApproval = true
+	config.ApprovalBaseURL = "https://books.example.com"
+	config.ApprovalSecret = "secret"
+	worker := startTestWorker(t, config, &recordingTransport{})
+	approver, err := newApprover(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerApprovalLinks(mux, approver, worker)
+
+	profile := worker.profiles.Get(defaultProfile)
+	hold := func(path string, recipients ...string) {
+		t.Helper()
+		if err := worker.Do(func() error {
+			for _, recipient := range recipients {
+				target := Target{Profile: profile, Recipient: recipient}
+				if _, err := enqueueFile(worker.db, path, target, 4, "hash", BookMetadata{}, queueStatusHeld); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held := func(path, recipient string) bool {
+		t.Helper()
+		var status string
+		if err := worker.Do(func() error {
+			var err error
+			status, err = queueStatus(worker.db, path, recipient)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return status == queueStatusHeld
+	}
+	open := func(method, action, path string) int {
+		t.Helper()
+		link, err := url.Parse(approver.signedURL(action, path, time.Now().Add(time.Hour)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, link.RequestURI(), nil))
+		return rec.Code
+	}
+
+	dune := filepath.Join(config.WatchPath, "Dune.epub")
+	emma := filepath.Join(config.WatchPath, "Emma.epub")
+	hold(dune, "a@kindle.com", "b@kindle.com")
+	hold(emma, "a@kindle.com")
+
+	// Opening a link only shows the confirmation page
+	for _, action := range []string{approvalApprove, approvalReject} {
+		if code := open(http.MethodGet, action, dune); code != http.StatusOK {
+			t.Errorf("GET %s = %d, want %d", action, code, http.StatusOK)
+		}
+	}
+	if !held(dune, "a@kindle.com") || !held(dune, "b@kindle.com") {
+		t.Fatal("opening the links decided the book")
+	}
+	if status := deliveryStatus(t, worker.db, dune, "a@kindle.com"); status != "" {
+		t.Fatalf("opening the reject link recorded a %q delivery", status)
+	}
+
+	// Other methods are refused
+	if code := open(http.MethodPut, approvalReject, dune); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+
+	// Submitting the rejection declines every held recipient
+	if code := open(http.MethodPost, approvalReject, dune); code != http.StatusOK {
+		t.Fatalf("POST reject = %d, want %d", code, http.StatusOK)
+	}
+	for _, recipient := range []string{"a@kindle.com", "b@kindle.com"} {
+		if held(dune, recipient) {
+			t.Errorf("%s is still held for %s after rejection", dune, recipient)
+		}
+		if status := deliveryStatus(t, worker.db, dune, recipient); status != deliveryStatusDeclined {
+			t.Errorf("delivery for %s = %q, want %q", recipient, status, deliveryStatusDeclined)
+		}
+	}
+	if code := open(http.MethodPost, approvalReject, dune); code != http.StatusNotFound {
+		t.Errorf("second POST reject = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Submitting the approval releases the book without recording a delivery
+	if code := open(http.MethodPost, approvalApprove, emma); code != http.StatusOK {
+		t.Fatalf("POST approve = %d, want %d", code, http.StatusOK)
+	}
+	if held(emma, "a@kindle.com") {
+		t.Error("Emma is still held after approval")
+	}
+	if status := deliveryStatus(t, worker.db, emma, "a@kindle.com"); status == deliveryStatusDeclined {
+		t.Error("approval recorded a declined delivery")
+	}
+}
+
+func TestRejectHeldForOneRecipient(t *testing.T) {
+	config := newTestConfig(t)
+	db := newTestDB(t)
+	profile := newTestProfiles(t, config, &recordingTransport{}).Get(defaultProfile)
+	path := filepath.Join(config.WatchPath, "Dune.epub")
+	for _, recipient := range []string{"a@kindle.com", "b@kindle.com"} {
+		target := Target{Profile: profile, Recipient: recipient}
+		if _, err := enqueueFile(db, path, target, 4, "hash", BookMetadata{}, queueStatusHeld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rejected, err := rejectHeld(db, path, "b@kindle.com")
+	if err != nil || rejected != 1 {
+		t.Fatalf("rejectHeld() = %d, %v, want 1", rejected, err)
+	}
+	if status, _ := queueStatus(db, path, "a@kindle.com"); status != queueStatusHeld {
+		t.Errorf("queue status for a = %q, want still held", status)
+	}
+	if status := deliveryStatus(t, db, path, "a@kindle.com"); status != "" {
+		t.Errorf("delivery for a = %q, want none", status)
+	}
+	if status := deliveryStatus(t, db, path, "b@kindle.com"); status != deliveryStatusDeclined {
+		t.Errorf("delivery for b = %q, want %q", status, deliveryStatusDeclined)
+	}
+
+	// The declined recipient isn't held again on the next scan
+	missing, err := undeliveredTargets(db, path, []Target{{Profile: profile, Recipient: "a@kindle.com"}, {Profile: profile, Recipient: "b@kindle.com"}}, false)
+	if err != nil || len(missing) != 1 || missing[0].Recipient != "a@kindle.com" {
+		t.Errorf("undeliveredTargets() = %v, %v, want only a@kindle.com", missing, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// isDatabaseEmpty reports whether nothing has been sent, recorded or queued
+// yet, i.e. this is the first run against the library
+func isDatabaseEmpty(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT (SELECT COUNT(*) FROM sent_files) + (SELECT COUNT(*) FROM send_queue)").Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+func markFileBaseline(db *sql.DB, filePath string, fileSize int64, fileHash string, meta BookMetadata) (bool, error) {
+	result, err := db.Exec(
+		`INSERT OR IGNORE INTO sent_files (file_path, file_size, file_hash, title, author, language, isbn, status, email_sent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0)`,
+		filePath, fileSize, fileHash, meta.Title, meta.Author, meta.Language, meta.ISBN, fileStatusBaseline,
+	)
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	return added > 0, err
+}
+
+// runBaseline records every supported file already under the watch path as
+// seen but not sent, so only books arriving afterwards are delivered. Files
+// waiting in the send queue are taken out of it.
+func runBaseline(config *Config, db *sql.DB) (int, error) {
+	log.Printf("Recording baseline of existing books under %s...", config.WatchPath)
+
+	recorded := 0
+	err := filepath.Walk(config.WatchPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("Error accessing path %s: %v", path, err)
+			return nil
+		}
+		// Like scans, skip download clients' temporary files and unpack
+		// folders, so unfinished books aren't recorded
+		if isIgnoredPath(path, config) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !isSupportedFile(info.Name(), config.FileExtensions) {
+			return nil
+		}
+
+		known, err := isFileSent(db, path)
+		if err != nil {
+			return fmt.Errorf("failed to check if file sent: %w", err)
+		}
+		if known {
+			return nil
+		}
+
+		fileHash, err := hashFile(path)
+		if err != nil {
+			log.Printf("Error hashing %s: %v", path, err)
+			return nil
+		}
+		meta, err := extractMetadata(path)
+		if err != nil {
+			log.Printf("Error extracting metadata from %s: %v", info.Name(), err)
+		}
+
+		added, err := markFileBaseline(db, path, info.Size(), fileHash, meta)
+		if err != nil {
+			return fmt.Errorf("failed to record baseline for %s: %w", path, err)
+		}
+		if _, err := db.Exec("DELETE FROM send_queue WHERE file_path = ?", path); err != nil {
+			return fmt.Errorf("failed to remove %s from send queue: %w", path, err)
+		}
+		if added {
+			recorded++
+		}
+		return nil
+	})
+	if err != nil {
+		return recorded, err
+	}
+
+	log.Printf("Baseline complete: %d existing books recorded as seen, not sent", recorded)
+	return recorded, nil
+}
+
+// runBaselineCommand implements the "baseline" subcommand. Profiles are
+// loaded as for a normal run, so formats only a profile sends are recorded.
+func runBaselineCommand(config *Config) {
+	if _, err := loadProfiles(config); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	db, err := initDatabase(config.DatabasePath)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := runBaseline(config, db); err != nil {
+		log.Fatalf("Baseline failed: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRunBaselineSkipsIgnoredPaths(t *testing.T) {
+	config := newTestConfig(t)
+	config.IgnorePatterns = []string{"*.part", "_UNPACK_*", "_FAILED_*"}
+	db := newTestDB(t)
+
+	book := filepath.Join(config.WatchPath, "Author", "Book.epub")
+	ignored := []string{
+		filepath.Join(config.WatchPath, "Author", "_UNPACK_Book", "Book.epub"),
+		filepath.Join(config.WatchPath, "Author", "_FAILED_Other.epub"),
+	}
+	for _, path := range append([]string{book}, ignored...) {
+		writeTestFile(t, path, filepath.Base(path))
+	}
+
+	recorded, err := runBaseline(config, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != 1 {
+		t.Errorf("recorded %d books, want 1", recorded)
+	}
+	if status, err := fileStatus(db, book); err != nil || status != fileStatusBaseline {
+		t.Errorf("status of %s = %q, %v, want baseline", book, status, err)
+	}
+	for _, path := range ignored {
+		if status, err := fileStatus(db, path); err != nil || status != "" {
+			t.Errorf("status of ignored %s = %q, %v, want none", path, status, err)
+		}
+	}
+}
+
+func TestRunBaselineCommandUsesProfileFormats(t *testing.T) {
+	config := newTestConfig(t)
+	config.Transport = "directory"
+	config.TransportPath = t.TempDir()
+	config.DatabasePath = filepath.Join(t.TempDir(), "kindle-sender.db")
+	config.Profiles = []string{"kid"}
+	t.Setenv("PROFILE_KID_KINDLE_EMAIL", "kid@kindle.com")
+	t.Setenv("PROFILE_KID_FILE_EXTENSIONS", ".mobi")
+
+	// Only the kid profile sends MOBIs; the baseline must still cover them
+	book := filepath.Join(config.WatchPath, "Gruffalo.mobi")
+	writeTestFile(t, book, "gruffalo")
+
+	runBaselineCommand(config)
+
+	db, err := initDatabase(config.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if status, err := fileStatus(db, book); err != nil || status != fileStatusBaseline {
+		t.Errorf("status of %s = %q, %v, want baseline", book, status, err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Conversion outcomes recorded in the conversions table
+const (
+	conversionConverted = "converted"
+	conversionFailed    = "failed"
+)
+
+// Converter turns a book the destination doesn't accept into EPUB
+type Converter interface {
+	// Name identifies the converter in logs and the conversions table
+	Name() string
+	// Convert writes an EPUB version of src into dir and returns its path
+	Convert(src, dir string) (string, error)
+}
+
+const createConversionsSQL = `
+	CREATE TABLE IF NOT EXISTS conversions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_path TEXT NOT NULL,
+		file_hash TEXT,
+		source_format TEXT NOT NULL,
+		converter TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		output_size INTEGER,
+		duration_ms INTEGER,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_conversions_file_path ON conversions(file_path);
+	`
+
+// defaultConvertFormats is the CONVERT_FORMATS default. The native converter
+// can't read KF8-only AZW3 books, so AZW3 is only converted by default when
+// CONVERTER would pick ebook-convert.
+func defaultConvertFormats(converter, ebookConvertPath string) string {
+	switch converter {
+	case "ebook-convert":
+		return ".mobi,.azw,.azw3"
+	case "auto":
+		if _, err := exec.LookPath(ebookConvertPath); err == nil {
+			return ".mobi,.azw,.azw3"
+		}
+	}
+	return ".mobi,.azw"
+}
+
+// newConverter builds the converter selected by CONVERTER. It returns nil
+// when conversion is disabled.
+func newConverter(config *Config) (Converter, error) {
+	if len(config.ConvertFormats) == 0 {
+		return nil, nil
+	}
+	switch config.Converter {
+	case "none":
+		return nil, nil
+	case "native":
+		return &nativeConverter{}, nil
+	case "ebook-convert":
+		path, err := exec.LookPath(config.EbookConvertPath)
+		if err != nil {
+			return nil, fmt.Errorf("ebook-convert not found: %w", err)
+		}
+		return &ebookConverter{path: path, timeout: time.Duration(config.ConvertTimeout) * time.Second}, nil
+	case "auto":
+		// Prefer calibre when the image ships it
+		if path, err := exec.LookPath(config.EbookConvertPath); err == nil {
+			return &ebookConverter{path: path, timeout: time.Duration(config.ConvertTimeout) * time.Second}, nil
+		}
+		return &nativeConverter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown converter %q (expected auto, ebook-convert, native or none)", config.Converter)
+	}
+}
+
+// ebookConverter runs calibre's ebook-convert
+type ebookConverter struct {
+	path    string
+	timeout time.Duration
+}
+
+func (c *ebookConverter) Name() string { return "ebook-convert" }
+
+func (c *ebookConverter) Convert(src, dir string) (string, error) {
+	out := filepath.Join(dir, convertedName(src))
+	// calibre writes its configuration under HOME
+	if _, err := runTool(c.timeout, []string{"HOME=" + dir}, c.path, src, out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// runTool runs an external program with extra environment variables,
+// killing it after timeout. Failures include the tail of its output.
+func runTool(timeout time.Duration, env []string, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	// Don't wait forever on helper processes still holding the output pipe
+	cmd.WaitDelay = 10 * time.Second
+	output, err := cmd.CombinedOutput()
+	tool := filepath.Base(name)
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s timed out after %s", tool, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", tool, err, lastLines(string(output), 5))
+	}
+	return output, nil
+}
+
+// lastLines returns at most n trailing lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " | ")
+}
+
+// convertedName is the file name of the EPUB made from src
+func convertedName(src string) string {
+	base := filepath.Base(src)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + ".epub"
+}
+
+// needsConversion reports whether filePath has one of CONVERT_FORMATS
+func needsConversion(filePath string, config *Config) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	for _, format := range config.ConvertFormats {
+		if strings.ToLower(strings.TrimSpace(format)) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// convertForDelivery converts a queued book into dir and records the outcome
+func convertForDelivery(item *QueueItem, converter Converter, dir string, db *sql.DB) (string, error) {
+	start := time.Now()
+	out, convErr := converter.Convert(item.FilePath, dir)
+	duration := time.Since(start)
+
+	var outputSize sql.NullInt64
+	if convErr == nil {
+		info, err := os.Stat(out)
+		if err != nil {
+			convErr = fmt.Errorf("converted file missing: %w", err)
+		} else {
+			outputSize = sql.NullInt64{Int64: info.Size(), Valid: true}
+		}
+	}
+
+	status := conversionConverted
+	var errText sql.NullString
+	if convErr != nil {
+		status = conversionFailed
+		errText = sql.NullString{String: convErr.Error(), Valid: true}
+	}
+	conversionsTotal.WithLabelValues(converter.Name(), status).Inc()
+
+	_, err := db.Exec(
+		`INSERT INTO conversions (file_path, file_hash, source_format, converter, status, error, output_size, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.FilePath, item.FileHash, strings.TrimPrefix(strings.ToLower(filepath.Ext(item.FilePath)), "."),
+		converter.Name(), status, errText, outputSize, duration.Milliseconds(),
+	)
+	if err != nil {
+		log.Printf("Error recording conversion of %s: %v", item.FilePath, err)
+	}
+	return out, convErr
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// formatRank is the position of a file's format in FORMAT_PREFERENCE, lower
+// being better, or -1 if the format isn't listed
+func formatRank(fileName string, preference []string) int {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for i, preferred := range preference {
+		if strings.ToLower(strings.TrimSpace(preferred)) == ext {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameBook reports whether two files in one folder are copies of the same
+// book: they share a file name apart from the extension, as Bookshelf names
+// them, or carry the same title and author
+func sameBook(pathA string, metaA BookMetadata, pathB string, metaB BookMetadata) bool {
+	stemA := strings.TrimSuffix(filepath.Base(pathA), filepath.Ext(pathA))
+	stemB := strings.TrimSuffix(filepath.Base(pathB), filepath.Ext(pathB))
+	if strings.EqualFold(stemA, stemB) {
+		return true
+	}
+	return metaA.Title != "" && strings.EqualFold(metaA.Title, metaB.Title) && strings.EqualFold(metaA.Author, metaB.Author)
+}
+
+// preferredSibling returns a copy of the same book in a better format next to
+// filePath, or "" if filePath is the best one. Only copies some profile can
+// send count, so a book isn't superseded by one that would never arrive.
+func preferredSibling(filePath string, meta BookMetadata, config *Config, db *sql.DB, router *Router) (string, error) {
+	rank := formatRank(filePath, config.FormatPreference)
+	if rank < 0 {
+		return "", nil
+	}
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		return "", err
+	}
+
+	best, bestRank := "", rank
+	for _, entry := range entries {
+		sibling := filepath.Join(filepath.Dir(filePath), entry.Name())
+		siblingRank := formatRank(entry.Name(), config.FormatPreference)
+		if entry.IsDir() || siblingRank < 0 || siblingRank >= bestRank || sibling == filePath {
+			continue
+		}
+		if !isSupportedFile(entry.Name(), config.FileExtensions) || isIgnoredPath(sibling, config) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if status, err := fileStatus(db, sibling); err != nil || status == fileStatusSuperseded {
+			continue
+		}
+		sendable := false
+		for _, target := range router.Targets(sibling) {
+			if ok, _ := target.Profile.acceptsFile(entry.Name(), info.Size()); ok {
+				sendable = true
+				break
+			}
+		}
+		if !sendable {
+			continue
+		}
+
+		siblingMeta, err := extractMetadata(sibling)
+		if err != nil {
+			log.Printf("Error extracting metadata from %s: %v", entry.Name(), err)
+		}
+		if sameBook(filePath, meta, sibling, siblingMeta) {
+			best, bestRank = sibling, siblingRank
+		}
+	}
+	return best, nil
+}
+
+// markFileSuperseded records that filePath won't be sent because a better
+// format of the book sits next to it. Files already sent keep their status.
+func markFileSuperseded(db *sql.DB, filePath string, fileSize int64, fileHash string, meta BookMetadata, by string) error {
+	result, err := db.Exec(
+		`INSERT INTO sent_files (file_path, file_size, file_hash, title, author, language, isbn, status, superseded_by, email_sent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0)
+		ON CONFLICT(file_path) DO UPDATE SET status = excluded.status, superseded_by = excluded.superseded_by
+		WHERE sent_files.status NOT IN (?, ?)`,
+		filePath, fileSize, fileHash, meta.Title, meta.Author, meta.Language, meta.ISBN, fileStatusSuperseded, by,
+		fileStatusSent, fileStatusMoved,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated > 0 {
+		filesSuperseded.Inc()
+	}
+	return nil
+}
+
+// supersedeQueuedSiblings takes worse formats of the book at filePath that
+// are still waiting in the send queue out of it. Copies already sent stay
+// sent.
+func supersedeQueuedSiblings(db *sql.DB, filePath string, meta BookMetadata, config *Config) error {
+	rank := formatRank(filePath, config.FormatPreference)
+	if rank < 0 {
+		return nil
+	}
+	rows, err := db.Query(
+		"SELECT DISTINCT file_path, file_size, file_hash, title, author, language, isbn FROM send_queue WHERE status IN (?, ?)",
+		queueStatusPending, queueStatusHeld,
+	)
+	if err != nil {
+		return err
+	}
+	type queuedFile struct {
+		path string
+		size int64
+		hash string
+		meta BookMetadata
+	}
+	var worse []queuedFile
+	for rows.Next() {
+		var f queuedFile
+		var fileHash, title, author, language, isbn sql.NullString
+		if err := rows.Scan(&f.path, &f.size, &fileHash, &title, &author, &language, &isbn); err != nil {
+			rows.Close()
+			return err
+		}
+		f.hash = fileHash.String
+		f.meta = BookMetadata{Title: title.String, Author: author.String, Language: language.String, ISBN: isbn.String}
+		siblingRank := formatRank(f.path, config.FormatPreference)
+		if filepath.Dir(f.path) == filepath.Dir(filePath) && siblingRank > rank && sameBook(filePath, meta, f.path, f.meta) {
+			worse = append(worse, f)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range worse {
+		if _, err := db.Exec("DELETE FROM send_queue WHERE file_path = ? AND status IN (?, ?)", f.path, queueStatusPending, queueStatusHeld); err != nil {
+			return err
+		}
+		if err := markFileSuperseded(db, f.path, f.size, f.hash, f.meta, filePath); err != nil {
+			return err
+		}
+		log.Printf("Superseded %s by %s", filepath.Base(f.path), filepath.Base(filePath))
+	}
+	return nil
+}
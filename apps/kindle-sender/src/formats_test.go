@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPreferredSibling(t *testing.T) {
+	config := newTestConfig(t)
+	config.FileExtensions = []string{".epub", ".pdf", ".azw3", ".mobi"}
+	config.FormatPreference = []string{".epub", ".pdf", ".azw3"}
+	db := newTestDB(t)
+	router, err := newRouter(config, newTestProfiles(t, config, &recordingTransport{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder := filepath.Join(config.WatchPath, "Frank Herbert", "Dune")
+	for _, name := range []string{"Dune.epub", "Dune.pdf", "Dune.azw3", "Dune.mobi", "Other.pdf"} {
+		writeTestFile(t, filepath.Join(folder, name), name)
+	}
+	epub := filepath.Join(folder, "Dune.epub")
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Dune.epub", ""},
+		{"Dune.pdf", epub},
+		{"Dune.azw3", epub},
+		// Formats not in the list are always sent
+		{"Dune.mobi", ""},
+		// and so are other books
+		{"Other.pdf", ""},
+	}
+	for _, tt := range tests {
+		got, err := preferredSibling(filepath.Join(folder, tt.name), BookMetadata{}, config, db, router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("preferredSibling(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// A better format no profile sends doesn't supersede anything
+	config.FileExtensions = []string{".pdf", ".azw3"}
+	if got, _ := preferredSibling(filepath.Join(folder, "Dune.azw3"), BookMetadata{}, config, db, router); got != filepath.Join(folder, "Dune.pdf") {
+		t.Errorf("preferredSibling(Dune.azw3) without EPUBs = %q, want the PDF", got)
+	}
+
+	// Without FORMAT_PREFERENCE every format is sent
+	config.FormatPreference = nil
+	if got, _ := preferredSibling(filepath.Join(folder, "Dune.pdf"), BookMetadata{}, config, db, router); got != "" {
+		t.Errorf("preferredSibling(Dune.pdf) without a preference = %q, want none", got)
+	}
+}
+
+func TestFormatPreferenceSendsBestFormat(t *testing.T) {
+	config := newTestConfig(t)
+	config.FileExtensions = []string{".epub", ".pdf", ".azw3", ".mobi"}
+	config.FormatPreference = []string{".epub", ".pdf", ".azw3"}
+	db := newTestDB(t)
+	router, err := newRouter(config, newTestProfiles(t, config, &recordingTransport{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	approver, err := newApprover(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := filepath.Join(config.WatchPath, "Dune")
+	path := func(name string) string { return filepath.Join(folder, name) }
+	process := func(name string) {
+		t.Helper()
+		writeTestFile(t, path(name), name)
+		if err := processFile(path(name), config, db, router, approver, BookMetadata{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The PDF arrives first and is queued; the EPUB arriving next takes its
+	// place, and the AZW3 after it is skipped
+	process("Dune.pdf")
+	if status, _ := queueStatus(db, path("Dune.pdf"), config.KindleEmail); status != queueStatusPending {
+		t.Fatalf("Dune.pdf queue status = %q, want pending", status)
+	}
+	process("Dune.epub")
+	process("Dune.azw3")
+	process("Dune.mobi")
+
+	for _, tt := range []struct {
+		name       string
+		wantQueued bool
+	}{
+		{"Dune.epub", true},
+		{"Dune.pdf", false},
+		{"Dune.azw3", false},
+		{"Dune.mobi", true},
+	} {
+		status, err := queueStatus(db, path(tt.name), config.KindleEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queued := status == queueStatusPending; queued != tt.wantQueued {
+			t.Errorf("%s queued = %v, want %v", tt.name, queued, tt.wantQueued)
+		}
+		if tt.wantQueued {
+			continue
+		}
+		var sentStatus, by string
+		if err := db.QueryRow("SELECT status, superseded_by FROM sent_files WHERE file_path = ?", path(tt.name)).Scan(&sentStatus, &by); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if sentStatus != fileStatusSuperseded || by != path("Dune.epub") {
+			t.Errorf("%s = %s by %q, want superseded by the EPUB", tt.name, sentStatus, by)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+)
+
+// hashFile returns the hex SHA-256 of a file's contents, streamed so large
+// books are never held in memory
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// recordFileMove tracks a known book at a new path without sending it again
+func recordFileMove(db *sql.DB, filePath string, fileSize int64, fileHash string, movedFrom string) error {
+	_, err := db.Exec(
+		"INSERT OR IGNORE INTO sent_files (file_path, file_size, file_hash, moved_from, status, email_sent) VALUES (?, ?, ?, ?, ?, 0)",
+		filePath, fileSize, fileHash, movedFrom, fileStatusMoved,
+	)
+	return err
+}
+
+// backfillFileHashes hashes sent files recorded before content hashes were
+// tracked. Files that no longer exist keep a NULL hash.
+func backfillFileHashes(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, file_path FROM sent_files WHERE file_hash IS NULL")
+	if err != nil {
+		return err
+	}
+	type pendingRow struct {
+		id       int64
+		filePath string
+	}
+	var pending []pendingRow
+	for rows.Next() {
+		var row pendingRow
+		if err := rows.Scan(&row.id, &row.filePath); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	log.Printf("Backfilling content hashes for %d sent files...", len(pending))
+	hashed := 0
+	for _, row := range pending {
+		fileHash, err := hashFile(row.filePath)
+		if err != nil {
+			continue
+		}
+		if _, err := db.Exec("UPDATE sent_files SET file_hash = ? WHERE id = ?", fileHash, row.id); err != nil {
+			return err
+		}
+		hashed++
+	}
+	log.Printf("Backfilled content hashes for %d/%d sent files", hashed, len(pending))
+	return nil
+}
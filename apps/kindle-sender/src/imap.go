@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// imapSessionTimeout bounds one check of the mailbox
+	imapSessionTimeout = 2 * time.Minute
+	// imapMaxLiteral caps a message fetched from the server; rejection
+	// notices are a few kilobytes
+	imapMaxLiteral = 10 << 20
+)
+
+// imapClient speaks the small part of IMAP4rev1 the rejection poller needs:
+// logging in, opening a mailbox read-only, searching by UID and fetching
+// messages without marking them seen
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	host string
+	tls  bool
+	tag  int
+}
+
+// imapResponse is one untagged server response, with the contents of any
+// literals it carried
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// dialIMAP connects to addr and sets up TLS according to mode, one of the
+// SMTP_TLS_MODE values
+func dialIMAP(host, port, mode string, tlsConfig *tls.Config) (*imapClient, error) {
+	addr := net.JoinHostPort(host, port)
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if mode == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(imapSessionTimeout))
+
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn), host: host, tls: mode == smtpTLSImplicit}
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting %q", greeting)
+	}
+
+	if mode == smtpTLSStartTLS {
+		// Never fall back to plaintext when STARTTLS was asked for
+		if _, err := c.command("STARTTLS"); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("IMAP server %s does not offer STARTTLS: %w", addr, err)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn, c.r, c.tls = tlsConn, bufio.NewReader(tlsConn), true
+	}
+	return c, nil
+}
+
+// Login authenticates with a password, refusing to send it in the clear
+// except to localhost
+func (c *imapClient) Login(user, password string) error {
+	if !c.tls && !isLocalhost(c.host) {
+		return errors.New("refusing to log in over an unencrypted connection")
+	}
+	_, err := c.command("LOGIN " + imapQuote(user) + " " + imapQuote(password))
+	return err
+}
+
+// AuthenticateXOAUTH2 logs in with an OAuth2 access token
+func (c *imapClient) AuthenticateXOAUTH2(user, token string) error {
+	if !c.tls && !isLocalhost(c.host) {
+		return errors.New("refusing to send a token over an unencrypted connection")
+	}
+	resp := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", user, token)
+	_, err := c.command("AUTHENTICATE XOAUTH2 " + base64.StdEncoding.EncodeToString([]byte(resp)))
+	return err
+}
+
+// Examine opens mailbox read-only and returns its UIDVALIDITY
+func (c *imapClient) Examine(mailbox string) (uint32, error) {
+	responses, err := c.command("EXAMINE " + imapQuote(mailbox))
+	if err != nil {
+		return 0, err
+	}
+	for _, resp := range responses {
+		if _, rest, ok := strings.Cut(resp.line, "[UIDVALIDITY "); ok {
+			value, _, _ := strings.Cut(rest, "]")
+			validity, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid UIDVALIDITY %q", value)
+			}
+			return uint32(validity), nil
+		}
+	}
+	return 0, errors.New("server did not report UIDVALIDITY")
+}
+
+// UIDSearch returns the UIDs of the messages matching criteria
+func (c *imapClient) UIDSearch(criteria string) ([]uint32, error) {
+	responses, err := c.command("UID SEARCH " + criteria)
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, resp := range responses {
+		if !strings.HasPrefix(resp.line, "* SEARCH") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(resp.line, "* SEARCH")) {
+			uid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid UID %q in search results", field)
+			}
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids, nil
+}
+
+// FetchMessage returns the full message with this UID, leaving its \Seen
+// flag alone
+func (c *imapClient) FetchMessage(uid uint32) ([]byte, error) {
+	responses, err := c.command(fmt.Sprintf("UID FETCH %d (BODY.PEEK[])", uid))
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range responses {
+		if strings.Contains(resp.line, " FETCH ") && len(resp.literals) > 0 {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("message %d not found", uid)
+}
+
+// Logout ends the session and closes the connection
+func (c *imapClient) Logout() error {
+	_, err := c.command("LOGOUT")
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// command sends one tagged command and collects the untagged responses until
+// its completion. A failed command returns the server's text as the error.
+func (c *imapClient) command(cmd string) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, cmd); err != nil {
+		return nil, err
+	}
+
+	var responses []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(resp.line, tag+" "):
+			status := strings.TrimPrefix(resp.line, tag+" ")
+			if strings.HasPrefix(status, "OK") {
+				return responses, nil
+			}
+			verb, _, _ := strings.Cut(cmd, " ")
+			return nil, fmt.Errorf("IMAP %s failed: %s", verb, status)
+		case strings.HasPrefix(resp.line, "+"):
+			// A challenge during AUTHENTICATE carries the error; an empty
+			// response lets the server report it
+			if _, err := io.WriteString(c.conn, "\r\n"); err != nil {
+				return nil, err
+			}
+		default:
+			responses = append(responses, resp)
+		}
+	}
+}
+
+// readResponse reads one response line, reading the literals announced with
+// {n} at the end of a line in between
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return resp, err
+		}
+		resp.line += line
+
+		open := strings.LastIndexByte(line, '{')
+		if open < 0 || !strings.HasSuffix(line, "}") {
+			return resp, nil
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(line[open+1:len(line)-1], "+"))
+		if err != nil {
+			return resp, nil
+		}
+		if size > imapMaxLiteral {
+			return resp, fmt.Errorf("IMAP literal of %d bytes is too large", size)
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+func (c *imapClient) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// imapQuote makes s an IMAP quoted string
+func imapQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
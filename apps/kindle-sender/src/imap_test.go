@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// imapStandIn is a minimal IMAP server holding one mailbox
+type imapStandIn struct {
+	listener    net.Listener
+	user        string
+	password    string
+	token       string
+	uidValidity uint32
+	messages    map[uint32]string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func startIMAPStandIn(t *testing.T, messages map[uint32]string) *imapStandIn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &imapStandIn{
+		listener:    listener,
+		user:        "sender@example.com",
+		password:    "secret",
+		token:       "access",
+		uidValidity: 7,
+		messages:    messages,
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *imapStandIn) Port() string {
+	return fmt.Sprint(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Commands returns the commands received so far, without their tags
+func (s *imapStandIn) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *imapStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("* OK IMAP4rev1 stand-in ready")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, cmd, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		verb, args, _ := strings.Cut(cmd, " ")
+		switch strings.ToUpper(verb) {
+		case "LOGIN":
+			if args != imapQuote(s.user)+" "+imapQuote(s.password) {
+				reply("%s NO [AUTHENTICATIONFAILED] Invalid credentials", tag)
+				continue
+			}
+			reply("%s OK LOGIN completed", tag)
+		case "AUTHENTICATE":
+			want := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", s.user, s.token)))
+			if args == "XOAUTH2 "+want {
+				reply("%s OK AUTHENTICATE completed", tag)
+				continue
+			}
+			// Like Gmail, report the failure as a challenge and wait for an
+			// empty response before the tagged NO
+			reply("+ %s", base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"Bearer"}`)))
+			if response, err := r.ReadString('\n'); err != nil || strings.TrimRight(response, "\r\n") != "" {
+				return
+			}
+			reply("%s NO [AUTHENTICATIONFAILED] Invalid credentials", tag)
+		case "EXAMINE":
+			reply("* %d EXISTS", len(s.messages))
+			reply("* OK [UIDVALIDITY %d] UIDs valid", s.uidValidity)
+			reply("%s OK [READ-ONLY] EXAMINE completed", tag)
+		case "UID":
+			sub, rest, _ := strings.Cut(args, " ")
+			switch strings.ToUpper(sub) {
+			case "SEARCH":
+				var uids []int
+				for uid := range s.messages {
+					uids = append(uids, int(uid))
+				}
+				sort.Ints(uids)
+				var found strings.Builder
+				for _, uid := range uids {
+					fmt.Fprintf(&found, " %d", uid)
+				}
+				reply("* SEARCH%s", found.String())
+				reply("%s OK SEARCH completed", tag)
+			case "FETCH":
+				var uid uint32
+				fmt.Sscan(rest, &uid)
+				msg, ok := s.messages[uid]
+				if ok {
+					fmt.Fprintf(conn, "* %d FETCH (UID %d BODY[] {%d}\r\n%s FLAGS ())\r\n", uid, uid, len(msg), msg)
+				}
+				reply("%s OK FETCH completed", tag)
+			default:
+				reply("%s BAD unknown UID command", tag)
+			}
+		case "LOGOUT":
+			reply("* BYE logging out")
+			reply("%s OK LOGOUT completed", tag)
+			return
+		default:
+			reply("%s BAD unknown command", tag)
+		}
+	}
+}
+
+func TestIMAPReadResponseLiterals(t *testing.T) {
+	first := "Subject: {5}\r\n\r\nbody with a } brace\r\n"
+	second := "second"
+	input := fmt.Sprintf("* 1 FETCH (BODY[HEADER] {%d}\r\n%s BODY[TEXT] {%d+}\r\n%s)\r\n* 2 EXISTS\r\n", len(first), first, len(second), second)
+	c := &imapClient{r: bufio.NewReader(strings.NewReader(input))}
+
+	resp, err := c.readResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.literals) != 2 || string(resp.literals[0]) != first || string(resp.literals[1]) != second {
+		t.Fatalf("literals = %q, want %q and %q", resp.literals, first, second)
+	}
+	if want := fmt.Sprintf("* 1 FETCH (BODY[HEADER] {%d} BODY[TEXT] {%d+})", len(first), len(second)); resp.line != want {
+		t.Errorf("line = %q, want %q", resp.line, want)
+	}
+
+	// The response after the literals is read on its own
+	resp, err = c.readResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.line != "* 2 EXISTS" || len(resp.literals) != 0 {
+		t.Errorf("next response = %+v, want * 2 EXISTS", resp)
+	}
+}
+
+func TestIMAPClientSession(t *testing.T) {
+	message := "From: Amazon <do-not-reply@amazon.com>\r\nSubject: Test\r\n\r\nHello\r\n"
+	server := startIMAPStandIn(t, map[uint32]string{3: message, 5: "From: someone@example.com\r\n\r\nHi\r\n"})
+
+	client, err := dialIMAP("127.0.0.1", server.Port(), smtpTLSNone, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Login(server.user, server.password); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	validity, err := client.Examine("INBOX")
+	if err != nil {
+		t.Fatalf("Examine: %v", err)
+	}
+	if validity != server.uidValidity {
+		t.Errorf("UIDVALIDITY = %d, want %d", validity, server.uidValidity)
+	}
+	uids, err := client.UIDSearch(`FROM "amazon"`)
+	if err != nil {
+		t.Fatalf("UIDSearch: %v", err)
+	}
+	if fmt.Sprint(uids) != "[3 5]" {
+		t.Errorf("UIDSearch = %v, want [3 5]", uids)
+	}
+	raw, err := client.FetchMessage(3)
+	if err != nil {
+		t.Fatalf("FetchMessage: %v", err)
+	}
+	if string(raw) != message {
+		t.Errorf("FetchMessage = %q, want %q", raw, message)
+	}
+	if _, err := client.FetchMessage(4); err == nil {
+		t.Error("FetchMessage of a missing UID succeeded")
+	}
+	if err := client.Logout(); err != nil {
+		t.Errorf("Logout: %v", err)
+	}
+
+	// Messages are opened read-only and fetched without marking them seen
+	for _, cmd := range server.Commands() {
+		if strings.HasPrefix(cmd, "SELECT") || (strings.HasPrefix(cmd, "UID FETCH") && !strings.Contains(cmd, "BODY.PEEK[]")) {
+			t.Errorf("command %q would change the mailbox", cmd)
+		}
+	}
+}
+
+func TestIMAPLoginFailure(t *testing.T) {
+	server := startIMAPStandIn(t, nil)
+	client, err := dialIMAP("127.0.0.1", server.Port(), smtpTLSNone, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout()
+
+	err = client.Login(server.user, "wrong")
+	if err == nil || !strings.Contains(err.Error(), "AUTHENTICATIONFAILED") {
+		t.Fatalf("Login() error = %v, want the server's refusal", err)
+	}
+}
+
+func TestIMAPAuthenticateXOAUTH2(t *testing.T) {
+	server := startIMAPStandIn(t, nil)
+
+	client, err := dialIMAP("127.0.0.1", server.Port(), smtpTLSNone, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AuthenticateXOAUTH2(server.user, server.token); err != nil {
+		t.Fatalf("AuthenticateXOAUTH2: %v", err)
+	}
+	client.Logout()
+
+	// A rejected token is reported through a continuation request, which
+	// the client answers with an empty line to get the tagged failure
+	client, err = dialIMAP("127.0.0.1", server.Port(), smtpTLSNone, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Logout()
+	err = client.AuthenticateXOAUTH2(server.user, "expired")
+	if err == nil || !strings.Contains(err.Error(), "AUTHENTICATIONFAILED") {
+		t.Fatalf("AuthenticateXOAUTH2() error = %v, want the server's refusal", err)
+	}
+}
@@ -2,13 +2,12 @@ package main
 
 import (
 	"database/sql"
-	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
-	"net/smtp"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +20,10 @@ import (
 
 type Config struct {
 	WatchPath       string
+	WatchMode       string
+	PollInterval    int
+	SettleSeconds   int
+	IgnorePatterns  []string
 	ScanInterval    int
 	MaxFileSizeMB   int
 	FileExtensions  []string
@@ -29,69 +32,194 @@ type Config struct {
 	SMTPUser        string
 	SMTPPassword    string
 	KindleEmail     string
+	Routes          string
+	Profiles        []string
 	SenderEmail     string
 	DatabasePath    string
 	MetricsPort     string
+	AdminToken      string
+	BookshelfToken  string
 	MaxBooksPerHour int
+	MaxBooksPerDay  int
+
+	DeliveryWindows  string
+	DeliveryTimezone string
+
+	BatchMaxAttachments int
+	BatchMaxSizeMB      int
+
+	// Sender mailbox checked for rejection notices
+	IMAPHost         string
+	IMAPPort         string
+	IMAPTLSMode      string
+	IMAPUser         string
+	IMAPPassword     string
+	IMAPMailbox      string
+	IMAPPollInterval int
+
+	BaselineOnEmptyDB bool
+	ReconcileInterval int
+	FormatPreference  []string
+	ResendOnUpgrade   bool
+
+	RequireApproval        bool
+	ApprovalAutoPaths      []string
+	ApprovalAutoExtensions []string
+	ApprovalAutoMinSizeKB  int
+	ApprovalAutoMaxSizeMB  int
+	ApprovalNotifyURL      string
+	ApprovalNotifyToken    string
+	ApprovalBaseURL        string
+	ApprovalSecret         string
+	ApprovalLinkTTL        int
+
+	Transport      string
+	TransportPath  string
+	WebhookURL     string
+	WebhookToken   string
+	WebhookTimeout int
+
+	QueuePollInterval    int
+	SendMaxAttempts      int
+	SendRetryBaseSeconds int
+	SendRetryMaxSeconds  int
+
+	SMTPTLSMode string
+	SMTPCAFile  string
+	SMTPAuth    string
+
+	ConvertFormats   []string
+	Converter        string
+	EbookConvertPath string
+	ConvertTimeout   int
+	ScratchDir       string
+
+	ShrinkOversized         bool
+	ShrinkJPEGQuality       int
+	ShrinkMaxImageDimension int
+	ShrinkPDFSteps          []string
+	ShrinkMaxVolumes        int
+	GhostscriptPath         string
+	QPDFPath                string
+
+	// OAuth2 client for SMTP_AUTH=xoauth2
+	OAuth2ClientID     string
+	OAuth2ClientSecret string
+	OAuth2RefreshToken string
+	OAuth2TokenURL     string
 }
 
 // Rate limiter state
 type RateLimiter struct {
-	sendTimes []time.Time
+	sendTimes  []time.Time
 	maxPerHour int
+	maxPerDay  int
 }
 
-func NewRateLimiter(maxPerHour int) *RateLimiter {
+func NewRateLimiter(maxPerHour int, maxPerDay int) *RateLimiter {
 	return &RateLimiter{
 		sendTimes:  make([]time.Time, 0),
 		maxPerHour: maxPerHour,
+		maxPerDay:  maxPerDay,
 	}
 }
 
+// Seed restores send times recorded before a restart
+func (r *RateLimiter) Seed(times []time.Time) {
+	r.sendTimes = append(r.sendTimes, times...)
+	sort.Slice(r.sendTimes, func(i, j int) bool { return r.sendTimes[i].Before(r.sendTimes[j]) })
+	r.cleanup()
+}
+
 func (r *RateLimiter) CanSend() bool {
 	r.cleanup()
-	return len(r.sendTimes) < r.maxPerHour
+	if r.countSince(time.Hour) >= r.maxPerHour {
+		return false
+	}
+	return r.maxPerDay <= 0 || r.countSince(24*time.Hour) < r.maxPerDay
 }
 
 func (r *RateLimiter) RecordSend() {
 	r.sendTimes = append(r.sendTimes, time.Now())
 }
 
+// window is how far back send times are kept
+func (r *RateLimiter) window() time.Duration {
+	if r.maxPerDay > 0 {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
+
 func (r *RateLimiter) cleanup() {
-	oneHourAgo := time.Now().Add(-time.Hour)
+	cutoff := time.Now().Add(-r.window())
 	newTimes := make([]time.Time, 0)
 	for _, t := range r.sendTimes {
-		if t.After(oneHourAgo) {
+		if t.After(cutoff) {
 			newTimes = append(newTimes, t)
 		}
 	}
 	r.sendTimes = newTimes
 }
 
+// countSince counts sends within the last d
+func (r *RateLimiter) countSince(d time.Duration) int {
+	cutoff := time.Now().Add(-d)
+	count := 0
+	for _, t := range r.sendTimes {
+		if t.After(cutoff) {
+			count++
+		}
+	}
+	return count
+}
+
+// timeUntilFree returns when a send slot frees up for a limit over window d
+func (r *RateLimiter) timeUntilFree(d time.Duration, limit int) time.Duration {
+	cutoff := time.Now().Add(-d)
+	var inWindow []time.Time
+	for _, t := range r.sendTimes {
+		if t.After(cutoff) {
+			inWindow = append(inWindow, t)
+		}
+	}
+	if len(inWindow) < limit || len(inWindow) == 0 {
+		return 0
+	}
+	// The slot frees up when enough of the oldest sends leave the window
+	return time.Until(inWindow[len(inWindow)-limit].Add(d))
+}
+
 func (r *RateLimiter) TimeUntilNextSlot() time.Duration {
 	if r.CanSend() {
 		return 0
 	}
-	r.cleanup()
-	if len(r.sendTimes) == 0 {
-		return 0
+	wait := r.timeUntilFree(time.Hour, r.maxPerHour)
+	if r.maxPerDay > 0 {
+		if dayWait := r.timeUntilFree(24*time.Hour, r.maxPerDay); dayWait > wait {
+			wait = dayWait
+		}
 	}
-	// Oldest send time + 1 hour = when that slot frees up
-	oldestSend := r.sendTimes[0]
-	return time.Until(oldestSend.Add(time.Hour))
+	return wait
 }
 
 func (r *RateLimiter) SentThisHour() int {
 	r.cleanup()
-	return len(r.sendTimes)
+	return r.countSince(time.Hour)
+}
+
+// SentToday counts sends over the rolling last 24 hours
+func (r *RateLimiter) SentToday() int {
+	r.cleanup()
+	return r.countSince(24 * time.Hour)
 }
 
 // Prometheus metrics
 var (
-	filesSentTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	filesSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kindle_sender_files_sent_total",
 		Help: "Total number of files successfully sent to Kindle",
-	})
+	}, []string{"profile"})
 	filesSkippedTooLarge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "kindle_sender_file_too_large",
 		Help: "Files that are too large to send (1 = too large, includes file info in labels)",
@@ -100,22 +228,106 @@ var (
 		Name: "kindle_sender_files_too_large_total",
 		Help: "Total count of files that are too large to send",
 	})
-	filesSendErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	filesSendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kindle_sender_send_errors_total",
 		Help: "Total number of send errors",
-	})
-	filesRateLimited = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, []string{"profile"})
+	filesRateLimited = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "kindle_sender_rate_limited",
 		Help: "Whether sending is currently rate limited (1 = rate limited)",
-	})
-	filesSentThisHour = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, []string{"profile"})
+	filesSentThisHour = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "kindle_sender_files_sent_this_hour",
 		Help: "Number of files sent in the current hour window",
-	})
+	}, []string{"profile"})
+	filesSentToday = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kindle_sender_files_sent_today",
+		Help: "Number of files sent in the rolling 24 hour window",
+	}, []string{"profile"})
 	filesPending = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "kindle_sender_files_pending",
 		Help: "Number of files waiting to be sent",
 	})
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kindle_sender_queue_depth",
+		Help: "Number of files in the send queue awaiting delivery or retry",
+	})
+	queueDeadLetter = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kindle_sender_queue_dead_letter",
+		Help: "Number of files that exhausted their send attempts",
+	})
+	deliveryWindowOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kindle_sender_delivery_window_open",
+		Help: "Whether a profile is inside its delivery windows (1 = open)",
+	}, []string{"profile"})
+	queueHeld = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kindle_sender_queue_held",
+		Help: "Number of files in the send queue waiting for approval",
+	})
+	approvalDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_approval_decisions_total",
+		Help: "Total number of held queue items approved or rejected, by decision",
+	}, []string{"decision"})
+	rejectionNotices = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_rejection_notices_total",
+		Help: "Total number of Amazon rejection notices read, by whether they matched a delivery",
+	}, []string{"profile", "result"})
+	batchesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_batches_sent_total",
+		Help: "Total number of messages sent with more than one book",
+	}, []string{"profile"})
+	sendRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_send_retries_total",
+		Help: "Total number of failed sends scheduled for retry",
+	}, []string{"profile"})
+	lastSentBook = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kindle_sender_last_sent_book",
+		Help: "Unix time of the most recent delivery, labelled with the book's title and author",
+	}, []string{"title", "author"})
+	booksSentByLanguage = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_books_sent_by_language_total",
+		Help: "Total number of books sent, by language from the book metadata",
+	}, []string{"language"})
+	booksSentByRecipient = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_books_sent_by_recipient_total",
+		Help: "Total number of books sent, by profile and recipient address",
+	}, []string{"profile", "recipient"})
+	conversionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_conversions_total",
+		Help: "Total number of format conversions, by converter and result",
+	}, []string{"converter", "result"})
+	watchEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_watch_events_total",
+		Help: "Total number of file changes seen by the watcher, by event",
+	}, []string{"event"})
+	pollDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kindle_sender_poll_duration_seconds",
+		Help: "Duration of the last polling watcher pass",
+	})
+	stalePruned = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_stale_rows_pruned_total",
+		Help: "Total number of rows removed because their file was deleted or renamed, by table",
+	}, []string{"table"})
+	webhookEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_webhook_events_total",
+		Help: "Total number of Bookshelf webhook notifications received, by event type",
+	}, []string{"event_type"})
+	filesSettling = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kindle_sender_files_settling",
+		Help: "Number of files waiting to stop changing before they are processed",
+	})
+	filesSuperseded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kindle_sender_files_superseded_total",
+		Help: "Total number of files not sent because a preferred format of the same book was",
+	})
+	contentChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kindle_sender_content_changes_total",
+		Help: "Total number of new versions detected at the path of a sent book",
+	})
+	shrinkTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kindle_sender_shrink_total",
+		Help: "Total number of attempts to shrink oversized books, by format and result",
+	}, []string{"format", "result"})
 )
 
 func init() {
@@ -125,7 +337,28 @@ func init() {
 	prometheus.MustRegister(filesSendErrors)
 	prometheus.MustRegister(filesRateLimited)
 	prometheus.MustRegister(filesSentThisHour)
+	prometheus.MustRegister(filesSentToday)
 	prometheus.MustRegister(filesPending)
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(queueDeadLetter)
+	prometheus.MustRegister(queueHeld)
+	prometheus.MustRegister(deliveryWindowOpen)
+	prometheus.MustRegister(approvalDecisions)
+	prometheus.MustRegister(sendRetriesTotal)
+	prometheus.MustRegister(batchesSent)
+	prometheus.MustRegister(rejectionNotices)
+	prometheus.MustRegister(lastSentBook)
+	prometheus.MustRegister(booksSentByLanguage)
+	prometheus.MustRegister(booksSentByRecipient)
+	prometheus.MustRegister(conversionsTotal)
+	prometheus.MustRegister(shrinkTotal)
+	prometheus.MustRegister(filesSuperseded)
+	prometheus.MustRegister(contentChanges)
+	prometheus.MustRegister(watchEventsTotal)
+	prometheus.MustRegister(pollDuration)
+	prometheus.MustRegister(filesSettling)
+	prometheus.MustRegister(stalePruned)
+	prometheus.MustRegister(webhookEventsTotal)
 }
 
 type EmailMessage struct {
@@ -133,13 +366,27 @@ type EmailMessage struct {
 	To          string
 	Subject     string
 	Body        string
-	Attachment  string
+	Attachments []EmailAttachment
+
+	// Date, MessageID and Boundary are generated when left empty
+	Date      time.Time
+	MessageID string
+	Boundary  string
+}
+
+// EmailAttachment is a book file sent with a message
+type EmailAttachment struct {
+	Path        string
 	ContentType string
 }
 
 func loadConfig() *Config {
-	return &Config{
+	config := &Config{
 		WatchPath:       getEnv("WATCH_PATH", "/media/books"),
+		WatchMode:       strings.ToLower(getEnv("WATCH_MODE", defaultWatchMode)),
+		PollInterval:    getEnvInt("POLL_INTERVAL", 30),
+		SettleSeconds:   getEnvInt("SETTLE_SECONDS", 5),
+		IgnorePatterns:  splitList(getEnv("IGNORE_PATTERNS", "*.part,*.!qB,*.crdownload,*.tmp,_UNPACK_*,_FAILED_*")),
 		ScanInterval:    getEnvInt("SCAN_INTERVAL", 300),
 		MaxFileSizeMB:   getEnvInt("MAX_FILE_SIZE_MB", 50),
 		FileExtensions:  strings.Split(getEnv("FILE_EXTENSIONS", ".epub,.mobi,.azw3,.pdf"), ","),
@@ -148,11 +395,110 @@ func loadConfig() *Config {
 		SMTPUser:        getEnv("SMTP_USER", ""),
 		SMTPPassword:    getEnv("SMTP_PASSWORD", ""),
 		KindleEmail:     getEnv("KINDLE_EMAIL", ""),
+		Routes:          getEnv("ROUTES", ""),
+		Profiles:        splitList(getEnv("PROFILES", "")),
 		SenderEmail:     getEnv("SENDER_EMAIL", getEnv("SMTP_USER", "")),
 		DatabasePath:    getEnv("DATABASE_PATH", "/data/kindle-sender.db"),
 		MetricsPort:     getEnv("METRICS_PORT", "9090"),
+		AdminToken:      getEnv("ADMIN_TOKEN", ""),
+		BookshelfToken:  getEnv("WEBHOOK_TOKEN", ""),
 		MaxBooksPerHour: getEnvInt("MAX_BOOKS_PER_HOUR", 20),
+		MaxBooksPerDay:  getEnvInt("MAX_BOOKS_PER_DAY", 0),
+
+		DeliveryWindows:  getEnv("DELIVERY_WINDOWS", ""),
+		DeliveryTimezone: getEnv("DELIVERY_TIMEZONE", ""),
+
+		BatchMaxAttachments: getEnvInt("BATCH_MAX_ATTACHMENTS", 1),
+		BatchMaxSizeMB:      getEnvInt("BATCH_MAX_SIZE_MB", 50),
+
+		IMAPHost:         getEnv("IMAP_HOST", ""),
+		IMAPPort:         getEnv("IMAP_PORT", "993"),
+		IMAPTLSMode:      strings.ToLower(getEnv("IMAP_TLS_MODE", defaultIMAPTLSMode(getEnv("IMAP_PORT", "993")))),
+		IMAPUser:         getEnv("IMAP_USER", getEnv("SMTP_USER", "")),
+		IMAPPassword:     getEnv("IMAP_PASSWORD", getEnv("SMTP_PASSWORD", "")),
+		IMAPMailbox:      getEnv("IMAP_MAILBOX", "INBOX"),
+		IMAPPollInterval: getEnvInt("IMAP_POLL_INTERVAL", 300),
+
+		BaselineOnEmptyDB: getEnvBool("BASELINE_ON_EMPTY_DB", false),
+		ReconcileInterval: getEnvInt("RECONCILE_INTERVAL", 3600),
+		FormatPreference:  splitList(getEnv("FORMAT_PREFERENCE", "")),
+		ResendOnUpgrade:   getEnvBool("RESEND_ON_UPGRADE", false),
+
+		RequireApproval:        getEnvBool("REQUIRE_APPROVAL", false),
+		ApprovalAutoPaths:      splitList(getEnv("APPROVAL_AUTO_PATHS", "")),
+		ApprovalAutoExtensions: splitList(getEnv("APPROVAL_AUTO_EXTENSIONS", "")),
+		ApprovalAutoMinSizeKB:  getEnvInt("APPROVAL_AUTO_MIN_SIZE_KB", 0),
+		ApprovalAutoMaxSizeMB:  getEnvInt("APPROVAL_AUTO_MAX_SIZE_MB", 0),
+		ApprovalNotifyURL:      getEnv("APPROVAL_NOTIFY_URL", ""),
+		ApprovalNotifyToken:    getEnv("APPROVAL_NOTIFY_TOKEN", ""),
+		ApprovalBaseURL:        getEnv("APPROVAL_BASE_URL", ""),
+		ApprovalSecret:         getEnv("APPROVAL_SECRET", ""),
+		ApprovalLinkTTL:        getEnvInt("APPROVAL_LINK_TTL_HOURS", 168),
+
+		Transport:      strings.ToLower(getEnv("TRANSPORT", "smtp")),
+		TransportPath:  getEnv("TRANSPORT_PATH", ""),
+		WebhookURL:     getEnv("TRANSPORT_WEBHOOK_URL", ""),
+		WebhookToken:   getEnv("TRANSPORT_WEBHOOK_TOKEN", ""),
+		WebhookTimeout: getEnvInt("TRANSPORT_WEBHOOK_TIMEOUT", 300),
+
+		QueuePollInterval:    getEnvInt("QUEUE_POLL_INTERVAL", 15),
+		SendMaxAttempts:      getEnvInt("SEND_MAX_ATTEMPTS", 8),
+		SendRetryBaseSeconds: getEnvInt("SEND_RETRY_BASE_SECONDS", 60),
+		SendRetryMaxSeconds:  getEnvInt("SEND_RETRY_MAX_SECONDS", 21600),
+
+		SMTPTLSMode: strings.ToLower(getEnv("SMTP_TLS_MODE", defaultSMTPTLSMode(getEnv("SMTP_PORT", "587")))),
+		SMTPCAFile:  getEnv("SMTP_CA_FILE", ""),
+		SMTPAuth:    strings.ToLower(getEnv("SMTP_AUTH", "plain")),
+
+		Converter:        strings.ToLower(getEnv("CONVERTER", "auto")),
+		EbookConvertPath: getEnv("EBOOK_CONVERT_PATH", "ebook-convert"),
+		ConvertTimeout:   getEnvInt("CONVERT_TIMEOUT", 600),
+		ScratchDir:       getEnv("SCRATCH_DIR", os.TempDir()),
+
+		ShrinkOversized:         getEnvBool("SHRINK_OVERSIZED", false),
+		ShrinkJPEGQuality:       getEnvInt("SHRINK_JPEG_QUALITY", 70),
+		ShrinkMaxImageDimension: getEnvInt("SHRINK_MAX_IMAGE_DIMENSION", 1600),
+		ShrinkPDFSteps:          splitList(strings.ToLower(getEnv("SHRINK_PDF_STEPS", "compress,split"))),
+		ShrinkMaxVolumes:        getEnvInt("SHRINK_MAX_VOLUMES", 10),
+		GhostscriptPath:         getEnv("GHOSTSCRIPT_PATH", "gs"),
+		QPDFPath:                getEnv("QPDF_PATH", "qpdf"),
+
+		OAuth2ClientID:     getEnv("OAUTH2_CLIENT_ID", ""),
+		OAuth2ClientSecret: getEnv("OAUTH2_CLIENT_SECRET", ""),
+		OAuth2RefreshToken: getEnv("OAUTH2_REFRESH_TOKEN", ""),
+		OAuth2TokenURL:     getEnv("OAUTH2_TOKEN_URL", "https://oauth2.googleapis.com/token"),
 	}
+	config.ConvertFormats = splitList(getEnv("CONVERT_FORMATS", defaultConvertFormats(config.Converter, config.EbookConvertPath)))
+	return config
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// defaultSMTPTLSMode picks implicit TLS for the submissions port and STARTTLS
+// otherwise
+func defaultSMTPTLSMode(port string) string {
+	if port == "465" {
+		return "tls"
+	}
+	return "starttls"
+}
+
+// defaultIMAPTLSMode picks implicit TLS for the IMAPS port and STARTTLS
+// otherwise
+func defaultIMAPTLSMode(port string) string {
+	if port == "993" {
+		return "tls"
+	}
+	return "starttls"
 }
 
 func getEnv(key, defaultValue string) string {
@@ -163,6 +509,18 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		return defaultValue
+	}
+	return boolValue
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	value := os.Getenv(key)
 	if value == "" {
@@ -182,7 +540,9 @@ func initDatabase(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	// The send queue worker writes alongside the scanner and watcher, so wait
+	// on locks instead of failing immediately with SQLITE_BUSY
+	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -212,9 +572,155 @@ func initDatabase(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create table: %w", err)
 	}
 
+	if _, err := db.Exec(createSendQueueSQL); err != nil {
+		return nil, fmt.Errorf("failed to create send queue: %w", err)
+	}
+
+	if _, err := db.Exec(createConversionsSQL); err != nil {
+		return nil, fmt.Errorf("failed to create conversions table: %w", err)
+	}
+
+	if _, err := db.Exec(createDeliveriesSQL); err != nil {
+		return nil, fmt.Errorf("failed to create deliveries table: %w", err)
+	}
+
+	if _, err := db.Exec(createFileSnapshotsSQL); err != nil {
+		return nil, fmt.Errorf("failed to create file snapshots table: %w", err)
+	}
+
+	if _, err := db.Exec(createFileVersionsSQL); err != nil {
+		return nil, fmt.Errorf("failed to create file versions table: %w", err)
+	}
+
+	if _, err := db.Exec(createIMAPStateSQL); err != nil {
+		return nil, fmt.Errorf("failed to create IMAP state table: %w", err)
+	}
+
+	if _, err := db.Exec(createSentMessagesSQL); err != nil {
+		return nil, fmt.Errorf("failed to create sent messages table: %w", err)
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	return db, nil
 }
 
+// columnMigration adds a column to a table created by an earlier version
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+}
+
+// Columns added since the original schema, applied in order on startup
+var columnMigrations = []columnMigration{
+	{"sent_files", "file_hash", "TEXT"},
+	{"sent_files", "moved_from", "TEXT"},
+	{"send_queue", "file_hash", "TEXT"},
+	{"sent_files", "title", "TEXT"},
+	{"sent_files", "author", "TEXT"},
+	{"sent_files", "language", "TEXT"},
+	{"sent_files", "isbn", "TEXT"},
+	{"send_queue", "title", "TEXT"},
+	{"send_queue", "author", "TEXT"},
+	{"send_queue", "language", "TEXT"},
+	{"send_queue", "isbn", "TEXT"},
+	{"sent_files", "status", "TEXT NOT NULL DEFAULT 'sent'"},
+	{"send_queue", "force", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"oversized_files", "reason", "TEXT"},
+	{"send_queue", "recipient", "TEXT NOT NULL DEFAULT ''"},
+	{"send_queue", "profile", "TEXT NOT NULL DEFAULT 'default'"},
+	{"deliveries", "profile", "TEXT NOT NULL DEFAULT 'default'"},
+	{"sent_files", "superseded_by", "TEXT"},
+	{"sent_files", "file_mtime", "INTEGER"},
+	{"deliveries", "version", "INTEGER NOT NULL DEFAULT 1"},
+	{"deliveries", "batch_id", "TEXT"},
+	{"deliveries", "rejection_reason", "TEXT"},
+	{"send_queue", "volumes_sent", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// Indexes on migrated columns, created once the columns exist
+const createMigratedIndexesSQL = `
+	CREATE INDEX IF NOT EXISTS idx_sent_files_hash ON sent_files(file_hash);
+	CREATE INDEX IF NOT EXISTS idx_sent_files_status ON sent_files(status);
+	DROP INDEX IF EXISTS idx_send_queue_file_path;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_send_queue_file_recipient ON send_queue(file_path, recipient);
+	CREATE INDEX IF NOT EXISTS idx_deliveries_profile ON deliveries(profile, sent_at);
+	`
+
+// Moves recorded before sent_files.status existed defaulted to 'sent'
+const fixMovedStatusSQL = `UPDATE sent_files SET status = 'moved' WHERE moved_from IS NOT NULL AND status = 'sent'`
+
+// Rejections used to be recorded on the whole file as well, which kept it
+// from every other recipient; they are tracked per delivery now
+const fixRejectedStatusSQL = `UPDATE sent_files SET status = 'sent' WHERE status = 'rejected'`
+
+func migrateDatabase(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		exists, err := columnExists(db, m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", m.table, m.column, err)
+		}
+		log.Printf("Database migrated: added %s.%s", m.table, m.column)
+	}
+
+	if _, err := db.Exec(createMigratedIndexesSQL); err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+	if _, err := db.Exec(fixMovedStatusSQL); err != nil {
+		return fmt.Errorf("failed to update moved file status: %w", err)
+	}
+	if _, err := db.Exec(fixRejectedStatusSQL); err != nil {
+		return fmt.Errorf("failed to update rejected file status: %w", err)
+	}
+	if _, err := db.Exec(seedSentMessagesSQL); err != nil {
+		return fmt.Errorf("failed to seed sent messages: %w", err)
+	}
+	return nil
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// sent_files status values. Every status counts as "already handled" for
+// isFileSent; only 'sent' rows were actually delivered.
+const (
+	fileStatusSent     = "sent"
+	fileStatusBaseline = "baseline"
+	fileStatusMoved    = "moved"
+	// A better format of the same book was sent instead
+	fileStatusSuperseded = "superseded"
+	// Amazon reported it couldn't deliver the book. Only set on the
+	// recipient's deliveries row; other recipients are unaffected.
+	fileStatusRejected = "rejected"
+)
+
 func isFileSent(db *sql.DB, filePath string) (bool, error) {
 	var count int
 	err := db.QueryRow("SELECT COUNT(*) FROM sent_files WHERE file_path = ?", filePath).Scan(&count)
@@ -224,22 +730,139 @@ func isFileSent(db *sql.DB, filePath string) (bool, error) {
 	return count > 0, nil
 }
 
-func markFileSent(db *sql.DB, filePath string, fileSize int64) error {
+// fileStatus returns the sent_files status for a path, or "" if it is unknown
+func fileStatus(db *sql.DB, filePath string) (string, error) {
+	var status string
+	err := db.QueryRow("SELECT status FROM sent_files WHERE file_path = ?", filePath).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// markFileSent records a delivery of filePath to a target. sent_files keeps
+// one row per file; deliveries has one per recipient, noting the version of
+// the file they received and, for books sent together, the batch.
+func markFileSent(db *sql.DB, filePath string, target Target, fileInfo os.FileInfo, fileHash string, meta BookMetadata, batchID string) error {
+	mtime := sql.NullInt64{Int64: fileInfo.ModTime().UnixNano(), Valid: true}
 	_, err := db.Exec(
-		"INSERT OR IGNORE INTO sent_files (file_path, file_size) VALUES (?, ?)",
-		filePath, fileSize,
+		`INSERT INTO sent_files (file_path, file_size, file_mtime, file_hash, title, author, language, isbn, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(file_path) DO UPDATE SET
+			file_size = excluded.file_size, file_mtime = excluded.file_mtime, file_hash = excluded.file_hash,
+			title = excluded.title, author = excluded.author, language = excluded.language, isbn = excluded.isbn,
+			status = excluded.status, email_sent = 1, sent_at = CURRENT_TIMESTAMP`,
+		filePath, fileInfo.Size(), mtime, fileHash, meta.Title, meta.Author, meta.Language, meta.ISBN, fileStatusSent,
 	)
+	if err != nil {
+		return err
+	}
+	if _, err := recordFileVersion(db, filePath, fileInfo.Size(), fileHash, mtime); err != nil {
+		return err
+	}
+	if err := recordDelivery(db, filePath, target, fileStatusSent); err != nil {
+		return err
+	}
+	if batchID == "" {
+		return nil
+	}
+	_, err = db.Exec("UPDATE deliveries SET batch_id = ? WHERE file_path = ? AND recipient = ?", batchID, filePath, target.Recipient)
 	return err
 }
 
-func markFileOversized(db *sql.DB, filePath string, fileName string, fileSize int64, maxSize int64) error {
+// sent_messages logs every message a profile sent, so its rate limiter can
+// be rebuilt after a restart. Each volume of a split book and each batch is
+// one row, as they are one send in the limiter.
+const createSentMessagesSQL = `
+	CREATE TABLE IF NOT EXISTS sent_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		profile TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_sent_messages_profile ON sent_messages(profile, sent_at);
+	`
+
+// Databases from before sent_messages existed start from the deliveries of
+// the last day, one message per book or batch
+const seedSentMessagesSQL = `
+	INSERT INTO sent_messages (profile, recipient, sent_at)
+	SELECT profile, recipient, MIN(sent_at) FROM deliveries
+	WHERE status IN ('sent', 'rejected') AND sent_at > datetime('now', '-1 day')
+		AND NOT EXISTS (SELECT 1 FROM sent_messages)
+	GROUP BY COALESCE(batch_id, id)`
+
+// recordMessageSent counts a sent message against the target profile's rate
+// limit and logs it for restarts
+func recordMessageSent(db *sql.DB, target Target) {
+	target.Profile.RateLimiter.RecordSend()
+	if _, err := db.Exec("INSERT INTO sent_messages (profile, recipient) VALUES (?, ?)", target.Profile.Name, target.Recipient); err != nil {
+		log.Printf("Error recording sent message for rate limiter of profile %s: %v", target.Profile.Name, err)
+	}
+}
+
+// loadRecentSendTimes returns when a profile sent messages within the last
+// window, oldest first. Older entries, which no limiter looks at, are
+// dropped.
+func loadRecentSendTimes(db *sql.DB, window time.Duration, profile string) ([]time.Time, error) {
+	// sent_at is written by CURRENT_TIMESTAMP, so compare in the same UTC format
+	format := "2006-01-02 15:04:05"
+	if _, err := db.Exec("DELETE FROM sent_messages WHERE profile = ? AND sent_at < ?",
+		profile, time.Now().Add(-24*time.Hour).UTC().Format(format)); err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-window).UTC().Format(format)
+	rows, err := db.Query(
+		"SELECT sent_at FROM sent_messages WHERE profile = ? AND sent_at > ? ORDER BY sent_at",
+		profile, cutoff,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []time.Time
+	for rows.Next() {
+		var sentAt time.Time
+		if err := rows.Scan(&sentAt); err != nil {
+			return nil, err
+		}
+		times = append(times, sentAt)
+	}
+	return times, rows.Err()
+}
+
+func markFileOversized(db *sql.DB, filePath string, fileName string, fileSize int64, maxSize int64, reason string) error {
 	_, err := db.Exec(
-		"INSERT OR REPLACE INTO oversized_files (file_path, file_name, file_size, max_size, detected_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
-		filePath, fileName, fileSize, maxSize,
+		"INSERT OR REPLACE INTO oversized_files (file_path, file_name, file_size, max_size, reason, detected_at) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		filePath, fileName, fileSize, maxSize, reason,
 	)
 	return err
 }
 
+// trackOversized parks a file that can't be sent because of its size and
+// adds it to the dashboard
+func trackOversized(db *sql.DB, filePath string, fileName string, fileSize int64, maxSize int64, reason string) {
+	if err := markFileOversized(db, filePath, fileName, fileSize, maxSize, reason); err != nil {
+		log.Printf("Error tracking oversized file: %v", err)
+	}
+	fileSizeMB := fmt.Sprintf("%.2f", float64(fileSize)/(1024*1024))
+	filesSkippedTooLarge.WithLabelValues(filePath, fileName, fileSizeMB).Set(1)
+	filesSkippedTooLargeTotal.Inc()
+}
+
+// clearFileOversized drops an oversized entry and its dashboard series
+func clearFileOversized(db *sql.DB, filePath string, fileName string, fileSize int64) error {
+	if _, err := db.Exec("DELETE FROM oversized_files WHERE file_path = ?", filePath); err != nil {
+		return err
+	}
+	fileSizeMB := fmt.Sprintf("%.2f", float64(fileSize)/(1024*1024))
+	if filesSkippedTooLarge.DeleteLabelValues(filePath, fileName, fileSizeMB) {
+		filesSkippedTooLargeTotal.Dec()
+	}
+	return nil
+}
+
 func isFileOversized(db *sql.DB, filePath string) (bool, error) {
 	var count int
 	err := db.QueryRow("SELECT COUNT(*) FROM oversized_files WHERE file_path = ?", filePath).Scan(&count)
@@ -249,26 +872,54 @@ func isFileOversized(db *sql.DB, filePath string) (bool, error) {
 	return count > 0, nil
 }
 
-func countPendingFiles(watchPath string, config *Config, db *sql.DB) (int, error) {
+func countPendingFiles(watchPath string, config *Config, db *sql.DB, router *Router) (int, error) {
 	var pending int
 	err := filepath.Walk(watchPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
+		if err != nil {
 			return nil
 		}
-		if !isSupportedFile(info.Name(), config.FileExtensions) {
+		if isIgnoredPath(path, config) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !isSupportedFile(info.Name(), config.FileExtensions) {
+			return nil
+		}
+		// Check if already sent; baselined files never are
+		recorded, err := fileStatus(db, path)
+		if err != nil || (recorded != "" && recorded != fileStatusSent && recorded != fileStatusMoved) {
 			return nil
 		}
-		// Check if file is too large
-		maxSize := int64(config.MaxFileSizeMB) * 1024 * 1024
-		if info.Size() > maxSize {
-			return nil // Skip oversized files
+		// Check if a recipient still needs it. Oversized files are skipped,
+		// unless they will be shrunk.
+		var accepted []Target
+		oversized := false
+		for _, target := range router.Targets(path) {
+			if ok, _ := target.Profile.acceptsFile(info.Name(), info.Size()); ok {
+				accepted = append(accepted, target)
+			}
+			oversized = oversized || info.Size() > target.Profile.maxFileSize()
 		}
-		// Check if already sent
-		sent, err := isFileSent(db, path)
-		if err != nil || sent {
+		missing, err := undeliveredTargets(db, path, accepted, config.ResendOnUpgrade)
+		if err != nil || len(missing) == 0 {
 			return nil
 		}
-		pending++
+		if oversized {
+			if tracked, err := isFileOversized(db, path); err != nil || tracked {
+				return nil
+			}
+		}
+		// Dead-lettered and held files need manual attention and are no
+		// longer pending; the file is pending while any recipient waits
+		for _, target := range missing {
+			status, err := queueStatus(db, path, target.Recipient)
+			if err == nil && status != queueStatusDead && status != queueStatusHeld {
+				pending++
+				break
+			}
+		}
 		return nil
 	})
 	return pending, err
@@ -306,70 +957,6 @@ func isSupportedFile(filename string, extensions []string) bool {
 	return false
 }
 
-func sendEmail(msg *EmailMessage, config *Config) error {
-	// Read attachment
-	fileData, err := os.ReadFile(msg.Attachment)
-	if err != nil {
-		return fmt.Errorf("failed to read attachment: %w", err)
-	}
-
-	// Build email
-	boundary := "kindle-sender-boundary"
-	headers := make(map[string]string)
-	headers["From"] = msg.From
-	headers["To"] = msg.To
-	headers["Subject"] = msg.Subject
-	headers["MIME-Version"] = "1.0"
-	headers["Content-Type"] = fmt.Sprintf("multipart/mixed; boundary=%s", boundary)
-
-	var emailBody strings.Builder
-	for k, v := range headers {
-		emailBody.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
-	}
-	emailBody.WriteString("\r\n")
-
-	// Body part
-	emailBody.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	emailBody.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
-	emailBody.WriteString(msg.Body)
-	emailBody.WriteString("\r\n\r\n")
-
-	// Attachment part
-	emailBody.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	emailBody.WriteString(fmt.Sprintf("Content-Type: %s\r\n", msg.ContentType))
-	emailBody.WriteString("Content-Transfer-Encoding: base64\r\n")
-	emailBody.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n\r\n",
-		filepath.Base(msg.Attachment)))
-
-	// Encode attachment to base64 using standard library
-	encoded := base64.StdEncoding.EncodeToString(fileData)
-	// Add line breaks every 76 characters per RFC 2045
-	for i := 0; i < len(encoded); i += 76 {
-		end := i + 76
-		if end > len(encoded) {
-			end = len(encoded)
-		}
-		emailBody.WriteString(encoded[i:end])
-		emailBody.WriteString("\r\n")
-	}
-	
-	emailBody.WriteString(fmt.Sprintf("--%s--", boundary))
-
-	// Send via SMTP
-	auth := smtp.PlainAuth("", config.SMTPUser, config.SMTPPassword, config.SMTPHost)
-	addr := fmt.Sprintf("%s:%s", config.SMTPHost, config.SMTPPort)
-
-	err = smtp.SendMail(
-		addr,
-		auth,
-		msg.From,
-		[]string{msg.To},
-		[]byte(emailBody.String()),
-	)
-
-	return err
-}
-
 func getContentType(filename string) string {
 	ext := strings.ToLower(filepath.Ext(filename))
 	switch ext {
@@ -386,114 +973,225 @@ func getContentType(filename string) string {
 	}
 }
 
-func processFile(filePath string, config *Config, db *sql.DB, rateLimiter *RateLimiter) error {
-	// Check file size
+// processFile queues a book for every recipient that hasn't got it yet.
+// Metadata from the event source, such as Bookshelf, takes precedence over
+// what the file embeds.
+func processFile(filePath string, config *Config, db *sql.DB, router *Router, approver *Approver, known BookMetadata) error {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to stat file: %w", err)
 	}
-
 	fileName := filepath.Base(filePath)
-	maxSize := int64(config.MaxFileSizeMB) * 1024 * 1024
-	
-	if fileInfo.Size() > maxSize {
+
+	// Check if already sent. Sent and moved books are still offered to
+	// recipients added since.
+	status, err := fileStatus(db, filePath)
+	if err != nil {
+		return fmt.Errorf("failed to check if file sent: %w", err)
+	}
+	if status != "" && status != fileStatusSent && status != fileStatusMoved {
+		log.Printf("Skipping %s: recorded as %s", filePath, status)
+		return nil
+	}
+
+	// An upgrade replacing a sent book at the same path is a new version,
+	// which recipients only get again with RESEND_ON_UPGRADE
+	if status != "" {
+		version, err := checkFileVersion(db, filePath, fileInfo)
+		if err != nil {
+			return fmt.Errorf("failed to check file version: %w", err)
+		}
+		if version > 0 && !config.ResendOnUpgrade {
+			log.Printf("Not resending version %d of %s: RESEND_ON_UPGRADE is off", version, fileName)
+		}
+	}
+
+	targets := router.Targets(filePath)
+	if len(targets) == 0 {
+		log.Printf("Skipping %s: no route matches and KINDLE_EMAIL is not set", filePath)
+		return nil
+	}
+
+	// Check file size against each profile's limit
+	var accepted []Target
+	var reasons []string
+	var maxSize int64
+	oversized := false
+	for _, target := range targets {
+		ok, reason := target.Profile.acceptsFile(fileName, fileInfo.Size())
+		maxSize = max(maxSize, target.Profile.maxFileSize())
+		oversized = oversized || fileInfo.Size() > target.Profile.maxFileSize()
+		if !ok {
+			reasons = append(reasons, reason)
+			continue
+		}
+		accepted = append(accepted, target)
+	}
+
+	if oversized {
 		// Check if already tracked as oversized
 		tracked, err := isFileOversized(db, filePath)
 		if err != nil {
 			log.Printf("Error checking oversized status: %v", err)
 		}
-		
-		if !tracked {
+		if tracked {
+			log.Printf("Skipping %s: already tracked as too large", fileName)
+			return nil
+		}
+
+		// Only a file no profile can send goes on the dashboard
+		if len(accepted) == 0 {
 			// Track in database and update metrics
-			if err := markFileOversized(db, filePath, fileName, fileInfo.Size(), maxSize); err != nil {
-				log.Printf("Error tracking oversized file: %v", err)
-			}
-			fileSizeMB := fmt.Sprintf("%.2f", float64(fileInfo.Size())/(1024*1024))
-			filesSkippedTooLarge.WithLabelValues(filePath, fileName, fileSizeMB).Set(1)
-			filesSkippedTooLargeTotal.Inc()
+			trackOversized(db, filePath, fileName, fileInfo.Size(), maxSize, strings.Join(reasons, "; "))
 			log.Printf("File too large (tracked for dashboard): %s (%.2f MB, max: %d MB)",
-				fileName, float64(fileInfo.Size())/(1024*1024), config.MaxFileSizeMB)
-		} else {
-			log.Printf("Skipping %s: already tracked as too large", fileName)
+				fileName, megabytes(fileInfo.Size()), maxSize/(1024*1024))
+			return nil
 		}
-		return nil
 	}
 
-	// Check if already sent
-	sent, err := isFileSent(db, filePath)
+	missing, err := undeliveredTargets(db, filePath, accepted, config.ResendOnUpgrade)
 	if err != nil {
 		return fmt.Errorf("failed to check if file sent: %w", err)
 	}
-	if sent {
-		log.Printf("Skipping %s: already sent", filePath)
+	if len(missing) == 0 {
+		log.Printf("Skipping %s: already sent or declined", filePath)
 		return nil
 	}
 
-	// Check rate limit
-	if !rateLimiter.CanSend() {
-		waitTime := rateLimiter.TimeUntilNextSlot()
-		filesRateLimited.Inc()
-		log.Printf("Rate limit reached (%d/%d per hour). %s will be sent in %.0f minutes",
-			rateLimiter.SentThisHour(), config.MaxBooksPerHour, fileName, waitTime.Minutes())
-		return nil // Will be picked up in next scan
+	// Recipients the file is already queued or held for are left to the
+	// queue, so periodic scans don't hash and parse it again
+	queued, err := queuedRecipients(db, filePath)
+	if err != nil {
+		return fmt.Errorf("failed to check send queue: %w", err)
 	}
+	var unqueued []Target
+	for _, target := range missing {
+		if !queued[target.Recipient] {
+			unqueued = append(unqueued, target)
+		}
+	}
+	if len(unqueued) == 0 {
+		return nil
+	}
+	missing = unqueued
 
-	// Update metrics for files sent this hour
-	filesSentThisHour.Set(float64(rateLimiter.SentThisHour()))
-
-	// Send email
-	msg := &EmailMessage{
-		From:        config.SenderEmail,
-		To:          config.KindleEmail,
-		Subject:     fmt.Sprintf("Book: %s", filepath.Base(filePath)),
-		Body:        fmt.Sprintf("Automatically sent by Kindle Sender\n\nFile: %s\nSize: %d bytes", filepath.Base(filePath), fileInfo.Size()),
-		Attachment:  filePath,
-		ContentType: getContentType(filePath),
+	// A book that was renamed or moved keeps its content hash, so recipients
+	// who already have it are skipped
+	fileHash, err := hashFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to hash file: %w", err)
+	}
+	var pending []Target
+	for _, target := range missing {
+		originalPath, err := findDeliveryByHash(db, fileHash, target.Recipient)
+		if err != nil {
+			return fmt.Errorf("failed to look up file hash: %w", err)
+		}
+		if originalPath == "" {
+			pending = append(pending, target)
+			continue
+		}
+		if err := recordFileMove(db, filePath, fileInfo.Size(), fileHash, originalPath); err != nil {
+			return fmt.Errorf("failed to record moved file: %w", err)
+		}
+		if err := recordDelivery(db, filePath, target, fileStatusMoved); err != nil {
+			return fmt.Errorf("failed to record moved file: %w", err)
+		}
+		log.Printf("Skipping %s for %s: same content already sent as %s", fileName, target, originalPath)
+	}
+	if len(pending) == 0 {
+		return nil
 	}
 
-	log.Printf("Sending %s to %s...", filepath.Base(filePath), config.KindleEmail)
-	if err := sendEmail(msg, config); err != nil {
-		filesSendErrors.Inc()
-		return fmt.Errorf("failed to send email: %w", err)
+	meta, err := extractMetadata(filePath)
+	if err != nil {
+		log.Printf("Error extracting metadata from %s: %v", fileName, err)
 	}
+	meta = meta.Merge(known)
 
-	// Mark as sent
-	if err := markFileSent(db, filePath, fileInfo.Size()); err != nil {
-		return fmt.Errorf("failed to mark file as sent: %w", err)
+	// Of several formats of a book in one folder only the preferred one is
+	// sent; the others are recorded as superseded
+	if len(config.FormatPreference) > 0 {
+		better, err := preferredSibling(filePath, meta, config, db, router)
+		if err != nil {
+			return fmt.Errorf("failed to look for other formats: %w", err)
+		}
+		if better != "" {
+			if err := markFileSuperseded(db, filePath, fileInfo.Size(), fileHash, meta, better); err != nil {
+				return fmt.Errorf("failed to record superseded file: %w", err)
+			}
+			log.Printf("Skipping %s: superseded by %s", fileName, filepath.Base(better))
+			return nil
+		}
+		if err := supersedeQueuedSiblings(db, filePath, meta, config); err != nil {
+			return fmt.Errorf("failed to supersede other formats: %w", err)
+		}
 	}
 
-	// Record in rate limiter and update metrics
-	rateLimiter.RecordSend()
-	filesSentThisHour.Set(float64(rateLimiter.SentThisHour()))
-	filesSentTotal.Inc()
-	log.Printf("Successfully sent %s (%d/%d this hour)", filepath.Base(filePath), rateLimiter.SentThisHour(), config.MaxBooksPerHour)
+	// Hand the file to the send queue worker, once per recipient.
+	// Shrinkable books are queued as usual and shrunk when they are sent.
+	queueAs := queueStatusPending
+	if approver.NeedsApproval(filePath, fileInfo.Size()) {
+		queueAs = queueStatusHeld
+	}
+	var held []Target
+	for _, target := range pending {
+		if fileInfo.Size() > target.Profile.maxFileSize() {
+			log.Printf("%s is %.2f MB, over the %d MB limit; it will be shrunk before sending to %s",
+				fileName, megabytes(fileInfo.Size()), target.Profile.Config.MaxFileSizeMB, target)
+		}
+		added, err := enqueueFile(db, filePath, target, fileInfo.Size(), fileHash, meta, queueAs)
+		if err != nil {
+			return fmt.Errorf("failed to queue file: %w", err)
+		}
+		if added {
+			if queueAs == queueStatusHeld {
+				held = append(held, target)
+				log.Printf("Holding %s for approval (%s)", meta.DisplayName(fileName), target)
+			} else if target.Recipient == "" {
+				log.Printf("Queued %s for delivery", meta.DisplayName(fileName))
+			} else {
+				log.Printf("Queued %s for delivery to %s", meta.DisplayName(fileName), target)
+			}
+		}
+	}
+	if len(held) > 0 {
+		approver.Notify(filePath, fileInfo.Size(), meta, held)
+	}
 	return nil
 }
 
-func scanDirectory(watchPath string, config *Config, db *sql.DB, rateLimiter *RateLimiter) error {
+// scanDirectory walks the watch path and hands every supported file to the
+// worker
+func scanDirectory(watchPath string, config *Config, db *sql.DB, worker *Worker) error {
 	err := filepath.Walk(watchPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Printf("Error accessing path %s: %v", path, err)
 			return nil // Continue walking
 		}
 
-		if info.IsDir() {
+		// Skip download clients' temporary files and unpack folders
+		if isIgnoredPath(path, config) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		if !isSupportedFile(info.Name(), config.FileExtensions) {
+		if info.IsDir() {
 			return nil
 		}
 
-		if err := processFile(path, config, db, rateLimiter); err != nil {
-			log.Printf("Error processing file %s: %v", path, err)
+		if !isSupportedFile(info.Name(), config.FileExtensions) {
+			return nil
 		}
 
+		worker.Enqueue(path)
 		return nil
 	})
 
 	// Update pending files metric after each scan
-	pending, countErr := countPendingFiles(watchPath, config, db)
+	pending, countErr := countPendingFiles(watchPath, config, db, worker.router)
 	if countErr == nil {
 		filesPending.Set(float64(pending))
 		if pending > 0 {
@@ -504,34 +1202,10 @@ func scanDirectory(watchPath string, config *Config, db *sql.DB, rateLimiter *Ra
 	return err
 }
 
-// waitForFileWriteComplete waits for a file's size to remain stable, indicating write completion
-func waitForFileWriteComplete(filepath string, timeout time.Duration, checkInterval time.Duration) bool {
-	deadline := time.Now().Add(timeout)
-	var lastSize int64 = -1
-	
-	for time.Now().Before(deadline) {
-		fileInfo, err := os.Stat(filepath)
-		if err != nil {
-			// File may not exist yet or was deleted
-			time.Sleep(checkInterval)
-			continue
-		}
-		
-		currentSize := fileInfo.Size()
-		if currentSize == lastSize && currentSize > 0 {
-			// Size is stable, file write is complete
-			return true
-		}
-		
-		lastSize = currentSize
-		time.Sleep(checkInterval)
-	}
-	
-	// Timeout reached
-	return false
-}
-
-func watchDirectory(watchPath string, config *Config, db *sql.DB, rateLimiter *RateLimiter) error {
+// watchDirectory watches with fsnotify, for platforms without inotify. It
+// can't tell when a writer is done, so every create or write restarts the
+// file's settle wait.
+func watchDirectory(watchPath string, config *Config, worker *Worker, settle *settleQueue) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("failed to create watcher: %w", err)
@@ -539,15 +1213,7 @@ func watchDirectory(watchPath string, config *Config, db *sql.DB, rateLimiter *R
 	defer watcher.Close()
 
 	// Watch the directory recursively
-	if err := filepath.Walk(watchPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return watcher.Add(path)
-		}
-		return nil
-	}); err != nil {
+	if err := addWatchTree(watcher, watchPath, config, nil); err != nil {
 		return fmt.Errorf("failed to add watch paths: %w", err)
 	}
 
@@ -561,30 +1227,60 @@ func watchDirectory(watchPath string, config *Config, db *sql.DB, rateLimiter *R
 				return nil
 			}
 
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				// Wait for file to be fully written by checking size stability
-				if !waitForFileWriteComplete(event.Name, 3*time.Second, 500*time.Millisecond) {
-					log.Printf("File write timeout or error for %s, skipping", event.Name)
+			// A renamed folder comes back as a Create under its new name;
+			// the watches under the old name are stale
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// A moved folder whose watch is already gone is reported
+				// without a name; the parent's event covers it
+				if event.Name == "" {
 					continue
 				}
-
-				fileInfo, err := os.Stat(event.Name)
-				if err != nil {
-					log.Printf("Error stating file %s: %v", event.Name, err)
-					continue
+				wasDir := false
+				for _, watched := range watcher.WatchList() {
+					if isUnder(watched, event.Name) {
+						watcher.Remove(watched)
+						wasDir = true
+					}
 				}
-
-				if fileInfo.IsDir() {
-					// Add new directory to watcher
-					watcher.Add(event.Name)
-					continue
+				if wasDir || isSupportedFile(event.Name, config.FileExtensions) {
+					if event.Op&fsnotify.Rename != 0 {
+						watchEventsTotal.WithLabelValues(watchRename).Inc()
+					} else {
+						watchEventsTotal.WithLabelValues(watchDelete).Inc()
+					}
+					worker.Removed(event.Name)
 				}
+				continue
+			}
+
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 || isIgnoredPath(event.Name, config) {
+				continue
+			}
+
+			fileInfo, err := os.Stat(event.Name)
+			if err != nil {
+				// Gone again, e.g. a temporary file renamed away
+				continue
+			}
 
-				if isSupportedFile(event.Name, config.FileExtensions) {
-					if err := processFile(event.Name, config, db, rateLimiter); err != nil {
-						log.Printf("Error processing file %s: %v", event.Name, err)
+			if fileInfo.IsDir() {
+				// Add new directory to watcher, along with books that were
+				// moved in with it
+				if event.Op&fsnotify.Create != 0 {
+					if err := addWatchTree(watcher, event.Name, config, settle); err != nil {
+						log.Printf("Error watching %s: %v", event.Name, err)
 					}
 				}
+				continue
+			}
+
+			if isSupportedFile(event.Name, config.FileExtensions) {
+				if event.Op&fsnotify.Create != 0 {
+					watchEventsTotal.WithLabelValues(watchCreate).Inc()
+				} else {
+					watchEventsTotal.WithLabelValues(watchModify).Inc()
+				}
+				settle.Add(event.Name)
 			}
 
 		case err, ok := <-watcher.Errors:
@@ -596,32 +1292,159 @@ func watchDirectory(watchPath string, config *Config, db *sql.DB, rateLimiter *R
 	}
 }
 
+// addWatchTree adds root and the folders below it to the watcher, skipping
+// ignored ones. Books found are handed to settle, if given.
+func addWatchTree(watcher *fsnotify.Watcher, root string, config *Config, settle *settleQueue) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isIgnoredPath(path, config) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		if settle != nil && isSupportedFile(info.Name(), config.FileExtensions) {
+			settle.Add(path)
+		}
+		return nil
+	})
+}
+
 func main() {
 	log.Println("Kindle Sender starting...")
 
 	config := loadConfig()
 
-	// Validate configuration
-	if config.SMTPHost == "" || config.SMTPUser == "" || config.SMTPPassword == "" {
-		log.Fatal("SMTP configuration is incomplete. Please set SMTP_HOST, SMTP_USER, and SMTP_PASSWORD")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "baseline":
+			runBaselineCommand(config)
+			return
+		default:
+			log.Fatalf("Unknown command %q (available: baseline)", os.Args[1])
+		}
+	}
+
+	// Validate configuration. Each profile has its own SMTP account and
+	// transport; the top-level settings form the default profile.
+	profiles, err := loadProfiles(config)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if def := profiles.Get(defaultProfile); def != nil && def.Config.Transport == "smtp" {
+		if config.KindleEmail == "" && config.Routes == "" {
+			log.Fatal("KINDLE_EMAIL is not set. Please set KINDLE_EMAIL or ROUTES")
+		}
+	}
+
+	router, err := newRouter(config, profiles)
+	if err != nil {
+		log.Fatalf("Invalid routes: %v", err)
+	}
+
+	converter, err := newConverter(config)
+	if err != nil {
+		log.Fatalf("Invalid converter configuration: %v", err)
+	}
+
+	approver, err := newApprover(config)
+	if err != nil {
+		log.Fatalf("Invalid approval configuration: %v", err)
+	}
+
+	rejectionPollers, err := newRejectionPollers(profiles)
+	if err != nil {
+		log.Fatalf("Invalid IMAP configuration: %v", err)
+	}
+
+	switch config.WatchMode {
+	case watchModeInotify, watchModeFsnotify, watchModePoll:
+	default:
+		log.Fatalf("Unknown WATCH_MODE %q (expected inotify, fsnotify or poll)", config.WatchMode)
 	}
-	if config.KindleEmail == "" {
-		log.Fatal("KINDLE_EMAIL is not set")
+	if config.WatchMode == watchModePoll && config.PollInterval <= 0 {
+		log.Fatal("POLL_INTERVAL must be positive")
+	}
+	if config.QueuePollInterval < 1 {
+		log.Fatal("QUEUE_POLL_INTERVAL must be positive")
+	}
+	if err := validateIgnorePatterns(config.IgnorePatterns); err != nil {
+		log.Fatalf("Invalid IGNORE_PATTERNS: %v", err)
+	}
+
+	if config.ShrinkOversized {
+		if err := validateShrinkConfig(config); err != nil {
+			log.Fatalf("Invalid shrink configuration: %v", err)
+		}
 	}
 
 	log.Printf("Configuration loaded:")
 	log.Printf("  Watch Path: %s", config.WatchPath)
+	if config.WatchMode == watchModePoll {
+		log.Printf("  Watch Mode: poll (every %d seconds)", config.PollInterval)
+	} else {
+		log.Printf("  Watch Mode: %s (settle %d seconds)", config.WatchMode, config.SettleSeconds)
+	}
+	if len(config.IgnorePatterns) > 0 {
+		log.Printf("  Ignore Patterns: %s", strings.Join(config.IgnorePatterns, ", "))
+	}
 	log.Printf("  Scan Interval: %d seconds", config.ScanInterval)
-	log.Printf("  Max File Size: %d MB", config.MaxFileSizeMB)
-	log.Printf("  Max Books Per Hour: %d", config.MaxBooksPerHour)
+	if config.ReconcileInterval > 0 {
+		log.Printf("  Reconcile Interval: %d seconds", config.ReconcileInterval)
+	}
+	log.Printf("  Send Attempts: %d (backoff %ds-%ds)", config.SendMaxAttempts, config.SendRetryBaseSeconds, config.SendRetryMaxSeconds)
+	log.Printf("  Baseline On Empty DB: %t", config.BaselineOnEmptyDB)
+	log.Printf("  Resend On Upgrade: %t", config.ResendOnUpgrade)
+	if config.RequireApproval {
+		log.Printf("  Require Approval: true (links: %t, notify: %t)", config.ApprovalBaseURL != "", config.ApprovalNotifyURL != "")
+	}
 	log.Printf("  File Extensions: %v", config.FileExtensions)
-	log.Printf("  SMTP Host: %s:%s", config.SMTPHost, config.SMTPPort)
-	log.Printf("  Kindle Email: %s", config.KindleEmail)
+	if converter != nil {
+		log.Printf("  Converter: %s (%s to EPUB)", converter.Name(), strings.Join(config.ConvertFormats, ", "))
+	}
+	if config.ShrinkOversized {
+		log.Printf("  Shrink Oversized: images up to %dpx at quality %d, PDF steps %s",
+			config.ShrinkMaxImageDimension, config.ShrinkJPEGQuality, strings.Join(config.ShrinkPDFSteps, ", "))
+	}
+	for _, profile := range profiles.All() {
+		pc := profile.Config
+		log.Printf("  Profile %s:", profile.Name)
+		log.Printf("    Transport: %s", profile.Transport.Name())
+		if pc.Transport == "smtp" {
+			log.Printf("    SMTP Host: %s:%s (tls: %s, auth: %s, user: %s)", pc.SMTPHost, pc.SMTPPort, pc.SMTPTLSMode, pc.SMTPAuth, pc.SMTPUser)
+		}
+		log.Printf("    Kindle Email: %s", pc.KindleEmail)
+		log.Printf("    File Extensions: %v", pc.FileExtensions)
+		log.Printf("    Max File Size: %d MB", pc.MaxFileSizeMB)
+		log.Printf("    Max Books Per Hour: %d", pc.MaxBooksPerHour)
+		if pc.MaxBooksPerDay > 0 {
+			log.Printf("    Max Books Per Day: %d", pc.MaxBooksPerDay)
+		}
+		if profile.Schedule != nil {
+			log.Printf("    Delivery Windows: %s", profile.Schedule)
+		}
+		if pc.BatchMaxAttachments > 1 {
+			log.Printf("    Batching: up to %d books, %d MB per message", pc.BatchMaxAttachments, pc.BatchMaxSizeMB)
+		}
+		if pc.IMAPHost != "" {
+			log.Printf("    Rejection Notices: %s on %s:%s (tls: %s, user: %s, every %d seconds)",
+				pc.IMAPMailbox, pc.IMAPHost, pc.IMAPPort, pc.IMAPTLSMode, pc.IMAPUser, config.IMAPPollInterval)
+		}
+	}
+	for _, rt := range router.routes {
+		targets := make([]string, len(rt.targets))
+		for i, target := range rt.targets {
+			targets[i] = target.String()
+		}
+		log.Printf("  Route: %s -> %s", rt.pattern, strings.Join(targets, ", "))
+	}
 	log.Printf("  Metrics Port: %s", config.MetricsPort)
 
-	// Initialize rate limiter
-	rateLimiter := NewRateLimiter(config.MaxBooksPerHour)
-
 	// Initialize database
 	db, err := initDatabase(config.DatabasePath)
 	if err != nil {
@@ -631,28 +1454,83 @@ func main() {
 
 	log.Println("Database initialized")
 
+	// History from before routing existed belongs to KINDLE_EMAIL
+	if err := migrateRecipients(db, config.KindleEmail); err != nil {
+		log.Fatalf("Failed to migrate recipients: %v", err)
+	}
+
+	// Hash files sent before content-based deduplication existed
+	if err := backfillFileHashes(db); err != nil {
+		log.Printf("Error backfilling file hashes: %v", err)
+	}
+	if err := backfillMetadata(db); err != nil {
+		log.Printf("Error backfilling book metadata: %v", err)
+	}
+
+	// Restore each profile's rate limiter from the send history so a restart
+	// or scale from zero can't exceed the limits
+	for _, profile := range profiles.All() {
+		recentSends, err := loadRecentSendTimes(db, profile.RateLimiter.window(), profile.Name)
+		if err != nil {
+			log.Printf("Error loading recent sends for rate limiter of profile %s: %v", profile.Name, err)
+		}
+		profile.RateLimiter.Seed(recentSends)
+		updateRateLimitMetrics(profile)
+		log.Printf("Rate limiter of profile %s restored: %d sent this hour, %d in the last 24 hours",
+			profile.Name, profile.RateLimiter.SentThisHour(), profile.RateLimiter.SentToday())
+	}
+
+	// On first run, record the existing library instead of emailing all of it
+	if config.BaselineOnEmptyDB {
+		empty, err := isDatabaseEmpty(db)
+		if err != nil {
+			log.Printf("Error checking for empty database: %v", err)
+		} else if empty {
+			if _, err := runBaseline(config, db); err != nil {
+				log.Fatalf("Baseline failed: %v", err)
+			}
+		}
+	}
+
+	// Drop state for books removed while the pod was down
+	if err := reconcileWatchPath(config, db); err != nil {
+		log.Printf("Error during reconciliation: %v", err)
+	}
+
 	// Load existing oversized files into metrics
 	if err := loadOversizedFilesMetrics(db); err != nil {
 		log.Printf("Error loading oversized files metrics: %v", err)
 	}
 
-	// Start metrics server
+	// All file processing, sending and database writes happen on one worker
+	worker := NewWorker(config, db, profiles, converter, router, approver)
+	go worker.Run()
+
+	// Check sender mailboxes for books Amazon couldn't deliver
+	for _, poller := range rejectionPollers {
+		go poller.Run(db, worker, time.Duration(config.IMAPPollInterval)*time.Second)
+	}
+
+	// Scans requested through the admin API
+	scanTrigger := make(chan struct{}, 1)
+
+	// Start metrics and admin API server
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
-		})
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/health", healthHandler(profiles))
+		registerAdminAPI(mux, config, db, worker, scanTrigger)
+		registerApprovalLinks(mux, approver, worker)
 		addr := fmt.Sprintf(":%s", config.MetricsPort)
 		log.Printf("Starting metrics server on %s", addr)
-		if err := http.ListenAndServe(addr, nil); err != nil {
+		if err := http.ListenAndServe(addr, mux); err != nil {
 			log.Printf("Metrics server error: %v", err)
 		}
 	}()
 
 	// Initial scan
 	log.Println("Performing initial scan...")
-	if err := scanDirectory(config.WatchPath, config, db, rateLimiter); err != nil {
+	if err := scanDirectory(config.WatchPath, config, db, worker); err != nil {
 		log.Printf("Error during initial scan: %v", err)
 	}
 	log.Println("Initial scan completed")
@@ -662,17 +1540,48 @@ func main() {
 	defer ticker.Stop()
 
 	go func() {
-		for range ticker.C {
-			log.Println("Performing periodic scan...")
-			if err := scanDirectory(config.WatchPath, config, db, rateLimiter); err != nil {
+		for {
+			select {
+			case <-ticker.C:
+				log.Println("Performing periodic scan...")
+			case <-scanTrigger:
+				log.Println("Performing requested scan...")
+			}
+			if err := scanDirectory(config.WatchPath, config, db, worker); err != nil {
 				log.Printf("Error during periodic scan: %v", err)
 			}
 		}
 	}()
 
-	// Start watching for new files
+	// Periodically prune state for files the watcher didn't see go
+	if config.ReconcileInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(config.ReconcileInterval) * time.Second) {
+				err := worker.Do(func() error { return reconcileWatchPath(config, db) })
+				if err != nil {
+					log.Printf("Error during reconciliation: %v", err)
+				}
+			}
+		}()
+	}
+
+	// Start watching for new files. Polling suits network filesystems where
+	// inotify never sees changes made by other hosts; the event watchers hold
+	// files until they stop changing.
 	log.Println("Starting file watcher...")
-	if err := watchDirectory(config.WatchPath, config, db, rateLimiter); err != nil {
+	switch config.WatchMode {
+	case watchModePoll:
+		err = pollDirectory(config.WatchPath, config, db, worker)
+	case watchModeInotify:
+		settle := newSettleQueue(config, worker)
+		go settle.Run()
+		err = watchDirectoryInotify(config.WatchPath, config, worker, settle)
+	default:
+		settle := newSettleQueue(config, worker)
+		go settle.Run()
+		err = watchDirectory(config.WatchPath, config, worker, settle)
+	}
+	if err != nil {
 		log.Fatalf("Error watching directory: %v", err)
 	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestDB opens a fresh database in a temporary directory
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := initDatabase(filepath.Join(t.TempDir(), "kindle-sender.db"))
+	if err != nil {
+		t.Fatalf("initDatabase: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestConfig returns settings for a single profile sending EPUBs from a
+// temporary watch path
+func newTestConfig(t *testing.T) *Config {
+	t.Helper()
+	return &Config{
+		WatchPath:            t.TempDir(),
+		FileExtensions:       []string{".epub", ".pdf"},
+		MaxFileSizeMB:        50,
+		KindleEmail:          "reader@kindle.com",
+		SenderEmail:          "sender@example.com",
+		MaxBooksPerHour:      100,
+		BatchMaxAttachments:  1,
+		BatchMaxSizeMB:       50,
+		QueuePollInterval:    3600,
+		SendMaxAttempts:      3,
+		SendRetryBaseSeconds: 60,
+		SendRetryMaxSeconds:  3600,
+		ScratchDir:           t.TempDir(),
+	}
+}
+
+// newTestProfiles builds the default profile around transport
+func newTestProfiles(t *testing.T, config *Config, transport Transport) *Profiles {
+	t.Helper()
+	profile := &Profile{
+		Name:        defaultProfile,
+		Config:      config,
+		Transport:   transport,
+		RateLimiter: NewRateLimiter(config.MaxBooksPerHour, config.MaxBooksPerDay),
+	}
+	return &Profiles{list: []*Profile{profile}, byName: map[string]*Profile{defaultProfile: profile}}
+}
+
+// writeTestFile creates a file and its parent directories
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// statTestFile returns the file info of path
+func statTestFile(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recordingTransport records delivered messages. Deliver calls hook first,
+// if set, and fails with its error.
+type recordingTransport struct {
+	mu       sync.Mutex
+	messages []*EmailMessage
+	hook     func(msg *EmailMessage) error
+}
+
+func (t *recordingTransport) Name() string { return "test" }
+
+func (t *recordingTransport) Deliver(msg *EmailMessage) error {
+	if t.hook != nil {
+		if err := t.hook(msg); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, msg)
+	return nil
+}
+
+func (t *recordingTransport) Delivered() []*EmailMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*EmailMessage(nil), t.messages...)
+}
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 and
+// writes it to a PEM file to trust as a CA bundle
+func newTestCertificate(t *testing.T) (*tls.Config, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kindle-sender test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, caFile
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// BookMetadata is the bibliographic information embedded in an eBook file
+type BookMetadata struct {
+	Title    string
+	Author   string
+	Language string
+	ISBN     string
+}
+
+// DisplayName describes the book for subjects and log lines, falling back to
+// the file name when the file carries no title
+func (m BookMetadata) DisplayName(fileName string) string {
+	if m.Title == "" {
+		return fileName
+	}
+	if m.Author == "" {
+		return m.Title
+	}
+	return fmt.Sprintf("%s by %s", m.Title, m.Author)
+}
+
+// Merge returns m with the fields set in other taking precedence
+func (m BookMetadata) Merge(other BookMetadata) BookMetadata {
+	if other.Title != "" {
+		m.Title = other.Title
+	}
+	if other.Author != "" {
+		m.Author = other.Author
+	}
+	if other.Language != "" {
+		m.Language = other.Language
+	}
+	if other.ISBN != "" {
+		m.ISBN = other.ISBN
+	}
+	return m
+}
+
+// extractMetadata reads embedded metadata based on the file extension.
+// Unsupported formats return empty metadata without error.
+func extractMetadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+	var err error
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".epub":
+		meta, err = extractEPUBMetadata(filePath)
+	case ".pdf":
+		meta, err = extractPDFMetadata(filePath)
+	case ".mobi", ".azw", ".azw3":
+		meta, err = extractMOBIMetadata(filePath)
+	}
+	meta.Title = strings.TrimSpace(meta.Title)
+	meta.Author = strings.TrimSpace(meta.Author)
+	meta.Language = strings.TrimSpace(meta.Language)
+	meta.ISBN = normalizeISBN(meta.ISBN)
+	return meta, err
+}
+
+// maxMetadataRead caps how much of any single structure is read while
+// looking for metadata
+const maxMetadataRead = 1 << 20
+
+// EPUB: META-INF/container.xml points at the OPF package document
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type opfPackage struct {
+	Metadata struct {
+		Titles   []string `xml:"title"`
+		Creators []struct {
+			Role  string `xml:"role,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"creator"`
+		Languages   []string `xml:"language"`
+		Identifiers []struct {
+			Scheme string `xml:"scheme,attr"`
+			Value  string `xml:",chardata"`
+		} `xml:"identifier"`
+	} `xml:"metadata"`
+}
+
+func extractEPUBMetadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return meta, fmt.Errorf("failed to open epub: %w", err)
+	}
+	defer archive.Close()
+
+	var container epubContainer
+	if err := decodeZipXML(&archive.Reader, "META-INF/container.xml", &container); err != nil {
+		return meta, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return meta, fmt.Errorf("epub container lists no package document")
+	}
+
+	var pkg opfPackage
+	if err := decodeZipXML(&archive.Reader, container.Rootfiles[0].FullPath, &pkg); err != nil {
+		return meta, err
+	}
+
+	if len(pkg.Metadata.Titles) > 0 {
+		meta.Title = pkg.Metadata.Titles[0]
+	}
+	for _, creator := range pkg.Metadata.Creators {
+		if meta.Author == "" || creator.Role == "aut" {
+			meta.Author = creator.Value
+			if creator.Role == "aut" {
+				break
+			}
+		}
+	}
+	if len(pkg.Metadata.Languages) > 0 {
+		meta.Language = pkg.Metadata.Languages[0]
+	}
+	for _, id := range pkg.Metadata.Identifiers {
+		value := strings.TrimSpace(id.Value)
+		lower := strings.ToLower(value)
+		switch {
+		case strings.EqualFold(id.Scheme, "isbn"):
+			meta.ISBN = value
+		case strings.HasPrefix(lower, "urn:isbn:"):
+			meta.ISBN = value[len("urn:isbn:"):]
+		case strings.HasPrefix(lower, "isbn:"):
+			meta.ISBN = value[len("isbn:"):]
+		case meta.ISBN == "" && looksLikeISBN(value):
+			meta.ISBN = value
+		}
+	}
+	return meta, nil
+}
+
+func decodeZipXML(archive *zip.Reader, name string, v interface{}) error {
+	// Zip entry names never start with a slash and use forward slashes
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	for _, f := range archive.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		defer rc.Close()
+		decoder := xml.NewDecoder(io.LimitReader(rc, maxMetadataRead))
+		decoder.Strict = false
+		decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		}
+		if err := decoder.Decode(v); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("epub is missing %s", name)
+}
+
+// PDF: the trailer's /Info entry references the document information dictionary
+
+var (
+	pdfInfoRefPattern = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	pdfEncryptPattern = regexp.MustCompile(`/Encrypt\s`)
+)
+
+// pdfTrailerWindow is how much of the end of a PDF is searched for the trailer
+const pdfTrailerWindow = 64 * 1024
+
+func extractPDFMetadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return meta, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return meta, err
+	}
+
+	tailStart := info.Size() - pdfTrailerWindow
+	if tailStart < 0 {
+		tailStart = 0
+	}
+	tail := make([]byte, info.Size()-tailStart)
+	if _, err := file.ReadAt(tail, tailStart); err != nil && err != io.EOF {
+		return meta, err
+	}
+
+	// Strings in encrypted documents can't be read without the key
+	if pdfEncryptPattern.Match(tail) {
+		return meta, nil
+	}
+
+	// Incremental updates append trailers, so the last /Info wins
+	refs := pdfInfoRefPattern.FindAllSubmatch(tail, -1)
+	if len(refs) == 0 {
+		return meta, nil
+	}
+	ref := refs[len(refs)-1]
+	objNum, _ := strconv.Atoi(string(ref[1]))
+	genNum, _ := strconv.Atoi(string(ref[2]))
+
+	dict, err := findPDFObject(file, objNum, genNum)
+	if err != nil || dict == nil {
+		return meta, err
+	}
+
+	meta.Title = pdfDictString(dict, "Title")
+	meta.Author = pdfDictString(dict, "Author")
+	return meta, nil
+}
+
+// findPDFObject scans the file for "N G obj" and returns its body up to endobj.
+// Objects inside compressed object streams are not found.
+func findPDFObject(file *os.File, objNum, genNum int) ([]byte, error) {
+	marker := []byte(fmt.Sprintf("%d %d obj", objNum, genNum))
+	const chunkSize = 1 << 20
+	overlap := len(marker) + 1
+	buf := make([]byte, chunkSize+overlap)
+
+	var offset int64
+	carried := 0
+	for {
+		n, err := file.ReadAt(buf[carried:], offset)
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		window := buf[:carried+n]
+		windowStart := offset - int64(carried)
+
+		for search := 0; ; {
+			idx := bytes.Index(window[search:], marker)
+			if idx < 0 {
+				break
+			}
+			idx += search
+			// Reject matches like "12 0 obj" found inside "112 0 obj"
+			if idx == 0 && windowStart == 0 || idx > 0 && isPDFWhitespace(window[idx-1]) {
+				body := make([]byte, 16*1024)
+				bodyStart := windowStart + int64(idx+len(marker))
+				m, _ := file.ReadAt(body, bodyStart)
+				body = body[:m]
+				if end := bytes.Index(body, []byte("endobj")); end >= 0 {
+					body = body[:end]
+				}
+				return body, nil
+			}
+			search = idx + 1
+		}
+
+		offset += int64(n)
+		if err == io.EOF || n == 0 {
+			return nil, nil
+		}
+		carried = overlap
+		if carried > len(window) {
+			carried = len(window)
+		}
+		copy(buf, window[len(window)-carried:])
+	}
+}
+
+func isPDFWhitespace(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\r' || b == '\t' || b == '\f' || b == 0
+}
+
+// pdfDictString returns the literal or hex string stored under key
+func pdfDictString(dict []byte, key string) string {
+	keyPattern := regexp.MustCompile(`/` + key + `\s*([(<])`)
+	loc := keyPattern.FindSubmatchIndex(dict)
+	if loc == nil {
+		return ""
+	}
+	start := loc[2]
+	if dict[start] == '<' {
+		end := bytes.IndexByte(dict[start:], '>')
+		if end < 0 {
+			return ""
+		}
+		hexStr := strings.Map(func(r rune) rune {
+			if strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return r
+			}
+			return -1
+		}, string(dict[start+1:start+end]))
+		if len(hexStr)%2 == 1 {
+			hexStr += "0"
+		}
+		raw := make([]byte, len(hexStr)/2)
+		for i := range raw {
+			v, _ := strconv.ParseUint(hexStr[2*i:2*i+2], 16, 8)
+			raw[i] = byte(v)
+		}
+		return decodePDFText(raw)
+	}
+	return decodePDFText(parsePDFLiteral(dict[start:]))
+}
+
+// parsePDFLiteral decodes a "(...)" string with balanced parentheses and
+// backslash escapes
+func parsePDFLiteral(data []byte) []byte {
+	var out []byte
+	depth := 0
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data):
+			i++
+			switch e := data[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case '\r', '\n':
+				// Line continuation
+				if e == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+					i++
+				}
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for j := 0; j < 3 && i < len(data) && data[i] >= '0' && data[i] <= '7'; j++ {
+						v = v*8 + int(data[i]-'0')
+						i++
+					}
+					i--
+					out = append(out, byte(v))
+				} else {
+					out = append(out, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				out = append(out, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return out
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// decodePDFText handles UTF-16BE strings with a byte order mark, and treats
+// everything else as PDFDocEncoding (close enough to Latin-1 for titles)
+func decodePDFText(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		return decodeUTF16BE(raw[2:])
+	}
+	return decodeLatin1(raw)
+}
+
+func decodeUTF16BE(raw []byte) string {
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(raw[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func decodeLatin1(raw []byte) string {
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// MOBI/AZW3: PalmDB record 0 holds the MOBI header followed by EXTH records
+
+const (
+	exthAuthor       = 100
+	exthISBN         = 104
+	exthUpdatedTitle = 503
+	exthLanguage     = 524
+)
+
+func extractMOBIMetadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return meta, err
+	}
+	defer file.Close()
+
+	record0, err := readPalmDBRecord(file, 0)
+	if err != nil {
+		return meta, err
+	}
+	// PalmDOC header (16 bytes) is followed by the MOBI header
+	if len(record0) < 132 || string(record0[16:20]) != "MOBI" {
+		return meta, fmt.Errorf("missing MOBI header")
+	}
+	textEncoding := binary.BigEndian.Uint32(record0[28:32])
+	decode := decodeLatin1
+	if textEncoding == 65001 {
+		decode = func(b []byte) string { return string(b) }
+	}
+
+	nameOffset := int(binary.BigEndian.Uint32(record0[84:88]))
+	nameLength := int(binary.BigEndian.Uint32(record0[88:92]))
+	if nameOffset > 0 && nameOffset+nameLength <= len(record0) {
+		meta.Title = decode(record0[nameOffset : nameOffset+nameLength])
+	}
+
+	for _, rec := range mobiEXTHRecords(record0) {
+		value := decode(rec.Data)
+		switch rec.Type {
+		case exthAuthor:
+			if meta.Author == "" {
+				meta.Author = value
+			}
+		case exthISBN:
+			meta.ISBN = value
+		case exthUpdatedTitle:
+			meta.Title = value
+		case exthLanguage:
+			meta.Language = value
+		}
+	}
+	return meta, nil
+}
+
+// exthRecord is one entry of the EXTH metadata block
+type exthRecord struct {
+	Type uint32
+	Data []byte
+}
+
+// mobiEXTHRecords returns the EXTH records that follow the MOBI header in
+// record 0, if the header announces any
+func mobiEXTHRecords(record0 []byte) []exthRecord {
+	if len(record0) < 132 {
+		return nil
+	}
+	headerLength := int(binary.BigEndian.Uint32(record0[20:24]))
+	exthFlags := binary.BigEndian.Uint32(record0[128:132])
+	exthStart := 16 + headerLength
+	if exthFlags&0x40 == 0 || exthStart+12 > len(record0) || string(record0[exthStart:exthStart+4]) != "EXTH" {
+		return nil
+	}
+
+	var records []exthRecord
+	count := int(binary.BigEndian.Uint32(record0[exthStart+8 : exthStart+12]))
+	pos := exthStart + 12
+	for i := 0; i < count && pos+8 <= len(record0); i++ {
+		recType := binary.BigEndian.Uint32(record0[pos : pos+4])
+		recLength := int(binary.BigEndian.Uint32(record0[pos+4 : pos+8]))
+		if recLength < 8 || pos+recLength > len(record0) {
+			break
+		}
+		records = append(records, exthRecord{Type: recType, Data: record0[pos+8 : pos+recLength]})
+		pos += recLength
+	}
+	return records
+}
+
+// palmDB reads records from a PalmDB container (MOBI, AZW, AZW3)
+type palmDB struct {
+	file    *os.File
+	offsets []int64
+	size    int64
+}
+
+func openPalmDB(file *os.File) (*palmDB, error) {
+	header := make([]byte, 78)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read PalmDB header: %w", err)
+	}
+	numRecords := int(binary.BigEndian.Uint16(header[76:78]))
+
+	entries := make([]byte, 8*numRecords)
+	if _, err := file.ReadAt(entries, 78); err != nil {
+		return nil, fmt.Errorf("failed to read PalmDB record list: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	db := &palmDB{file: file, offsets: make([]int64, numRecords), size: info.Size()}
+	for i := range db.offsets {
+		db.offsets[i] = int64(binary.BigEndian.Uint32(entries[8*i : 8*i+4]))
+	}
+	return db, nil
+}
+
+// NumRecords returns the number of records in the file
+func (p *palmDB) NumRecords() int {
+	return len(p.offsets)
+}
+
+// Record returns the raw bytes of one record
+func (p *palmDB) Record(index int) ([]byte, error) {
+	if index < 0 || index >= len(p.offsets) {
+		return nil, fmt.Errorf("PalmDB record %d out of range (%d records)", index, len(p.offsets))
+	}
+	start := p.offsets[index]
+	end := p.size
+	if index+1 < len(p.offsets) {
+		end = p.offsets[index+1]
+	}
+	if end <= start || end > p.size || end-start > maxMetadataRead {
+		return nil, fmt.Errorf("invalid PalmDB record %d bounds", index)
+	}
+
+	record := make([]byte, end-start)
+	if _, err := p.file.ReadAt(record, start); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read PalmDB record %d: %w", index, err)
+	}
+	return record, nil
+}
+
+// readPalmDBRecord returns the raw bytes of one record in a PalmDB file
+func readPalmDBRecord(file *os.File, index int) ([]byte, error) {
+	db, err := openPalmDB(file)
+	if err != nil {
+		return nil, err
+	}
+	return db.Record(index)
+}
+
+func normalizeISBN(isbn string) string {
+	return strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(isbn)))
+}
+
+func looksLikeISBN(value string) bool {
+	n := normalizeISBN(value)
+	if len(n) != 10 && len(n) != 13 {
+		return false
+	}
+	for i, r := range n {
+		if r < '0' || r > '9' {
+			// ISBN-10 may end in an X check digit
+			if !(len(n) == 10 && i == 9 && r == 'X') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// backfillMetadata extracts metadata for sent files recorded before it was
+// tracked. Files without embedded metadata store empty strings so they are
+// not retried on every startup.
+func backfillMetadata(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, file_path FROM sent_files WHERE title IS NULL")
+	if err != nil {
+		return err
+	}
+	type pendingRow struct {
+		id       int64
+		filePath string
+	}
+	var pending []pendingRow
+	for rows.Next() {
+		var row pendingRow
+		if err := rows.Scan(&row.id, &row.filePath); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	log.Printf("Extracting metadata for %d sent files...", len(pending))
+	for _, row := range pending {
+		if _, err := os.Stat(row.filePath); err != nil {
+			continue
+		}
+		meta, err := extractMetadata(row.filePath)
+		if err != nil {
+			log.Printf("Error extracting metadata from %s: %v", filepath.Base(row.filePath), err)
+		}
+		if _, err := db.Exec(
+			"UPDATE sent_files SET title = ?, author = ?, language = ?, isbn = ? WHERE id = ?",
+			meta.Title, meta.Author, meta.Language, meta.ISBN, row.id,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestZip writes an archive holding files, in the given order
+func writeTestZip(t *testing.T, path string, files ...[2]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := archive.Create(f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f[1]))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, buf.String())
+}
+
+const testEPUBContainer = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`
+
+func TestExtractEPUBMetadata(t *testing.T) {
+	opf := func(metadata string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" xmlns:opf="http://www.idpf.org/2007/opf">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">` + metadata + `</metadata>
+</package>`
+	}
+
+	tests := []struct {
+		name    string
+		files   [][2]string
+		want    BookMetadata
+		wantErr bool
+	}{
+		{
+			name: "full metadata",
+			files: [][2]string{
+				{"META-INF/container.xml", testEPUBContainer},
+				{"OEBPS/content.opf", opf(`
+    <dc:title> Dune </dc:title>
+    <dc:title>Dune: Deluxe Edition</dc:title>
+    <dc:creator opf:role="edt">An Editor</dc:creator>
+    <dc:creator opf:role="aut">Frank Herbert</dc:creator>
+    <dc:language>en</dc:language>
+    <dc:identifier>urn:uuid:0c4d1d2e-8a0b-4e7a-a1d0-3f3c1f1e2d3c</dc:identifier>
+    <dc:identifier>urn:isbn:978-0-441-17271-9</dc:identifier>`)},
+			},
+			want: BookMetadata{Title: "Dune", Author: "Frank Herbert", Language: "en", ISBN: "9780441172719"},
+		},
+		{
+			name: "first creator without roles",
+			files: [][2]string{
+				{"META-INF/container.xml", testEPUBContainer},
+				{"OEBPS/content.opf", opf(`
+    <dc:title>Good Omens</dc:title>
+    <dc:creator>Terry Pratchett</dc:creator>
+    <dc:creator>Neil Gaiman</dc:creator>
+    <dc:identifier opf:scheme="ISBN">0-552-13703-6</dc:identifier>`)},
+			},
+			want: BookMetadata{Title: "Good Omens", Author: "Terry Pratchett", ISBN: "0552137036"},
+		},
+		{
+			name: "package at the root, no metadata",
+			files: [][2]string{
+				{"META-INF/container.xml", `<container><rootfiles><rootfile full-path="/content.opf"/></rootfiles></container>`},
+				{"content.opf", opf("")},
+			},
+		},
+		{
+			name:    "no container",
+			files:   [][2]string{{"OEBPS/content.opf", opf("<dc:title>Dune</dc:title>")}},
+			wantErr: true,
+		},
+		{
+			name:    "container lists no package",
+			files:   [][2]string{{"META-INF/container.xml", `<container><rootfiles/></container>`}},
+			wantErr: true,
+		},
+		{
+			name:    "package missing",
+			files:   [][2]string{{"META-INF/container.xml", testEPUBContainer}},
+			wantErr: true,
+		},
+		{
+			name: "truncated package",
+			files: [][2]string{
+				{"META-INF/container.xml", testEPUBContainer},
+				{"OEBPS/content.opf", `<package><metadata><dc:title>Dune`},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "book.epub")
+			writeTestZip(t, path, tt.files...)
+			got, err := extractMetadata(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractMetadata() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("extractMetadata() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// A truncated archive is not read
+	path := filepath.Join(t.TempDir(), "book.epub")
+	writeTestZip(t, path, [2]string{"META-INF/container.xml", testEPUBContainer})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, string(data[:len(data)/2]))
+	if _, err := extractMetadata(path); err == nil {
+		t.Error("extractMetadata(truncated archive) succeeded")
+	}
+}
+
+func TestExtractPDFMetadata(t *testing.T) {
+	const catalog = "%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n"
+	tests := []struct {
+		name string
+		pdf  string
+		want BookMetadata
+	}{
+		{
+			name: "literal strings",
+			pdf: catalog + "2 0 obj\n<< /Title (Dune \\(1965\\)) /Author (Frank\\040Herbert) >>\nendobj\n" +
+				"trailer\n<< /Root 1 0 R /Info 2 0 R >>\n%%EOF\n",
+			want: BookMetadata{Title: "Dune (1965)", Author: "Frank Herbert"},
+		},
+		{
+			name: "UTF-16 and Latin-1",
+			pdf: catalog + "2 0 obj\n<< /Title <FEFF00C9 006D006D0061> /Author (Jane Aust\\351n) >>\nendobj\n" +
+				"trailer\n<< /Info 2 0 R >>\n%%EOF\n",
+			want: BookMetadata{Title: "Émma", Author: "Jane Austén"},
+		},
+		{
+			// Object 12 must not be taken for object 2
+			name: "similar object numbers",
+			pdf: catalog + "12 0 obj\n<< /Title (Wrong) >>\nendobj\n2 0 obj\n<< /Title (Right) >>\nendobj\n" +
+				"trailer\n<< /Info 2 0 R >>\n%%EOF\n",
+			want: BookMetadata{Title: "Right"},
+		},
+		{
+			name: "incremental update",
+			pdf: catalog + "2 0 obj\n<< /Title (First) >>\nendobj\ntrailer\n<< /Info 2 0 R >>\n%%EOF\n" +
+				"3 0 obj\n<< /Title (Second) >>\nendobj\ntrailer\n<< /Info 3 0 R /Prev 9 >>\n%%EOF\n",
+			want: BookMetadata{Title: "Second"},
+		},
+		{
+			name: "encrypted",
+			pdf: catalog + "2 0 obj\n<< /Title (Secret) >>\nendobj\n" +
+				"trailer\n<< /Info 2 0 R /Encrypt 5 0 R >>\n%%EOF\n",
+		},
+		{
+			name: "no info",
+			pdf:  catalog + "trailer\n<< /Root 1 0 R >>\n%%EOF\n",
+		},
+		{
+			name: "info object missing",
+			pdf:  catalog + "trailer\n<< /Info 7 0 R >>\n%%EOF\n",
+		},
+		{
+			name: "unterminated strings",
+			pdf:  catalog + "2 0 obj\n<< /Author <46726 /Title (Dune",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "book.pdf")
+			writeTestFile(t, path, tt.pdf)
+			got, err := extractMetadata(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("extractMetadata() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractMOBIMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		mobi testMOBI
+		want BookMetadata
+	}{
+		{
+			name: "header title and EXTH",
+			mobi: testMOBI{title: "Dune", author: "Frank Herbert", exth: []exthRecord{
+				{Type: exthLanguage, Data: []byte("en")},
+				{Type: exthISBN, Data: []byte("978-0-441-17271-9")},
+			}},
+			want: BookMetadata{Title: "Dune", Author: "Frank Herbert", Language: "en", ISBN: "9780441172719"},
+		},
+		{
+			name: "updated title",
+			mobi: testMOBI{title: "DUNE_ABRIDGED", exth: []exthRecord{{Type: exthUpdatedTitle, Data: []byte("Dune")}}},
+			want: BookMetadata{Title: "Dune"},
+		},
+		{
+			name: "first author",
+			mobi: testMOBI{title: "Good Omens", exth: []exthRecord{
+				{Type: exthAuthor, Data: []byte("Terry Pratchett")},
+				{Type: exthAuthor, Data: []byte("Neil Gaiman")},
+			}},
+			want: BookMetadata{Title: "Good Omens", Author: "Terry Pratchett"},
+		},
+		{
+			name: "Latin-1",
+			mobi: testMOBI{title: "\xc9mma", author: "Jane Aust\xe9n", encoding: 1252},
+			want: BookMetadata{Title: "Émma", Author: "Jane Austén"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "book.mobi")
+			tt.mobi.cover = -1
+			writeTestMOBI(t, path, tt.mobi)
+			got, err := extractMetadata(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("extractMetadata() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractMOBIMetadataMalformed(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.mobi")
+	writeTestMOBI(t, valid, testMOBI{title: "Dune", author: "Frank Herbert", cover: -1})
+	data, err := os.ReadFile(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Record 0 starts after the header, the record list and two bytes of
+	// padding
+	record0 := 78 + 8*1 + 2
+
+	notMOBI := append([]byte(nil), data...)
+	copy(notMOBI[record0+16:], "TEXt")
+
+	for name, content := range map[string][]byte{
+		"empty":                nil,
+		"truncated header":     data[:40],
+		"truncated records":    data[:record0+64],
+		"no MOBI header":       notMOBI,
+		"records past the end": append(append([]byte(nil), data[:76]...), 0x7f, 0xff),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, "book.mobi")
+			writeTestFile(t, path, string(content))
+			if meta, err := extractMetadata(path); err == nil {
+				t.Errorf("extractMetadata() = %+v, want an error", meta)
+			}
+		})
+	}
+}
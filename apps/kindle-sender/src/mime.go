@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// base64LineLength is the maximum encoded line length allowed by RFC 2045
+const base64LineLength = 76
+
+// crlf ends encoded lines. Writing it as a byte slice saves converting a
+// string on every line of an attachment.
+var crlf = []byte("\r\n")
+
+// writeMessage streams a MIME multipart email with each attachment read from
+// the matching reader, so only a small fixed-size buffer is held in memory.
+// Headers are written in a fixed order, the subject and file names are
+// encoded so non-ASCII titles survive, and each message gets a random
+// boundary unless the message sets its own.
+func writeMessage(w io.Writer, msg *EmailMessage, attachments []io.Reader) error {
+	bw := bufio.NewWriter(w)
+	mw := multipart.NewWriter(bw)
+	if msg.Boundary != "" {
+		if err := mw.SetBoundary(msg.Boundary); err != nil {
+			return err
+		}
+	}
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID := msg.MessageID
+	if messageID == "" {
+		messageID = newMessageID(msg.From)
+	}
+
+	headers := [][2]string{
+		{"From", msg.From},
+		{"To", msg.To},
+		{"Subject", encodeHeader(msg.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", messageID},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()})},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(bw, "%s: %s\r\n", h[0], h[1])
+	}
+	bw.WriteString("\r\n")
+
+	// Body part, quoted-printable since titles may not be ASCII
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := io.WriteString(qp, strings.ReplaceAll(msg.Body, "\n", "\r\n")); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	// Attachment parts
+	for i, attachment := range msg.Attachments {
+		name := filepath.Base(attachment.Path)
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(attachment.ContentType, map[string]string{"name": asciiFileName(name)})},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {attachmentDisposition(name)},
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeBase64(part, attachments[i]); err != nil {
+			return fmt.Errorf("failed to encode attachment: %w", err)
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encodeHeader RFC 2047 encodes a header value that isn't plain ASCII,
+// folding between encoded words to keep lines short
+func encodeHeader(value string) string {
+	return strings.ReplaceAll(mime.QEncoding.Encode("utf-8", value), "?= =?", "?=\r\n =?")
+}
+
+// newMessageID returns a unique Message-ID in the domain of the sender
+func newMessageID(from string) string {
+	domain := "kindle-sender.local"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = strings.Trim(from[at+1:], "<> ")
+	}
+	var b [12]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b[:]), domain)
+}
+
+// rfc2231Chunk is the longest encoded piece of a parameter value per line
+const rfc2231Chunk = 60
+
+// attachmentDisposition builds the Content-Disposition of an attachment. A
+// name that isn't plain ASCII is given as an RFC 2231 filename*, split into
+// continuations for long names; clients that don't read it still get the
+// ASCII name of the Content-Type.
+func attachmentDisposition(name string) string {
+	if asciiFileName(name) == name {
+		return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	}
+
+	disposition := "attachment"
+	encoded := "utf-8''" + rfc2231Encode(name)
+	if len(encoded) <= rfc2231Chunk {
+		return disposition + ";\r\n filename*=" + encoded
+	}
+	for i := 0; len(encoded) > 0; i++ {
+		n := min(rfc2231Chunk, len(encoded))
+		// Don't split a %XX escape
+		if p := strings.LastIndexByte(encoded[:n], '%'); p >= 0 && p > n-3 && n < len(encoded) {
+			n = p
+		}
+		disposition += fmt.Sprintf(";\r\n filename*%d*=%s", i, encoded[:n])
+		encoded = encoded[n:]
+	}
+	return disposition
+}
+
+// rfc2231Encode percent-encodes the UTF-8 bytes of value that aren't
+// attribute characters
+func rfc2231Encode(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 0x80 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// asciiFileName replaces the characters of a file name that aren't printable
+// ASCII, for the plain filename parameter
+func asciiFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// writeBase64 encodes r as base64 wrapped at 76 characters per line
+func writeBase64(w io.Writer, r io.Reader) error {
+	lw := &lineWrapper{w: w, max: base64LineLength}
+	encoder := base64.NewEncoder(base64.StdEncoding, lw)
+	if _, err := io.Copy(encoder, r); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	// Terminate the last partial line
+	if lw.col > 0 {
+		_, err := w.Write(crlf)
+		return err
+	}
+	return nil
+}
+
+// lineWrapper inserts a CRLF after every max bytes written through it
+type lineWrapper struct {
+	w   io.Writer
+	max int
+	col int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := l.max - l.col
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		l.col += n
+		p = p[n:]
+		if l.col == l.max {
+			if _, err := l.w.Write(crlf); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zeroReader is an endless source of zero bytes, standing in for a book
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// BenchmarkWriteMessage streams a 50 MB attachment. Allocations per message
+// stay the same whatever the attachment size, as it is never held in memory.
+func BenchmarkWriteMessage(b *testing.B) {
+	const size = 50 << 20
+	msg := &EmailMessage{
+		From:        "sender@example.com",
+		To:          "reader@kindle.com",
+		Subject:     "Book: Large",
+		Body:        "Automatically sent by Kindle Sender",
+		Attachments: []EmailAttachment{{Path: "/books/large.pdf", ContentType: "application/pdf"}},
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		attachments := []io.Reader{io.LimitReader(zeroReader{}, size)}
+		if err := writeMessage(io.Discard, msg, attachments); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestWriteMessageGolden(t *testing.T) {
+	date := time.Date(2024, time.March, 9, 18, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		msg   *EmailMessage
+		files []string
+	}{
+		{
+			name: "plain",
+			msg: &EmailMessage{
+				Subject:     "Book: Dune",
+				Body:        "Automatically sent by Kindle Sender\n\nFile: Dune.epub\nSize: 12 bytes",
+				Attachments: []EmailAttachment{{Path: "/books/Dune.epub", ContentType: "application/epub+zip"}},
+			},
+			files: []string{"epub contents"},
+		},
+		{
+			name: "non_ascii",
+			msg: &EmailMessage{
+				Subject:     "Book: Les Misérables — 第一巻",
+				Body:        "Automatically sent by Kindle Sender\n\nTitle: Les Misérables\nAuthor: Victor Hugo",
+				Attachments: []EmailAttachment{{Path: "/books/Les Misérables 第一巻.epub", ContentType: "application/epub+zip"}},
+			},
+			files: []string{"épub"},
+		},
+		{
+			name: "batch",
+			msg: &EmailMessage{
+				Subject: "Books: Dune, The \"Quoted\" Book, Émile and 1 more",
+				Body:    "Automatically sent by Kindle Sender\n\n3 books:",
+				Attachments: []EmailAttachment{
+					{Path: "/books/Dune.epub", ContentType: "application/epub+zip"},
+					{Path: "/books/The \"Quoted\" Book.pdf", ContentType: "application/pdf"},
+					{Path: "/books/Émile.epub", ContentType: "application/epub+zip"},
+				},
+			},
+			files: []string{"first", "second", "third"},
+		},
+		{
+			name: "folding",
+			msg: &EmailMessage{
+				Subject:     "Book: " + strings.Repeat("Ζωή και θάνατος ", 6),
+				Body:        "Automatically sent by Kindle Sender\n\n" + strings.Repeat("long line of body text ", 10),
+				Attachments: []EmailAttachment{{Path: "/books/" + strings.Repeat("Ζωή και θάνατος ", 4) + ".epub", ContentType: "application/epub+zip"}},
+			},
+			files: []string{strings.Repeat("0123456789", 12)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := *tt.msg
+			msg.From = "Sender <sender@example.com>"
+			msg.To = "reader@kindle.com"
+			msg.Date = date
+			msg.MessageID = "<1710009000.golden@example.com>"
+			msg.Boundary = "golden-boundary-" + tt.name
+
+			var attachments []io.Reader
+			for _, content := range tt.files {
+				attachments = append(attachments, strings.NewReader(content))
+			}
+			var buf bytes.Buffer
+			if err := writeMessage(&buf, &msg, attachments); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".eml")
+			if *updateGolden {
+				if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("message differs from %s (run with -update to rewrite):\n%s", golden, buf.String())
+			}
+
+			checkMessageDecodes(t, buf.Bytes(), &msg, tt.files)
+		})
+	}
+}
+
+// checkMessageDecodes parses a generated message back and compares the
+// decoded subject, file names and attachment contents with the originals
+func checkMessageDecodes(t *testing.T, raw []byte, msg *EmailMessage, files []string) {
+	t.Helper()
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	var decoder mime.WordDecoder
+	subject, err := decoder.DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("decoding subject: %v", err)
+	}
+	if subject != msg.Subject {
+		t.Errorf("subject = %q, want %q", subject, msg.Subject)
+	}
+
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Errorf("line longer than 998 characters: %.40s...", line)
+		}
+	}
+
+	_, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	if _, err := reader.NextPart(); err != nil {
+		t.Fatalf("reading body part: %v", err)
+	}
+	for i, attachment := range msg.Attachments {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("reading attachment %d: %v", i, err)
+		}
+		if got, want := part.FileName(), filepath.Base(attachment.Path); got != want {
+			t.Errorf("attachment %d file name = %q, want %q", i, got, want)
+		}
+		content, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		if err != nil {
+			t.Fatalf("decoding attachment %d: %v", i, err)
+		}
+		if string(content) != files[i] {
+			t.Errorf("attachment %d = %q, want %q", i, content, files[i])
+		}
+	}
+}
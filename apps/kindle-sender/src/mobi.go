@@ -0,0 +1,803 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Native MOBI to EPUB conversion. Only the classic MOBI text is supported:
+// the PalmDOC-compressed HTML is decompressed, cleaned up into XHTML and
+// packaged with its images. KF8-only AZW3 books need ebook-convert.
+
+const (
+	mobiCompressionNone    = 1
+	mobiCompressionPalmDOC = 2
+	mobiCompressionHuffman = 17480
+
+	exthCoverOffset = 201
+)
+
+// maxConvertedText caps the decompressed text of a single book
+const maxConvertedText = 64 << 20
+
+// nativeConverter repackages MOBI books as EPUB without external tools
+type nativeConverter struct{}
+
+func (c *nativeConverter) Name() string { return "native" }
+
+func (c *nativeConverter) Convert(src, dir string) (string, error) {
+	book, err := readMOBIBook(src)
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(dir, convertedName(src))
+	if err := book.writeEPUB(out); err != nil {
+		os.Remove(out)
+		return "", err
+	}
+	return out, nil
+}
+
+type mobiBook struct {
+	meta   BookMetadata
+	title  string
+	body   string
+	images map[int]mobiImage
+	cover  int
+}
+
+type mobiImage struct {
+	data      []byte
+	ext       string
+	mediaType string
+}
+
+func readMOBIBook(path string) (*mobiBook, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pdb, err := openPalmDB(file)
+	if err != nil {
+		return nil, err
+	}
+	record0, err := pdb.Record(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(record0) < 132 || string(record0[16:20]) != "MOBI" {
+		return nil, fmt.Errorf("missing MOBI header")
+	}
+
+	compression := binary.BigEndian.Uint16(record0[0:2])
+	textLength := int(binary.BigEndian.Uint32(record0[4:8]))
+	textRecords := int(binary.BigEndian.Uint16(record0[8:10]))
+	encryption := binary.BigEndian.Uint16(record0[12:14])
+	headerLength := int(binary.BigEndian.Uint32(record0[20:24]))
+	textEncoding := binary.BigEndian.Uint32(record0[28:32])
+	mobiVersion := binary.BigEndian.Uint32(record0[36:40])
+	firstImage := int(binary.BigEndian.Uint32(record0[108:112]))
+
+	if encryption != 0 {
+		return nil, fmt.Errorf("book is DRM-protected")
+	}
+	if mobiVersion >= 8 {
+		return nil, fmt.Errorf("KF8-only books are not supported by the native converter, use ebook-convert")
+	}
+	if compression != mobiCompressionNone && compression != mobiCompressionPalmDOC {
+		if compression == mobiCompressionHuffman {
+			return nil, fmt.Errorf("HUFF/CDIC compressed books are not supported by the native converter, use ebook-convert")
+		}
+		return nil, fmt.Errorf("unknown MOBI compression %d", compression)
+	}
+
+	var extraFlags uint16
+	if headerLength >= 0xE4 && len(record0) >= 0xF4 && mobiVersion >= 5 {
+		extraFlags = binary.BigEndian.Uint16(record0[0xF2:0xF4])
+	}
+
+	var text []byte
+	for i := 1; i <= textRecords && i < pdb.NumRecords(); i++ {
+		record, err := pdb.Record(i)
+		if err != nil {
+			return nil, err
+		}
+		record = record[:len(record)-trailingEntriesSize(record, extraFlags)]
+		if compression == mobiCompressionPalmDOC {
+			record = palmDOCDecompress(record)
+		}
+		text = append(text, record...)
+		if len(text) > maxConvertedText {
+			return nil, fmt.Errorf("book text exceeds %d bytes", maxConvertedText)
+		}
+	}
+	if textLength > 0 && len(text) > textLength {
+		text = text[:textLength]
+	}
+
+	meta, err := extractMOBIMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	book := &mobiBook{meta: meta, images: make(map[int]mobiImage)}
+	book.title = strings.TrimSpace(meta.Title)
+	if book.title == "" {
+		book.title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	// Image records follow the text; recindex attributes count from 1
+	if firstImage > 0 && firstImage < pdb.NumRecords() {
+		for i := firstImage; i < pdb.NumRecords(); i++ {
+			record, err := pdb.Record(i)
+			if err != nil {
+				continue
+			}
+			if ext, mediaType := sniffImage(record); ext != "" {
+				book.images[i-firstImage+1] = mobiImage{data: record, ext: ext, mediaType: mediaType}
+			}
+		}
+		for _, rec := range mobiEXTHRecords(record0) {
+			if rec.Type == exthCoverOffset && len(rec.Data) == 4 {
+				if cover := int(binary.BigEndian.Uint32(rec.Data)) + 1; book.images[cover].ext != "" {
+					book.cover = cover
+				}
+			}
+		}
+	}
+
+	text, anchors := insertFileposAnchors(text)
+	var markup string
+	if textEncoding == 65001 {
+		markup = strings.ToValidUTF8(string(text), "\uFFFD")
+	} else {
+		markup = decodeCP1252(text)
+	}
+	book.body = mobiToXHTML(htmlBody(markup), book.images, anchors)
+	return book, nil
+}
+
+// trailingEntriesSize returns how many bytes at the end of a text record are
+// trailing entries rather than text, per the extra data flags
+func trailingEntriesSize(record []byte, flags uint16) int {
+	size := len(record)
+	num := 0
+	for f := flags >> 1; f != 0 && num < size; f >>= 1 {
+		if f&1 != 0 {
+			num += trailingEntrySize(record[:size-num])
+		}
+	}
+	if flags&1 != 0 && num < size {
+		num += int(record[size-num-1]&0x3) + 1
+	}
+	if num > size {
+		return size
+	}
+	return num
+}
+
+// trailingEntrySize decodes the backward-encoded size at the end of data
+func trailingEntrySize(data []byte) int {
+	result, shift := 0, 0
+	for i := len(data) - 1; i >= 0; i-- {
+		v := data[i]
+		result |= int(v&0x7f) << shift
+		shift += 7
+		if v&0x80 != 0 || shift >= 28 {
+			break
+		}
+	}
+	return result
+}
+
+// palmDOCDecompress expands PalmDOC's LZ77 variant
+func palmDOCDecompress(src []byte) []byte {
+	out := make([]byte, 0, 4096)
+	for i := 0; i < len(src); {
+		c := src[i]
+		i++
+		switch {
+		case c >= 1 && c <= 8:
+			// Literal run of c bytes
+			end := i + int(c)
+			if end > len(src) {
+				end = len(src)
+			}
+			out = append(out, src[i:end]...)
+			i = end
+		case c < 0x80:
+			out = append(out, c)
+		case c >= 0xc0:
+			// Space followed by a character
+			out = append(out, ' ', c^0x80)
+		default:
+			// Back reference: 11 bits of distance, 3 bits of length
+			if i >= len(src) {
+				return out
+			}
+			m := int(c)<<8 | int(src[i])
+			i++
+			dist := (m >> 3) & 0x7ff
+			n := (m & 7) + 3
+			if dist == 0 || dist > len(out) {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				out = append(out, out[len(out)-dist])
+			}
+		}
+	}
+	return out
+}
+
+func sniffImage(data []byte) (string, string) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		return ".jpg", "image/jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png", "image/png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return ".gif", "image/gif"
+	}
+	return "", ""
+}
+
+var fileposPattern = regexp.MustCompile(`(?i)filepos=["']?0*([0-9]+)`)
+
+// insertFileposAnchors adds an anchor at every byte offset that a filepos
+// link points to, so the links can become fragment references
+func insertFileposAnchors(text []byte) ([]byte, map[int]bool) {
+	anchors := make(map[int]bool)
+	for _, m := range fileposPattern.FindAllSubmatch(text, -1) {
+		if pos, err := strconv.Atoi(string(m[1])); err == nil && pos < len(text) {
+			anchors[pos] = true
+		}
+	}
+	if len(anchors) == 0 {
+		return text, anchors
+	}
+
+	positions := make([]int, 0, len(anchors))
+	for pos := range anchors {
+		positions = append(positions, pos)
+	}
+	sort.Ints(positions)
+
+	var out bytes.Buffer
+	last := 0
+	for _, pos := range positions {
+		// Never split a tag; anchor in front of it instead
+		at := pos
+		if lt := bytes.LastIndexByte(text[:pos], '<'); lt >= last && lt > bytes.LastIndexByte(text[:pos], '>') {
+			at = lt
+		}
+		if at < last {
+			at = last
+		}
+		out.Write(text[last:at])
+		fmt.Fprintf(&out, `<a id="filepos%d"></a>`, pos)
+		last = at
+	}
+	out.Write(text[last:])
+	return out.Bytes(), anchors
+}
+
+// htmlBody returns the content of the body element, or all of markup if it
+// has none
+func htmlBody(markup string) string {
+	lower := strings.ToLower(markup)
+	start := strings.Index(lower, "<body")
+	if start < 0 {
+		return markup
+	}
+	gt := strings.IndexByte(markup[start:], '>')
+	if gt < 0 {
+		return markup
+	}
+	start += gt + 1
+	end := strings.LastIndex(lower, "</body")
+	if end < start {
+		end = len(markup)
+	}
+	return markup[start:end]
+}
+
+// HTML elements kept in the converted book, mapping obsolete ones to their
+// modern equivalent
+var xhtmlElements = map[string]string{
+	"a": "a", "abbr": "abbr", "b": "b", "big": "span", "blockquote": "blockquote", "br": "br",
+	"caption": "caption", "center": "div", "cite": "cite", "code": "code", "dd": "dd", "del": "del",
+	"div": "div", "dl": "dl", "dt": "dt", "em": "em", "font": "span", "h1": "h1", "h2": "h2",
+	"h3": "h3", "h4": "h4", "h5": "h5", "h6": "h6", "hr": "hr", "i": "i", "img": "img", "ins": "ins",
+	"li": "li", "ol": "ol", "p": "p", "pre": "pre", "q": "q", "s": "s", "small": "small", "span": "span",
+	"strike": "s", "strong": "strong", "sub": "sub", "sup": "sup", "table": "table", "tbody": "tbody",
+	"td": "td", "tfoot": "tfoot", "th": "th", "thead": "thead", "tr": "tr", "tt": "code", "u": "u",
+	"ul": "ul",
+}
+
+var xhtmlVoidElements = map[string]bool{"br": true, "hr": true, "img": true}
+
+// Block elements implicitly close an open paragraph
+var xhtmlBlockElements = map[string]bool{
+	"blockquote": true, "div": true, "dl": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "hr": true, "ol": true, "p": true, "pre": true, "table": true, "ul": true,
+}
+
+var xhtmlIDPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// xhtmlWriter turns loosely nested MOBI markup into well-formed XHTML
+type xhtmlWriter struct {
+	out     strings.Builder
+	stack   []string
+	ids     map[string]bool
+	images  map[int]mobiImage
+	anchors map[int]bool
+}
+
+func mobiToXHTML(markup string, images map[int]mobiImage, anchors map[int]bool) string {
+	w := &xhtmlWriter{ids: make(map[string]bool), images: images, anchors: anchors}
+	for len(markup) > 0 {
+		lt := strings.IndexByte(markup, '<')
+		if lt < 0 {
+			w.text(markup)
+			break
+		}
+		w.text(markup[:lt])
+		markup = markup[lt:]
+
+		if strings.HasPrefix(markup, "<!--") {
+			end := strings.Index(markup, "-->")
+			if end < 0 {
+				break
+			}
+			markup = markup[end+3:]
+			continue
+		}
+		gt := tagEnd(markup)
+		if gt < 0 {
+			// A stray '<' is text
+			w.text("<")
+			markup = markup[1:]
+			continue
+		}
+		tag := markup[1:gt]
+		markup = markup[gt+1:]
+		w.tag(tag)
+	}
+	w.closeTo(0)
+	return w.out.String()
+}
+
+// tagEnd returns the index of the '>' closing the tag at the start of s,
+// skipping quoted attribute values
+func tagEnd(s string) int {
+	var quote byte
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		case c == '<':
+			return -1
+		}
+	}
+	return -1
+}
+
+func (w *xhtmlWriter) tag(tag string) {
+	if tag == "" || tag[0] == '!' || tag[0] == '?' {
+		return
+	}
+	closing := tag[0] == '/'
+	if closing {
+		tag = tag[1:]
+	}
+	nameEnd := strings.IndexAny(tag, " \t\r\n/")
+	if nameEnd < 0 {
+		nameEnd = len(tag)
+	}
+	rawName := strings.ToLower(tag[:nameEnd])
+
+	if rawName == "mbp:pagebreak" {
+		if !closing {
+			w.closeParagraph()
+			w.out.WriteString(`<div class="pagebreak" style="page-break-after: always"></div>`)
+		}
+		return
+	}
+	name, ok := xhtmlElements[rawName]
+	if !ok {
+		return
+	}
+
+	if closing {
+		for i := len(w.stack) - 1; i >= 0; i-- {
+			if w.stack[i] == name {
+				w.closeTo(i)
+				return
+			}
+		}
+		return
+	}
+
+	attrs := w.attributes(rawName, name, parseAttributes(tag[nameEnd:]))
+	if name == "img" && attrs == "" {
+		return
+	}
+
+	switch {
+	case xhtmlBlockElements[name]:
+		w.closeParagraph()
+	case name == "li":
+		w.closeOpen("li", "ul", "ol")
+	case name == "dt" || name == "dd":
+		w.closeOpen("dt", "dl")
+		w.closeOpen("dd", "dl")
+	case name == "tr":
+		w.closeOpen("tr", "table", "tbody", "thead", "tfoot")
+	case name == "td" || name == "th":
+		w.closeOpen("td", "tr")
+		w.closeOpen("th", "tr")
+	}
+
+	if xhtmlVoidElements[name] {
+		fmt.Fprintf(&w.out, "<%s%s/>", name, attrs)
+		return
+	}
+	fmt.Fprintf(&w.out, "<%s%s>", name, attrs)
+	w.stack = append(w.stack, name)
+}
+
+// attributes keeps the attributes valid in XHTML, converting MOBI specific
+// ones (filepos links, recindex images, align)
+func (w *xhtmlWriter) attributes(rawName, name string, attrs map[string]string) string {
+	var b strings.Builder
+	add := func(key, value string) {
+		fmt.Fprintf(&b, ` %s="%s"`, key, escapeXMLAttr(value))
+	}
+
+	if name == "img" {
+		index, err := strconv.Atoi(attrs["recindex"])
+		image, ok := w.images[index]
+		if err != nil || !ok {
+			return ""
+		}
+		add("src", fmt.Sprintf("images/img%05d%s", index, image.ext))
+		add("alt", attrs["alt"])
+		return b.String()
+	}
+
+	id := attrs["id"]
+	if id == "" && name == "a" {
+		id = attrs["name"]
+	}
+	if id != "" && xhtmlIDPattern.MatchString(id) && !w.ids[id] {
+		w.ids[id] = true
+		add("id", id)
+	}
+	if class := attrs["class"]; class != "" {
+		add("class", class)
+	}
+
+	var style []string
+	if s := strings.TrimSpace(attrs["style"]); s != "" {
+		style = append(style, strings.TrimSuffix(s, ";"))
+	}
+	if align := strings.ToLower(attrs["align"]); align == "left" || align == "right" || align == "center" || align == "justify" {
+		style = append(style, "text-align: "+align)
+	} else if rawName == "center" {
+		style = append(style, "text-align: center")
+	}
+	if rawName == "big" {
+		style = append(style, "font-size: larger")
+	}
+	if len(style) > 0 {
+		add("style", strings.Join(style, "; "))
+	}
+
+	if name == "a" {
+		if pos, err := strconv.Atoi(attrs["filepos"]); err == nil && w.anchors[pos] {
+			add("href", fmt.Sprintf("#filepos%d", pos))
+		} else if href := attrs["href"]; strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "mailto:") {
+			add("href", href)
+		}
+	}
+	if name == "td" || name == "th" {
+		for _, key := range []string{"colspan", "rowspan"} {
+			if _, err := strconv.Atoi(attrs[key]); err == nil {
+				add(key, attrs[key])
+			}
+		}
+	}
+	return b.String()
+}
+
+// parseAttributes reads name=value pairs with quoted, unquoted or missing
+// values
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n/")
+		if s == "" {
+			return attrs
+		}
+		end := strings.IndexAny(s, " \t\r\n=/")
+		if end < 0 {
+			end = len(s)
+		}
+		key := strings.ToLower(s[:end])
+		s = strings.TrimLeft(s[end:], " \t\r\n")
+
+		value := ""
+		if strings.HasPrefix(s, "=") {
+			s = strings.TrimLeft(s[1:], " \t\r\n")
+			if s != "" && (s[0] == '"' || s[0] == '\'') {
+				quote := s[0]
+				closeQuote := strings.IndexByte(s[1:], quote)
+				if closeQuote < 0 {
+					value, s = s[1:], ""
+				} else {
+					value, s = s[1:closeQuote+1], s[closeQuote+2:]
+				}
+			} else {
+				end := strings.IndexAny(s, " \t\r\n")
+				if end < 0 {
+					end = len(s)
+				}
+				value, s = s[:end], s[end:]
+			}
+		}
+		if key != "" {
+			if _, seen := attrs[key]; !seen {
+				attrs[key] = html.UnescapeString(value)
+			}
+		}
+	}
+}
+
+func (w *xhtmlWriter) text(s string) {
+	if s == "" {
+		return
+	}
+	w.out.WriteString(escapeXMLText(html.UnescapeString(s)))
+}
+
+// closeTo closes every open element from index i upwards
+func (w *xhtmlWriter) closeTo(i int) {
+	for len(w.stack) > i {
+		fmt.Fprintf(&w.out, "</%s>", w.stack[len(w.stack)-1])
+		w.stack = w.stack[:len(w.stack)-1]
+	}
+}
+
+func (w *xhtmlWriter) closeParagraph() {
+	w.closeOpen("p")
+}
+
+// closeOpen closes the innermost open name element, unless one of the
+// boundary elements is open inside it
+func (w *xhtmlWriter) closeOpen(name string, boundaries ...string) {
+	for i := len(w.stack) - 1; i >= 0; i-- {
+		if w.stack[i] == name {
+			w.closeTo(i)
+			return
+		}
+		for _, boundary := range boundaries {
+			if w.stack[i] == boundary {
+				return
+			}
+		}
+	}
+}
+
+var (
+	xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	xmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+func escapeXMLText(s string) string {
+	return xmlTextEscaper.Replace(stripInvalidXMLChars(s))
+}
+
+func escapeXMLAttr(s string) string {
+	return xmlAttrEscaper.Replace(stripInvalidXMLChars(s))
+}
+
+// stripInvalidXMLChars drops control characters that XML 1.0 forbids
+func stripInvalidXMLChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r != 0xfffe && r != 0xffff) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// cp1252 maps the bytes 0x80-0x9f, where Windows-1252 differs from Latin-1
+var cp1252 = [32]rune{
+	'€', 0xfffd, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0xfffd, 'Ž', 0xfffd,
+	0xfffd, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0xfffd, 'ž', 'Ÿ',
+}
+
+func decodeCP1252(raw []byte) string {
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		if b >= 0x80 && b < 0xa0 {
+			runes[i] = cp1252[b-0x80]
+		} else {
+			runes[i] = rune(b)
+		}
+	}
+	return string(runes)
+}
+
+// writeEPUB packages the book as an EPUB 3 file
+func (b *mobiBook) writeEPUB(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create EPUB: %w", err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	now := time.Now()
+	create := func(name string, method uint16) (io.Writer, error) {
+		return archive.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: now})
+	}
+
+	// The mimetype entry must come first and be stored uncompressed
+	mimetype, err := create("mimetype", zip.Store)
+	if err != nil {
+		return err
+	}
+	mimetype.Write([]byte("application/epub+zip"))
+
+	indexes := make([]int, 0, len(b.images))
+	for index := range b.images {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var manifest strings.Builder
+	for _, index := range indexes {
+		image := b.images[index]
+		properties := ""
+		if index == b.cover {
+			properties = ` properties="cover-image"`
+		}
+		fmt.Fprintf(&manifest, "    <item id=\"img%05d\" href=\"images/img%05d%s\" media-type=\"%s\"%s/>\n",
+			index, index, image.ext, image.mediaType, properties)
+	}
+
+	title := escapeXMLText(b.title)
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"META-INF/container.xml", epubContainerXML},
+		{"OEBPS/content.opf", fmt.Sprintf(epubPackageOPF, b.language(), escapeXMLText(b.identifier()), title,
+			b.creator(), escapeXMLText(b.language()), now.UTC().Format("2006-01-02T15:04:05Z"), b.coverMeta(), manifest.String())},
+		{"OEBPS/nav.xhtml", fmt.Sprintf(epubNavXHTML, title, title)},
+		{"OEBPS/text.xhtml", fmt.Sprintf(epubTextXHTML, title, b.body)},
+	}
+	for _, f := range files {
+		w, err := create(f.name, zip.Deflate)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			return err
+		}
+	}
+	for _, index := range indexes {
+		image := b.images[index]
+		w, err := create(fmt.Sprintf("OEBPS/images/img%05d%s", index, image.ext), zip.Deflate)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(image.data); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (b *mobiBook) language() string {
+	if b.meta.Language != "" && xhtmlIDPattern.MatchString(b.meta.Language) {
+		return b.meta.Language
+	}
+	return "und"
+}
+
+func (b *mobiBook) identifier() string {
+	if isbn := normalizeISBN(b.meta.ISBN); looksLikeISBN(isbn) {
+		return "urn:isbn:" + isbn
+	}
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func (b *mobiBook) creator() string {
+	if b.meta.Author == "" {
+		return ""
+	}
+	return fmt.Sprintf("\n    <dc:creator>%s</dc:creator>", escapeXMLText(b.meta.Author))
+}
+
+func (b *mobiBook) coverMeta() string {
+	if b.cover == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n    <meta name=\"cover\" content=\"img%05d\"/>", b.cover)
+}
+
+const epubContainerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubPackageOPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid" xml:lang="%s">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="bookid">%s</dc:identifier>
+    <dc:title>%s</dc:title>%s
+    <dc:language>%s</dc:language>
+    <meta property="dcterms:modified">%s</meta>%s
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="text" href="text.xhtml" media-type="application/xhtml+xml"/>
+%s  </manifest>
+  <spine>
+    <itemref idref="text"/>
+  </spine>
+</package>
+`
+
+const epubNavXHTML = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title></head>
+<body>
+<nav epub:type="toc"><ol><li><a href="text.xhtml">%s</a></li></ol></nav>
+</body>
+</html>
+`
+
+const epubTextXHTML = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>%s</title></head>
+<body>
+%s
+</body>
+</html>
+`
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testMOBI describes a MOBI file for writeTestMOBI. Text records are stored
+// as given, so compressed text must already be compressed.
+type testMOBI struct {
+	title       string
+	author      string
+	compression uint16
+	encoding    uint32
+	version     uint32
+	encryption  uint16
+	extraFlags  uint16
+	textLength  int
+	text        [][]byte
+	images      [][]byte
+	cover       int // index into images, or -1 for none
+	exth        []exthRecord
+}
+
+// writeTestMOBI writes a PalmDB file with a MOBI header, EXTH metadata, the
+// text records and then the image records
+func writeTestMOBI(t *testing.T, path string, m testMOBI) {
+	t.Helper()
+	if m.compression == 0 {
+		m.compression = mobiCompressionNone
+	}
+	if m.encoding == 0 {
+		m.encoding = 65001
+	}
+	if m.version == 0 {
+		m.version = 6
+	}
+	if m.textLength == 0 {
+		for _, record := range m.text {
+			m.textLength += len(record)
+		}
+	}
+
+	var exth bytes.Buffer
+	var exthCount uint32
+	addEXTH := func(recType uint32, data []byte) {
+		binary.Write(&exth, binary.BigEndian, recType)
+		binary.Write(&exth, binary.BigEndian, uint32(8+len(data)))
+		exth.Write(data)
+		exthCount++
+	}
+	if m.author != "" {
+		addEXTH(exthAuthor, []byte(m.author))
+	}
+	if m.cover >= 0 && m.cover < len(m.images) {
+		addEXTH(exthCoverOffset, binary.BigEndian.AppendUint32(nil, uint32(m.cover)))
+	}
+	for _, rec := range m.exth {
+		addEXTH(rec.Type, rec.Data)
+	}
+
+	const headerLength = 0xE8
+	record0 := make([]byte, 16+headerLength)
+	binary.BigEndian.PutUint16(record0[0:2], m.compression)
+	binary.BigEndian.PutUint32(record0[4:8], uint32(m.textLength))
+	binary.BigEndian.PutUint16(record0[8:10], uint16(len(m.text)))
+	binary.BigEndian.PutUint16(record0[10:12], 4096)
+	binary.BigEndian.PutUint16(record0[12:14], m.encryption)
+	copy(record0[16:20], "MOBI")
+	binary.BigEndian.PutUint32(record0[20:24], headerLength)
+	binary.BigEndian.PutUint32(record0[24:28], 2)
+	binary.BigEndian.PutUint32(record0[28:32], m.encoding)
+	binary.BigEndian.PutUint32(record0[36:40], m.version)
+	firstImage := uint32(0xFFFFFFFF)
+	if len(m.images) > 0 {
+		firstImage = uint32(1 + len(m.text))
+	}
+	binary.BigEndian.PutUint32(record0[108:112], firstImage)
+	binary.BigEndian.PutUint32(record0[128:132], 0x40)
+	binary.BigEndian.PutUint16(record0[0xF2:0xF4], m.extraFlags)
+
+	record0 = append(record0, "EXTH"...)
+	record0 = binary.BigEndian.AppendUint32(record0, uint32(12+exth.Len()))
+	record0 = binary.BigEndian.AppendUint32(record0, exthCount)
+	record0 = append(record0, exth.Bytes()...)
+	binary.BigEndian.PutUint32(record0[84:88], uint32(len(record0)))
+	binary.BigEndian.PutUint32(record0[88:92], uint32(len(m.title)))
+	record0 = append(record0, m.title...)
+	record0 = append(record0, 0, 0)
+
+	records := append([][]byte{record0}, m.text...)
+	records = append(records, m.images...)
+
+	header := make([]byte, 78)
+	copy(header, "test")
+	copy(header[60:68], "BOOKMOBI")
+	binary.BigEndian.PutUint16(header[76:78], uint16(len(records)))
+	var out bytes.Buffer
+	out.Write(header)
+	offset := 78 + 8*len(records) + 2
+	for i, record := range records {
+		binary.Write(&out, binary.BigEndian, uint32(offset))
+		binary.Write(&out, binary.BigEndian, uint32(i))
+		offset += len(record)
+	}
+	out.Write([]byte{0, 0})
+	for _, record := range records {
+		out.Write(record)
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// palmDOCLiterals encodes data as PalmDOC without compressing it
+func palmDOCLiterals(data []byte) []byte {
+	var out []byte
+	for _, c := range data {
+		if c >= 0x09 && c < 0x80 {
+			out = append(out, c)
+		} else {
+			out = append(out, 1, c)
+		}
+	}
+	return out
+}
+
+func TestPalmDOCDecompress(t *testing.T) {
+	tests := []struct {
+		name string
+		src  []byte
+		want string
+	}{
+		{"plain bytes", []byte("Dune"), "Dune"},
+		{"literal run", []byte{'a', 3, 0xe9, 0x00, 0x80, 'b'}, "a\xe9\x00\x80b"},
+		{"space and character", []byte{'a', 0xe2, 0xe3}, "a b c"},
+		// 0x8021: distance 4, length 1+3
+		{"back reference", []byte{'a', 'b', 'c', 'd', 0x80, 0x21}, "abcdabcd"},
+		// 0x8013: distance 2, length 3+3, overlapping what it copies
+		{"overlapping back reference", []byte{'a', 'b', 0x80, 0x13}, "abababab"},
+		{"distance past the start", []byte{'a', 0x80, 0x41}, "a"},
+		{"truncated back reference", []byte{'a', 0x80}, "a"},
+		{"truncated literal run", []byte{'a', 4, 'b', 'c'}, "abc"},
+	}
+	for _, tt := range tests {
+		if got := palmDOCDecompress(tt.src); string(got) != tt.want {
+			t.Errorf("%s: palmDOCDecompress(%x) = %q, want %q", tt.name, tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestTrailingEntriesSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		record string
+		flags  uint16
+		want   int
+	}{
+		{"no flags", "text\x83", 0, 0},
+		// The low two bits of the last byte count the extra bytes of a
+		// character split across records
+		{"multibyte", "text\xc3\x01", 1, 2},
+		// Trailing entries end with their size, including itself, encoded
+		// backwards with the high bit marking the first byte
+		{"one entry", "textxy\x83", 2, 3},
+		{"two byte size", "text" + strings.Repeat("x", 128) + "\x81\x02", 2, 130},
+		{"two entries", "textx\x82y\x82", 6, 4},
+		{"entry and multibyte", "tex\xc3\x01z\x82", 3, 4},
+		{"entry larger than record", "te\x8a", 2, 3},
+	}
+	for _, tt := range tests {
+		if got := trailingEntriesSize([]byte(tt.record), tt.flags); got != tt.want {
+			t.Errorf("%s: trailingEntriesSize() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInsertFileposAnchors(t *testing.T) {
+	link := `<p><a filepos=%010d>Chapter 1</a></p>`
+	chapter := `<h2>Chapter 1</h2>`
+	target := len(fmt.Sprintf(link, 0))
+
+	tests := []struct {
+		name    string
+		pos     int
+		want    string
+		anchors []int
+	}{
+		{
+			name:    "before a tag",
+			pos:     target,
+			want:    fmt.Sprintf(link, target) + fmt.Sprintf(`<a id="filepos%d"></a>`, target) + chapter,
+			anchors: []int{target},
+		},
+		{
+			// Never inside a tag, but in front of it
+			name:    "inside a tag",
+			pos:     target + 2,
+			want:    fmt.Sprintf(link, target+2) + fmt.Sprintf(`<a id="filepos%d"></a>`, target+2) + chapter,
+			anchors: []int{target + 2},
+		},
+		{
+			name: "past the end",
+			pos:  target + len(chapter),
+			want: fmt.Sprintf(link, target+len(chapter)) + chapter,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, anchors := insertFileposAnchors([]byte(fmt.Sprintf(link, tt.pos) + chapter))
+			if string(got) != tt.want {
+				t.Errorf("text = %s, want %s", got, tt.want)
+			}
+			if len(anchors) != len(tt.anchors) {
+				t.Fatalf("anchors = %v, want %v", anchors, tt.anchors)
+			}
+			for _, pos := range tt.anchors {
+				if !anchors[pos] {
+					t.Errorf("anchors = %v, want %d", anchors, pos)
+				}
+			}
+		})
+	}
+}
+
+func TestNativeConverter(t *testing.T) {
+	link := `<html><body><p><a filepos=%010d>Part Two</a></p>`
+	rest := `<p>It was a <b>dark</b> night &amp; cold.<mbp:pagebreak/><h2>Part Two</h2><p><img recindex="00001"></p></body></html>`
+	text := []byte(fmt.Sprintf(link, len(fmt.Sprintf(link, 0))+strings.Index(rest, "<h2>")) + rest)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...)
+
+	// Two compressed text records, each followed by a one byte trailing
+	// entry that must not end up in the text
+	half := len(text) / 2
+	src := filepath.Join(t.TempDir(), "Dune.mobi")
+	writeTestMOBI(t, src, testMOBI{
+		title:       "Dune",
+		author:      "Frank Herbert",
+		compression: mobiCompressionPalmDOC,
+		extraFlags:  2,
+		textLength:  len(text),
+		text: [][]byte{
+			append(palmDOCLiterals(text[:half]), 0x81),
+			append(palmDOCLiterals(text[half:]), 0x81),
+		},
+		images: [][]byte{png},
+		cover:  0,
+	})
+
+	book, err := readMOBIBook(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.title != "Dune" || book.meta.Author != "Frank Herbert" {
+		t.Errorf("book = %q by %q, want Dune by Frank Herbert", book.title, book.meta.Author)
+	}
+	if book.cover != 1 || book.images[1].ext != ".png" {
+		t.Errorf("cover = %d, images = %v, want the PNG as cover", book.cover, book.images)
+	}
+	for _, want := range []string{
+		`It was a <b>dark</b> night &amp; cold.`,
+		`class="pagebreak"`,
+		`<a href="#filepos`,
+		`<a id="filepos`,
+		`<img src="images/img00001.png" alt=""/>`,
+	} {
+		if !strings.Contains(book.body, want) {
+			t.Errorf("body does not contain %s:\n%s", want, book.body)
+		}
+	}
+	if strings.ContainsRune(book.body, '\uFFFD') {
+		t.Errorf("trailing entries ended up in the body:\n%s", book.body)
+	}
+
+	out, err := (&nativeConverter{}).Convert(src, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if first := archive.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Errorf("first entry = %s, method %d, want a stored mimetype", first.Name, first.Method)
+	}
+	entries := make(map[string]string)
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name] = string(content)
+	}
+	if entries["OEBPS/images/img00001.png"] != string(png) {
+		t.Error("the image is missing from the EPUB")
+	}
+	for _, name := range []string{"OEBPS/content.opf", "OEBPS/nav.xhtml", "OEBPS/text.xhtml"} {
+		decoder := xml.NewDecoder(strings.NewReader(entries[name]))
+		for {
+			if _, err := decoder.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%s is not well-formed: %v", name, err)
+				break
+			}
+		}
+	}
+
+	// The EPUB reads back with the book's metadata
+	meta, err := extractEPUBMetadata(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Dune" || meta.Author != "Frank Herbert" {
+		t.Errorf("EPUB metadata = %q by %q, want Dune by Frank Herbert", meta.Title, meta.Author)
+	}
+}
+
+func TestReadMOBIBookRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		mobi testMOBI
+		want string
+	}{
+		{"DRM", testMOBI{encryption: 2, text: [][]byte{[]byte("x")}}, "DRM"},
+		{"KF8", testMOBI{version: 8, text: [][]byte{[]byte("x")}}, "KF8"},
+		{"HUFF/CDIC", testMOBI{compression: mobiCompressionHuffman, text: [][]byte{[]byte("x")}}, "HUFF/CDIC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mobi.cover = -1
+			path := filepath.Join(t.TempDir(), "book.mobi")
+			writeTestMOBI(t, path, tt.mobi)
+			if _, err := readMOBIBook(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("readMOBIBook() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
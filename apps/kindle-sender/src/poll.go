@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Watch modes selected by WATCH_MODE
+const (
+	watchModeInotify  = "inotify"
+	watchModeFsnotify = "fsnotify"
+	watchModePoll     = "poll"
+)
+
+// Change kinds reported by the watchers
+const (
+	watchCreate     = "create"
+	watchModify     = "modify"
+	watchDelete     = "delete"
+	watchCloseWrite = "close_write"
+	watchMovedTo    = "moved_to"
+	watchMovedFrom  = "moved_from"
+	watchRename     = "rename"
+)
+
+// file_snapshots holds what the polling watcher saw on its last pass, so
+// changes made while the pod was down are noticed on the first pass
+const createFileSnapshotsSQL = `
+	CREATE TABLE IF NOT EXISTS file_snapshots (
+		file_path TEXT PRIMARY KEY,
+		file_size INTEGER NOT NULL,
+		mtime INTEGER NOT NULL,
+		inode INTEGER NOT NULL
+	);
+	`
+
+// fileSnapshot identifies one version of a file. A changed inode with the
+// same size and mtime means the file was replaced.
+type fileSnapshot struct {
+	Size  int64
+	MTime int64
+	Inode int64
+}
+
+func snapshotOf(info fs.FileInfo) fileSnapshot {
+	snap := fileSnapshot{Size: info.Size(), MTime: info.ModTime().UnixNano()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		// Stored as SQLite's signed integer; only equality matters
+		snap.Inode = int64(st.Ino)
+	}
+	return snap
+}
+
+// pollWatcher detects changes by walking the watch path and diffing against
+// the previous pass. It only stats files, so a pass is far cheaper than a
+// scan, which queries the database for every book.
+type pollWatcher struct {
+	watchPath string
+	config    *Config
+	db        *sql.DB
+	worker    *Worker
+	// known is the last persisted state; unsettled holds files that changed
+	// on the last pass and are reported once they stop changing
+	known     map[string]fileSnapshot
+	unsettled map[string]fileSnapshot
+}
+
+// pollDirectory watches by polling every POLL_INTERVAL, for filesystems such
+// as NFS where inotify never sees writes made by other hosts
+func pollDirectory(watchPath string, config *Config, db *sql.DB, worker *Worker) error {
+	p := &pollWatcher{
+		watchPath: watchPath,
+		config:    config,
+		db:        db,
+		worker:    worker,
+		unsettled: make(map[string]fileSnapshot),
+	}
+	var err error
+	if p.known, err = loadFileSnapshots(db); err != nil {
+		return fmt.Errorf("failed to load file snapshots: %w", err)
+	}
+
+	log.Printf("Polling directory: %s (every %d seconds)", watchPath, config.PollInterval)
+
+	// An empty snapshot table is seeded silently; the initial scan has
+	// already picked up everything there
+	if len(p.known) == 0 {
+		if err := p.poll(false); err != nil {
+			log.Printf("Error polling %s: %v", watchPath, err)
+		}
+	}
+
+	ticker := time.NewTicker(time.Duration(config.PollInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.poll(true); err != nil {
+			log.Printf("Error polling %s: %v", watchPath, err)
+		}
+	}
+	return nil
+}
+
+// poll makes one pass, reporting changes when report is set, and saves the
+// new state
+func (p *pollWatcher) poll(report bool) error {
+	start := time.Now()
+	current := make(map[string]fileSnapshot, len(p.known))
+	err := filepath.WalkDir(p.watchPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Entries removed mid-walk are reported as deleted. Any other
+			// error abandons the pass rather than mistaking an unreadable
+			// folder for deleted books.
+			if errors.Is(err, fs.ErrNotExist) && path != p.watchPath {
+				return nil
+			}
+			return err
+		}
+		if isIgnoredPath(path, p.config) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isSupportedFile(d.Name(), p.config.FileExtensions) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		current[path] = snapshotOf(info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[string]fileSnapshot)
+	var events int
+	for path, snap := range current {
+		old, seen := p.known[path]
+		if seen && old == snap {
+			delete(p.unsettled, path)
+			continue
+		}
+		if !report {
+			changed[path] = snap
+			continue
+		}
+		// Report a change once the file has held still for a whole pass, so
+		// a copy in progress isn't picked up half written
+		if pending, ok := p.unsettled[path]; !ok || pending != snap {
+			p.unsettled[path] = snap
+			continue
+		}
+		delete(p.unsettled, path)
+		changed[path] = snap
+
+		op := watchModify
+		if !seen {
+			op = watchCreate
+		}
+		p.emit(op, path)
+		events++
+	}
+
+	var removed []string
+	for path := range p.known {
+		if _, ok := current[path]; ok {
+			continue
+		}
+		removed = append(removed, path)
+		delete(p.unsettled, path)
+		if report {
+			p.emit(watchDelete, path)
+			events++
+		}
+	}
+
+	if len(changed) > 0 || len(removed) > 0 {
+		// The worker owns database writes
+		err := p.worker.Do(func() error {
+			return saveFileSnapshots(p.db, changed, removed)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save file snapshots: %w", err)
+		}
+		for path, snap := range changed {
+			p.known[path] = snap
+		}
+		for _, path := range removed {
+			delete(p.known, path)
+		}
+	}
+
+	pollDuration.Set(time.Since(start).Seconds())
+	if events > 0 {
+		log.Printf("Poll found %d changes in %d files (%.1fs)", events, len(current), time.Since(start).Seconds())
+	}
+	return nil
+}
+
+// emit hands a change to the worker
+func (p *pollWatcher) emit(op, path string) {
+	watchEventsTotal.WithLabelValues(op).Inc()
+	switch op {
+	case watchCreate, watchModify:
+		p.worker.Enqueue(path)
+	case watchDelete:
+		p.worker.Removed(path)
+	}
+}
+
+func loadFileSnapshots(db *sql.DB) (map[string]fileSnapshot, error) {
+	rows, err := db.Query("SELECT file_path, file_size, mtime, inode FROM file_snapshots")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := make(map[string]fileSnapshot)
+	for rows.Next() {
+		var path string
+		var snap fileSnapshot
+		if err := rows.Scan(&path, &snap.Size, &snap.MTime, &snap.Inode); err != nil {
+			return nil, err
+		}
+		snapshots[path] = snap
+	}
+	return snapshots, rows.Err()
+}
+
+// saveFileSnapshots applies one pass's changes in a single transaction
+func saveFileSnapshots(db *sql.DB, changed map[string]fileSnapshot, removed []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upsert, err := tx.Prepare(
+		`INSERT INTO file_snapshots (file_path, file_size, mtime, inode) VALUES (?, ?, ?, ?)
+		ON CONFLICT(file_path) DO UPDATE SET file_size = excluded.file_size, mtime = excluded.mtime, inode = excluded.inode`,
+	)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+	for path, snap := range changed {
+		if _, err := upsert.Exec(path, snap.Size, snap.MTime, snap.Inode); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range removed {
+		if _, err := tx.Exec("DELETE FROM file_snapshots WHERE file_path = ?", path); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
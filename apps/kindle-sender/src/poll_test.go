@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newTestPollWatcher returns a watcher on config.WatchPath whose worker runs
+// actions but leaves paths queued, so a test can see what was emitted
+func newTestPollWatcher(t *testing.T, config *Config) *pollWatcher {
+	t.Helper()
+	db := newTestDB(t)
+	worker := NewWorker(config, db, newTestProfiles(t, config, &recordingTransport{}), nil, nil, nil)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case fn := <-worker.actions:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return &pollWatcher{
+		watchPath: config.WatchPath,
+		config:    config,
+		db:        db,
+		worker:    worker,
+		known:     make(map[string]fileSnapshot),
+		unsettled: make(map[string]fileSnapshot),
+	}
+}
+
+// pollEmitted makes a reporting pass and returns the base names of the
+// paths it handed to the worker
+func pollEmitted(t *testing.T, p *pollWatcher) string {
+	t.Helper()
+	if err := p.poll(true); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	var names []string
+	for {
+		path, _, ok := p.worker.paths.Pop()
+		if !ok {
+			break
+		}
+		names = append(names, filepath.Base(path))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestPollWatcherWaitsForFilesToSettle(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestPollWatcher(t, config)
+	dune := filepath.Join(config.WatchPath, "Dune.epub")
+	emma := filepath.Join(config.WatchPath, "Emma.epub")
+	writeTestFile(t, dune, "dune")
+
+	// The seeding pass reports nothing
+	if err := p.poll(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := pollEmitted(t, p); got != "" {
+		t.Fatalf("first pass after seeding emitted %s, want nothing", got)
+	}
+
+	// A copy still growing on every pass is held back
+	content := "e"
+	for i := 0; i < 3; i++ {
+		content += "mma"
+		writeTestFile(t, emma, content)
+		if got := pollEmitted(t, p); got != "" {
+			t.Fatalf("pass %d emitted %s while Emma.epub was changing", i+1, got)
+		}
+	}
+	if got := pollEmitted(t, p); got != "Emma.epub" {
+		t.Fatalf("pass after Emma.epub held still emitted %q, want Emma.epub", got)
+	}
+	if got := pollEmitted(t, p); got != "" {
+		t.Errorf("pass after the create emitted %s again", got)
+	}
+
+	// A modification waits a pass as well
+	writeTestFile(t, dune, "dune, revised")
+	if got := pollEmitted(t, p); got != "" {
+		t.Fatalf("pass right after the change emitted %s", got)
+	}
+	if got := pollEmitted(t, p); got != "Dune.epub" {
+		t.Fatalf("pass after Dune.epub held still emitted %q, want Dune.epub", got)
+	}
+
+	// What was reported is saved, so a restarted watcher starts from it
+	saved, err := loadFileSnapshots(p.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved[dune] != snapshotOf(statTestFile(t, dune)) || saved[emma] != snapshotOf(statTestFile(t, emma)) {
+		t.Errorf("saved snapshots = %+v, want both books as last seen", saved)
+	}
+}
+
+func TestPollWatcherPicksUpRenames(t *testing.T) {
+	config := newTestConfig(t)
+	p := newTestPollWatcher(t, config)
+	oldPath := filepath.Join(config.WatchPath, "Unsorted", "Dune.epub")
+	newPath := filepath.Join(config.WatchPath, "Frank Herbert", "Dune.epub")
+	writeTestFile(t, oldPath, "dune")
+	if err := p.poll(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old path's queue item is forgotten once the rename is seen
+	profile := p.worker.profiles.Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+	if _, err := enqueueFile(p.db, oldPath, target, 4, "hash", BookMetadata{}, queueStatusPending); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The removal is reported at once, the new path once it has held still
+	if got := pollEmitted(t, p); got != "" {
+		t.Fatalf("pass right after the rename emitted %s", got)
+	}
+	if _, ok := p.known[oldPath]; ok {
+		t.Error("old path still known after the rename")
+	}
+	waitFor(t, "the old path's queue item to be forgotten", func() bool {
+		status, err := queueStatus(p.db, oldPath, config.KindleEmail)
+		return err == nil && status == ""
+	})
+
+	if got := pollEmitted(t, p); got != "Dune.epub" {
+		t.Fatalf("second pass emitted %q, want the renamed Dune.epub", got)
+	}
+	saved, err := loadFileSnapshots(p.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved[oldPath]; ok || len(saved) != 1 {
+		t.Errorf("saved snapshots = %+v, want only the new path", saved)
+	}
+	if _, ok := saved[newPath]; !ok {
+		t.Errorf("saved snapshots = %+v, want the new path", saved)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultProfile is the implicit profile built from the top-level settings
+const defaultProfile = "default"
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Profile is one sender with its own SMTP account, Kindle address, accepted
+// formats, size limit and rate limiter. Settings a profile leaves unset are
+// inherited from the top-level configuration, which also forms the implicit
+// default profile.
+type Profile struct {
+	Name        string
+	Config      *Config
+	Transport   Transport
+	RateLimiter *RateLimiter
+	Schedule    *Schedule
+	// rateLimited and windowClosed are owned by the worker, to log hitting
+	// the limit and leaving the delivery windows once
+	rateLimited  bool
+	windowClosed bool
+}
+
+// Profiles holds the configured profiles, default first
+type Profiles struct {
+	list   []*Profile
+	byName map[string]*Profile
+}
+
+// Get returns the named profile, or nil if it is not configured
+func (p *Profiles) Get(name string) *Profile {
+	return p.byName[name]
+}
+
+func (p *Profiles) All() []*Profile {
+	return p.list
+}
+
+func (p *Profiles) add(name string, config *Config) error {
+	transport, err := newTransport(config)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	schedule, err := parseSchedule(config.DeliveryWindows, config.DeliveryTimezone)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	profile := &Profile{
+		Name:        name,
+		Config:      config,
+		Transport:   transport,
+		RateLimiter: NewRateLimiter(config.MaxBooksPerHour, config.MaxBooksPerDay),
+		Schedule:    schedule,
+	}
+	p.list = append(p.list, profile)
+	p.byName[name] = profile
+
+	// Export zeroes so dashboards show every profile before its first send
+	filesSentTotal.WithLabelValues(name).Add(0)
+	filesSendErrors.WithLabelValues(name).Add(0)
+	sendRetriesTotal.WithLabelValues(name).Add(0)
+	filesRateLimited.WithLabelValues(name).Set(0)
+	deliveryWindowOpen.WithLabelValues(name).Set(1)
+	return nil
+}
+
+// loadProfiles builds the default profile and those listed in PROFILES. With
+// PROFILES set the default profile is optional and left out when the
+// top-level SMTP settings are incomplete.
+func loadProfiles(config *Config) (*Profiles, error) {
+	profiles := &Profiles{byName: make(map[string]*Profile)}
+
+	base := *config
+	if err := validateSendConfig(&base); err == nil {
+		if err := profiles.add(defaultProfile, &base); err != nil {
+			return nil, err
+		}
+	} else if len(config.Profiles) == 0 {
+		return nil, err
+	} else {
+		log.Printf("Default profile disabled: %v", err)
+	}
+
+	for _, name := range config.Profiles {
+		name = strings.ToLower(name)
+		if !profileNamePattern.MatchString(name) || name == defaultProfile {
+			return nil, fmt.Errorf("invalid profile name %q (use letters, digits and underscores)", name)
+		}
+		if profiles.Get(name) != nil {
+			return nil, fmt.Errorf("profile %s is listed twice", name)
+		}
+
+		profileConfig := loadProfileConfig(config, name)
+		if err := validateSendConfig(profileConfig); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		if profileConfig.KindleEmail == "" {
+			return nil, fmt.Errorf("profile %s: PROFILE_%s_KINDLE_EMAIL is not set", name, strings.ToUpper(name))
+		}
+		if err := profiles.add(name, profileConfig); err != nil {
+			return nil, err
+		}
+	}
+	if len(profiles.list) == 0 {
+		return nil, errors.New("no profile can send")
+	}
+
+	// The scanner and watcher pick up every format some profile accepts
+	var extensions []string
+	seen := make(map[string]bool)
+	for _, profile := range profiles.list {
+		for _, ext := range profile.Config.FileExtensions {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext != "" && !seen[ext] {
+				seen[ext] = true
+				extensions = append(extensions, ext)
+			}
+		}
+	}
+	config.FileExtensions = extensions
+	return profiles, nil
+}
+
+// loadProfileConfig overlays the PROFILE_<NAME>_* settings on the top-level
+// configuration. The Kindle address is never inherited.
+func loadProfileConfig(base *Config, name string) *Config {
+	prefix := "PROFILE_" + strings.ToUpper(name) + "_"
+	config := *base
+
+	config.SMTPHost = getEnv(prefix+"SMTP_HOST", base.SMTPHost)
+	config.SMTPPort = getEnv(prefix+"SMTP_PORT", base.SMTPPort)
+	config.SMTPUser = getEnv(prefix+"SMTP_USER", base.SMTPUser)
+	config.SMTPPassword = getEnv(prefix+"SMTP_PASSWORD", base.SMTPPassword)
+	config.SenderEmail = getEnv(prefix+"SENDER_EMAIL", getEnv(prefix+"SMTP_USER", base.SenderEmail))
+	config.KindleEmail = getEnv(prefix+"KINDLE_EMAIL", "")
+	config.FileExtensions = strings.Split(getEnv(prefix+"FILE_EXTENSIONS", strings.Join(base.FileExtensions, ",")), ",")
+	config.MaxFileSizeMB = getEnvInt(prefix+"MAX_FILE_SIZE_MB", base.MaxFileSizeMB)
+	config.MaxBooksPerHour = getEnvInt(prefix+"MAX_BOOKS_PER_HOUR", base.MaxBooksPerHour)
+	config.MaxBooksPerDay = getEnvInt(prefix+"MAX_BOOKS_PER_DAY", base.MaxBooksPerDay)
+	config.DeliveryWindows = getEnv(prefix+"DELIVERY_WINDOWS", base.DeliveryWindows)
+	config.DeliveryTimezone = getEnv(prefix+"DELIVERY_TIMEZONE", base.DeliveryTimezone)
+	config.BatchMaxAttachments = getEnvInt(prefix+"BATCH_MAX_ATTACHMENTS", base.BatchMaxAttachments)
+	config.BatchMaxSizeMB = getEnvInt(prefix+"BATCH_MAX_SIZE_MB", base.BatchMaxSizeMB)
+
+	config.Transport = strings.ToLower(getEnv(prefix+"TRANSPORT", base.Transport))
+	config.TransportPath = getEnv(prefix+"TRANSPORT_PATH", base.TransportPath)
+	config.WebhookURL = getEnv(prefix+"TRANSPORT_WEBHOOK_URL", base.WebhookURL)
+	config.WebhookToken = getEnv(prefix+"TRANSPORT_WEBHOOK_TOKEN", base.WebhookToken)
+	config.WebhookTimeout = getEnvInt(prefix+"TRANSPORT_WEBHOOK_TIMEOUT", base.WebhookTimeout)
+
+	// The sender mailbox defaults to the profile's own SMTP account
+	config.IMAPHost = getEnv(prefix+"IMAP_HOST", base.IMAPHost)
+	config.IMAPPort = getEnv(prefix+"IMAP_PORT", base.IMAPPort)
+	config.IMAPTLSMode = strings.ToLower(getEnv(prefix+"IMAP_TLS_MODE", getEnv("IMAP_TLS_MODE", defaultIMAPTLSMode(config.IMAPPort))))
+	config.IMAPUser = getEnv(prefix+"IMAP_USER", getEnv(prefix+"SMTP_USER", base.IMAPUser))
+	config.IMAPPassword = getEnv(prefix+"IMAP_PASSWORD", getEnv(prefix+"SMTP_PASSWORD", base.IMAPPassword))
+	config.IMAPMailbox = getEnv(prefix+"IMAP_MAILBOX", base.IMAPMailbox)
+
+	// A profile on another port gets that port's default TLS mode
+	config.SMTPTLSMode = strings.ToLower(getEnv(prefix+"SMTP_TLS_MODE", getEnv("SMTP_TLS_MODE", defaultSMTPTLSMode(config.SMTPPort))))
+	config.SMTPCAFile = getEnv(prefix+"SMTP_CA_FILE", base.SMTPCAFile)
+	config.SMTPAuth = strings.ToLower(getEnv(prefix+"SMTP_AUTH", base.SMTPAuth))
+	config.OAuth2ClientID = getEnv(prefix+"OAUTH2_CLIENT_ID", base.OAuth2ClientID)
+	config.OAuth2ClientSecret = getEnv(prefix+"OAUTH2_CLIENT_SECRET", base.OAuth2ClientSecret)
+	config.OAuth2RefreshToken = getEnv(prefix+"OAUTH2_REFRESH_TOKEN", base.OAuth2RefreshToken)
+	config.OAuth2TokenURL = getEnv(prefix+"OAUTH2_TOKEN_URL", base.OAuth2TokenURL)
+	return &config
+}
+
+// validateSendConfig checks that the SMTP settings are complete when sending
+// by SMTP
+func validateSendConfig(config *Config) error {
+	if config.Transport != "smtp" {
+		return nil
+	}
+	// XOAUTH2 authenticates with a token instead of SMTP_PASSWORD
+	needsPassword := config.SMTPAuth == smtpAuthPlain
+	if config.SMTPHost == "" || config.SMTPUser == "" || (needsPassword && config.SMTPPassword == "") {
+		return errors.New("SMTP configuration is incomplete. Please set SMTP_HOST, SMTP_USER, and SMTP_PASSWORD")
+	}
+	return nil
+}
+
+func (p *Profile) maxFileSize() int64 {
+	return int64(p.Config.MaxFileSizeMB) * 1024 * 1024
+}
+
+// batchMaxSize is the most the attachments of one message may add up to
+func (p *Profile) batchMaxSize() int64 {
+	return int64(p.Config.BatchMaxSizeMB) * 1024 * 1024
+}
+
+// acceptsFile reports whether the profile takes this book: its format is in
+// the profile's extensions and it fits the size limit, or can be shrunk to
+func (p *Profile) acceptsFile(fileName string, fileSize int64) (bool, string) {
+	if !isSupportedFile(fileName, p.Config.FileExtensions) {
+		return false, ""
+	}
+	if fileSize <= p.maxFileSize() || (p.Config.ShrinkOversized && canShrink(fileName, p.Config)) {
+		return true, ""
+	}
+	reason := fmt.Sprintf("over the %d MB limit", p.Config.MaxFileSizeMB)
+	if p.Name != defaultProfile {
+		reason += " of profile " + p.Name
+	}
+	if p.Config.ShrinkOversized {
+		reason += fmt.Sprintf("; shrinking %s files is not supported", strings.ToLower(filepath.Ext(fileName)))
+	}
+	return false, reason
+}
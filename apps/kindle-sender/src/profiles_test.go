@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadProfilesOverlay(t *testing.T) {
+	config := newTestConfig(t)
+	config.Transport = "smtp"
+	config.SMTPHost = "smtp.example.com"
+	config.SMTPPort = "587"
+	config.SMTPTLSMode = "starttls"
+	config.SMTPUser = "family@example.com"
+	config.SMTPPassword = "secret"
+	config.SMTPAuth = smtpAuthPlain
+	config.OAuth2TokenURL = "https://oauth2.googleapis.com/token"
+	config.Profiles = []string{"alice", "bob"}
+
+	t.Setenv("PROFILE_ALICE_KINDLE_EMAIL", "alice@kindle.com")
+	t.Setenv("PROFILE_ALICE_SMTP_USER", "alice@outlook.com")
+	t.Setenv("PROFILE_ALICE_SMTP_AUTH", "xoauth2")
+	t.Setenv("PROFILE_ALICE_OAUTH2_CLIENT_ID", "alice-client")
+	t.Setenv("PROFILE_ALICE_OAUTH2_REFRESH_TOKEN", "alice-refresh")
+	t.Setenv("PROFILE_ALICE_OAUTH2_TOKEN_URL", "https://login.microsoftonline.com/common/oauth2/v2.0/token")
+	t.Setenv("PROFILE_ALICE_MAX_BOOKS_PER_HOUR", "1")
+	t.Setenv("PROFILE_BOB_KINDLE_EMAIL", "bob@kindle.com")
+	t.Setenv("PROFILE_BOB_TRANSPORT", "webhook")
+	t.Setenv("PROFILE_BOB_TRANSPORT_WEBHOOK_URL", "http://relay.example.com/send")
+	t.Setenv("PROFILE_BOB_TRANSPORT_WEBHOOK_TOKEN", "bob-token")
+	t.Setenv("PROFILE_BOB_FILE_EXTENSIONS", ".epub,.mobi")
+
+	profiles, err := loadProfiles(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, profile := range profiles.All() {
+		names = append(names, profile.Name)
+	}
+	if strings.Join(names, ",") != "default,alice,bob" {
+		t.Fatalf("profiles = %v, want default, alice and bob", names)
+	}
+
+	def, alice, bob := profiles.Get(defaultProfile), profiles.Get("alice"), profiles.Get("bob")
+	tests := []struct {
+		name, got, want string
+	}{
+		{"alice SMTP host", alice.Config.SMTPHost, "smtp.example.com"},
+		{"alice SMTP user", alice.Config.SMTPUser, "alice@outlook.com"},
+		{"alice sender", alice.Config.SenderEmail, "alice@outlook.com"},
+		{"alice auth", alice.Config.SMTPAuth, smtpAuthXOAUTH2},
+		{"alice token URL", alice.Config.OAuth2TokenURL, "https://login.microsoftonline.com/common/oauth2/v2.0/token"},
+		{"bob token URL", bob.Config.OAuth2TokenURL, "https://oauth2.googleapis.com/token"},
+		{"bob transport", bob.Transport.Name(), "webhook"},
+		{"bob webhook URL", bob.Config.WebhookURL, "http://relay.example.com/send"},
+		{"bob webhook token", bob.Config.WebhookToken, "bob-token"},
+		{"default webhook URL", def.Config.WebhookURL, ""},
+		{"default Kindle address", def.Config.KindleEmail, "reader@kindle.com"},
+		{"scanned extensions", strings.Join(config.FileExtensions, ","), ".epub,.pdf,.mobi"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// Each profile has its own rate limiter
+	if alice.RateLimiter == def.RateLimiter || alice.RateLimiter == bob.RateLimiter {
+		t.Fatal("profiles share a rate limiter")
+	}
+	alice.RateLimiter.RecordSend()
+	if alice.RateLimiter.CanSend() {
+		t.Error("alice can send past her limit of one book per hour")
+	}
+	if !def.RateLimiter.CanSend() || !bob.RateLimiter.CanSend() {
+		t.Error("alice reaching her limit held up the other profiles")
+	}
+}
+
+func TestLoadProfilesErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles []string
+		env      map[string]string
+		want     string
+	}{
+		{name: "invalid name", profiles: []string{"Alice!"}, want: "invalid profile name"},
+		{name: "listed twice", profiles: []string{"alice", "Alice"}, env: map[string]string{"PROFILE_ALICE_KINDLE_EMAIL": "alice@kindle.com"}, want: "listed twice"},
+		{name: "no Kindle address", profiles: []string{"alice"}, want: "PROFILE_ALICE_KINDLE_EMAIL is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig(t)
+			config.Transport = "directory"
+			config.TransportPath = t.TempDir()
+			config.Profiles = tt.profiles
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if _, err := loadProfiles(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadProfiles() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
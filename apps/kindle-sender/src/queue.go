@@ -0,0 +1,678 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Send queue item states
+const (
+	queueStatusPending = "pending"
+	queueStatusDead    = "dead"
+	// Held items wait for approval before they are sent
+	queueStatusHeld = "held"
+)
+
+// QueueItem is a file waiting in the durable send queue
+type QueueItem struct {
+	ID            int64
+	FilePath      string
+	Recipient     string
+	Profile       string
+	FileSize      int64
+	FileHash      string
+	Metadata      BookMetadata
+	Force         bool
+	Status        string
+	Attempts      int
+	LastError     string
+	SMTPCode      int
+	NextAttemptAt time.Time
+	// VolumesSent counts the volumes of a split book already delivered, so a
+	// retry only sends the rest
+	VolumesSent int
+}
+
+const createSendQueueSQL = `
+	CREATE TABLE IF NOT EXISTS send_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_path TEXT NOT NULL,
+		file_size INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		smtp_code INTEGER,
+		next_attempt_at INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_send_queue_due ON send_queue(status, next_attempt_at);
+	`
+
+// enqueueFile adds a file to the send queue for one target, pending or held
+// for approval. Files already queued for its recipient (including
+// dead-lettered ones) are left untouched.
+func enqueueFile(db *sql.DB, filePath string, target Target, fileSize int64, fileHash string, meta BookMetadata, status string) (bool, error) {
+	result, err := db.Exec(
+		`INSERT OR IGNORE INTO send_queue (file_path, recipient, profile, file_size, file_hash, title, author, language, isbn, status, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		filePath, target.Recipient, target.Profile.Name, fileSize, fileHash, meta.Title, meta.Author, meta.Language, meta.ISBN, status, time.Now().Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	return added > 0, err
+}
+
+// requeueFile queues a file for an immediate forced send, resetting any
+// existing queue entry including dead-lettered ones. Forced items skip the
+// already-sent checks.
+func requeueFile(db *sql.DB, filePath string, target Target, fileSize int64, fileHash string, meta BookMetadata) error {
+	_, err := db.Exec(
+		`INSERT INTO send_queue (file_path, recipient, profile, file_size, file_hash, title, author, language, isbn, status, next_attempt_at, force)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT(file_path, recipient) DO UPDATE SET
+			profile = excluded.profile, file_size = excluded.file_size, file_hash = excluded.file_hash,
+			title = excluded.title, author = excluded.author, language = excluded.language, isbn = excluded.isbn,
+			status = excluded.status, attempts = 0, last_error = NULL, smtp_code = NULL, volumes_sent = 0,
+			next_attempt_at = excluded.next_attempt_at, force = 1, updated_at = CURRENT_TIMESTAMP`,
+		filePath, target.Recipient, target.Profile.Name, fileSize, fileHash, meta.Title, meta.Author, meta.Language, meta.ISBN, queueStatusPending, time.Now().Unix(),
+	)
+	return err
+}
+
+// queuedRecipients returns the recipients a file already has a send queue
+// entry for, in any state
+func queuedRecipients(db *sql.DB, filePath string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT recipient FROM send_queue WHERE file_path = ?", filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	queued := make(map[string]bool)
+	for rows.Next() {
+		var recipient string
+		if err := rows.Scan(&recipient); err != nil {
+			return nil, err
+		}
+		queued[recipient] = true
+	}
+	return queued, rows.Err()
+}
+
+// queueStatus returns the state of a file's queue entry for one recipient,
+// or "" if it isn't queued for them
+func queueStatus(db *sql.DB, filePath, recipient string) (string, error) {
+	var status string
+	err := db.QueryRow("SELECT status FROM send_queue WHERE file_path = ? AND recipient = ?", filePath, recipient).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// queueItemColumns are the send_queue columns read by scanQueueItem
+const queueItemColumns = `id, file_path, recipient, profile, file_size, file_hash, title, author, language, isbn, force,
+	status, attempts, last_error, smtp_code, next_attempt_at, volumes_sent`
+
+// scanQueueItem reads a row selected with queueItemColumns
+func scanQueueItem(row interface{ Scan(...interface{}) error }) (*QueueItem, error) {
+	var item QueueItem
+	var fileHash, title, author, language, isbn, lastError sql.NullString
+	var smtpCode sql.NullInt64
+	var nextAttempt int64
+	err := row.Scan(
+		&item.ID, &item.FilePath, &item.Recipient, &item.Profile, &item.FileSize, &fileHash, &title, &author, &language, &isbn, &item.Force,
+		&item.Status, &item.Attempts, &lastError, &smtpCode, &nextAttempt, &item.VolumesSent)
+	if err != nil {
+		return nil, err
+	}
+	item.FileHash = fileHash.String
+	item.Metadata = BookMetadata{Title: title.String, Author: author.String, Language: language.String, ISBN: isbn.String}
+	item.LastError = lastError.String
+	item.SMTPCode = int(smtpCode.Int64)
+	item.NextAttemptAt = time.Unix(nextAttempt, 0)
+	return &item, nil
+}
+
+// nextDueQueueItem returns the pending item with the earliest due time, or nil
+// if nothing is due yet. Items of the excluded profiles are passed over.
+func nextDueQueueItem(db *sql.DB, now time.Time, excluded []string) (*QueueItem, error) {
+	query := "SELECT " + queueItemColumns + " FROM send_queue WHERE status = ? AND next_attempt_at <= ?"
+	args := []interface{}{queueStatusPending, now.Unix()}
+	if len(excluded) > 0 {
+		query += " AND profile NOT IN (?" + strings.Repeat(", ?", len(excluded)-1) + ")"
+		for _, profile := range excluded {
+			args = append(args, profile)
+		}
+	}
+	item, err := scanQueueItem(db.QueryRow(query+" ORDER BY next_attempt_at, id LIMIT 1", args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return item, err
+}
+
+// batchCompanions returns further due items for the same profile and
+// recipient to send in one message with first, within the profile's batch
+// limits. Retries and books that will need shrinking go out on their own.
+func batchCompanions(db *sql.DB, first *QueueItem, profile *Profile, now time.Time) ([]*QueueItem, error) {
+	limit := profile.Config.BatchMaxAttachments - 1
+	if limit <= 0 || first.Attempts > 0 || first.FileSize > profile.maxFileSize() {
+		return nil, nil
+	}
+	rows, err := db.Query(
+		"SELECT "+queueItemColumns+` FROM send_queue
+		WHERE status = ? AND next_attempt_at <= ? AND profile = ? AND recipient = ? AND attempts = 0 AND id != ? AND file_size <= ?
+		ORDER BY next_attempt_at, id`,
+		queueStatusPending, now.Unix(), first.Profile, first.Recipient, first.ID, profile.maxFileSize(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*QueueItem
+	size := first.FileSize
+	for rows.Next() && len(items) < limit {
+		item, err := scanQueueItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		if size+item.FileSize > profile.batchMaxSize() {
+			continue
+		}
+		items = append(items, item)
+		size += item.FileSize
+	}
+	return items, rows.Err()
+}
+
+func deleteQueueItem(db *sql.DB, id int64) error {
+	_, err := db.Exec("DELETE FROM send_queue WHERE id = ?", id)
+	return err
+}
+
+// recordSendFailure bumps the attempt counter and schedules the next retry, or
+// moves the item to the dead-letter state once it has used up its attempts.
+// It returns the status the item ended up in.
+func recordSendFailure(db *sql.DB, item *QueueItem, sendErr error, config *Config) (string, error) {
+	attempts := item.Attempts + 1
+	status := queueStatusPending
+	if attempts >= config.SendMaxAttempts {
+		status = queueStatusDead
+	}
+	next := time.Now().Add(retryBackoff(attempts, config))
+
+	var smtpCode sql.NullInt64
+	var tpErr *textproto.Error
+	if errors.As(sendErr, &tpErr) {
+		smtpCode = sql.NullInt64{Int64: int64(tpErr.Code), Valid: true}
+	}
+
+	_, err := db.Exec(
+		`UPDATE send_queue SET attempts = ?, status = ?, last_error = ?, smtp_code = ?,
+		next_attempt_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		attempts, status, sendErr.Error(), smtpCode, next.Unix(), item.ID,
+	)
+	return status, err
+}
+
+// recordVolumesSent stores how many volumes of a split book have been
+// delivered
+func recordVolumesSent(db *sql.DB, item *QueueItem, sent int) error {
+	_, err := db.Exec("UPDATE send_queue SET volumes_sent = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", sent, item.ID)
+	if err == nil {
+		item.VolumesSent = sent
+	}
+	return err
+}
+
+// markQueueItemDead moves an item straight to the dead-letter state, for
+// failures that retrying can't fix
+func markQueueItemDead(db *sql.DB, item *QueueItem, reason error) error {
+	_, err := db.Exec(
+		`UPDATE send_queue SET attempts = attempts + 1, status = ?, last_error = ?,
+		updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		queueStatusDead, reason.Error(), item.ID,
+	)
+	return err
+}
+
+// retryBackoff doubles the delay for each failed attempt, capped at the
+// configured maximum
+func retryBackoff(attempts int, config *Config) time.Duration {
+	base := time.Duration(config.SendRetryBaseSeconds) * time.Second
+	max := time.Duration(config.SendRetryMaxSeconds) * time.Second
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	return delay
+}
+
+func updateQueueMetrics(db *sql.DB) {
+	var pending, dead, held int
+	if err := db.QueryRow("SELECT COUNT(*) FROM send_queue WHERE status = ?", queueStatusPending).Scan(&pending); err != nil {
+		log.Printf("Error counting queued files: %v", err)
+		return
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM send_queue WHERE status = ?", queueStatusDead).Scan(&dead); err != nil {
+		log.Printf("Error counting dead-lettered files: %v", err)
+		return
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM send_queue WHERE status = ?", queueStatusHeld).Scan(&held); err != nil {
+		log.Printf("Error counting held files: %v", err)
+		return
+	}
+	queueDepth.Set(float64(pending))
+	queueDeadLetter.Set(float64(dead))
+	queueHeld.Set(float64(held))
+}
+
+// preparedItem is a queue item ready to be sent: the book, converted or
+// shrunk where needed, as one or more attachments
+type preparedItem struct {
+	item        *QueueItem
+	fileInfo    os.FileInfo
+	attachments []string
+	size        int64
+	dir         string
+}
+
+// cleanup removes the item's scratch copies
+func (p *preparedItem) cleanup() {
+	if p.dir != "" {
+		os.RemoveAll(p.dir)
+	}
+}
+
+// deliverQueueItems makes one delivery attempt for queued files of one
+// profile and recipient, using the profile's settings, transport and rate
+// limiter. Several books go out together in one message; a book split into
+// volumes, or larger than a batch may be, is sent on its own, and books that
+// no longer fit the batch stay queued. Send failures are recorded on each
+// queue item; only database errors are returned.
+func deliverQueueItems(items []*QueueItem, profile *Profile, db *sql.DB, converter Converter) error {
+	var batch []*preparedItem
+	var batchSize int64
+	defer func() {
+		for _, p := range batch {
+			p.cleanup()
+		}
+	}()
+
+	for _, item := range items {
+		p, err := prepareQueueItem(item, profile, db, converter)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			continue
+		}
+		alone := len(p.attachments) > 1 || p.size > profile.batchMaxSize()
+		if alone && len(batch) == 0 {
+			defer p.cleanup()
+			return sendPrepared([]*preparedItem{p}, profile, db)
+		}
+		if alone || batchSize+p.size > profile.batchMaxSize() {
+			p.cleanup()
+			continue
+		}
+		batch = append(batch, p)
+		batchSize += p.size
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return sendPrepared(batch, profile, db)
+}
+
+// prepareQueueItem checks that a queued file still needs sending and converts
+// or shrinks it as needed. It returns nil when the item was settled without
+// sending: dropped, recorded as moved, dead-lettered or parked as oversized.
+func prepareQueueItem(item *QueueItem, profile *Profile, db *sql.DB, converter Converter) (*preparedItem, error) {
+	config := profile.Config
+	target := Target{Profile: profile, Recipient: item.Recipient}
+	fileName := filepath.Base(item.FilePath)
+
+	fileInfo, err := os.Stat(item.FilePath)
+	if err != nil {
+		log.Printf("Dropping %s from send queue: %v", fileName, err)
+		return nil, deleteQueueItem(db, item.ID)
+	}
+
+	// Items queued before hashing existed have no hash yet
+	if item.FileHash == "" {
+		if item.FileHash, err = hashFile(item.FilePath); err != nil {
+			log.Printf("Dropping %s from send queue: failed to hash file: %v", fileName, err)
+			return nil, deleteQueueItem(db, item.ID)
+		}
+	}
+
+	// Resends requested through the admin API go out regardless of history
+	if !item.Force {
+		delivered, err := isDelivered(db, item.FilePath, item.Recipient, config.ResendOnUpgrade)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if file sent: %w", err)
+		}
+		if delivered {
+			return nil, deleteQueueItem(db, item.ID)
+		}
+
+		// Duplicates queued side by side are checked against what has been
+		// sent to this recipient since they were queued
+		originalPath, err := findDeliveryByHash(db, item.FileHash, item.Recipient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up file hash: %w", err)
+		}
+		if originalPath != "" {
+			if err := recordFileMove(db, item.FilePath, fileInfo.Size(), item.FileHash, originalPath); err != nil {
+				return nil, fmt.Errorf("failed to record moved file: %w", err)
+			}
+			if err := recordDelivery(db, item.FilePath, target, fileStatusMoved); err != nil {
+				return nil, fmt.Errorf("failed to record moved file: %w", err)
+			}
+			log.Printf("Skipping %s for %s: same content already sent as %s", fileName, target, originalPath)
+			return nil, deleteQueueItem(db, item.ID)
+		}
+	}
+
+	p := &preparedItem{item: item, fileInfo: fileInfo}
+	maxSize := profile.maxFileSize()
+	convert := converter != nil && needsConversion(item.FilePath, config)
+
+	// Conversion and shrinking work on copies in a scratch directory
+	if convert || fileInfo.Size() > maxSize {
+		if p.dir, err = os.MkdirTemp(config.ScratchDir, "deliver-"); err != nil {
+			return nil, fmt.Errorf("failed to create scratch directory: %w", err)
+		}
+	}
+
+	// Formats the destination no longer accepts are converted to EPUB first
+	attachment, attachmentSize := item.FilePath, fileInfo.Size()
+	if convert {
+		log.Printf("Converting %s to EPUB with %s...", fileName, converter.Name())
+		converted, convErr := convertForDelivery(item, converter, p.dir, db)
+		if convErr == nil {
+			info, err := os.Stat(converted)
+			if err != nil {
+				convErr = fmt.Errorf("converted file missing: %w", err)
+			} else {
+				attachment, attachmentSize = converted, info.Size()
+			}
+		}
+		if convErr != nil {
+			p.cleanup()
+			// A conversion that failed once will fail again, so don't retry
+			if err := markQueueItemDead(db, item, convErr); err != nil {
+				return nil, fmt.Errorf("failed to record conversion failure: %w", err)
+			}
+			log.Printf("Failed to convert %s, moved to dead letter: %v", fileName, convErr)
+			return nil, nil
+		}
+	}
+
+	p.attachments, p.size = []string{attachment}, attachmentSize
+	if attachmentSize > maxSize {
+		var shrinkErr error
+		if p.attachments, shrinkErr = shrinkForDelivery(attachment, attachmentSize, maxSize, p.dir, config); shrinkErr != nil {
+			p.cleanup()
+			// Park the book with the reason instead of retrying; clearing the
+			// oversized entry lets the next scan pick it up again
+			reason := fmt.Sprintf("%.2f MB, over the %d MB limit: %v", megabytes(attachmentSize), config.MaxFileSizeMB, shrinkErr)
+			trackOversized(db, item.FilePath, fileName, fileInfo.Size(), maxSize, reason)
+			log.Printf("Cannot send %s: %s", fileName, reason)
+			return nil, deleteQueueItem(db, item.ID)
+		}
+		p.size = 0
+		for _, volume := range p.attachments {
+			if info, err := os.Stat(volume); err == nil {
+				p.size += info.Size()
+			}
+		}
+	}
+	return p, nil
+}
+
+// sendPrepared sends prepared books to their recipient. A single book goes
+// out as one message per volume; several books share one message with an
+// attachment each. Every message counts against the rate limit.
+func sendPrepared(batch []*preparedItem, profile *Profile, db *sql.DB) error {
+	config := profile.Config
+	first := batch[0].item
+	target := Target{Profile: profile, Recipient: first.Recipient}
+
+	var messages []*EmailMessage
+	var batchID, name string
+	// Volumes of a split book delivered by earlier attempts are skipped
+	skipped := 0
+	if len(batch) == 1 {
+		// A book split into volumes is sent as one message per volume. Each
+		// delivered volume is recorded, so a retry after a failed volume
+		// only sends the ones that haven't gone out.
+		fileName := filepath.Base(first.FilePath)
+		name = first.Metadata.DisplayName(fileName)
+		volumes := batch[0].attachments
+		skipped = min(first.VolumesSent, len(volumes))
+		if skipped > 0 {
+			log.Printf("Resuming %s at part %d of %d", name, skipped+1, len(volumes))
+		}
+		for i, attachment := range volumes[skipped:] {
+			i += skipped
+			subject := fmt.Sprintf("Book: %s", name)
+			if len(volumes) > 1 {
+				subject = fmt.Sprintf("Book: %s (part %d of %d)", name, i+1, len(volumes))
+			}
+			messages = append(messages, &EmailMessage{
+				From:        config.SenderEmail,
+				To:          first.Recipient,
+				Subject:     subject,
+				Body:        messageBody(fileName, batch[0].fileInfo.Size(), first.Metadata),
+				Attachments: []EmailAttachment{{Path: attachment, ContentType: getContentType(attachment)}},
+			})
+		}
+	} else {
+		batchID = newBatchID()
+		name = fmt.Sprintf("%d books", len(batch))
+		msg := &EmailMessage{
+			From:    config.SenderEmail,
+			To:      first.Recipient,
+			Subject: batchSubject(batch),
+			Body:    batchMessageBody(batch),
+		}
+		for _, p := range batch {
+			msg.Attachments = append(msg.Attachments, EmailAttachment{Path: p.attachments[0], ContentType: getContentType(p.attachments[0])})
+		}
+		messages = append(messages, msg)
+	}
+
+	for i, msg := range messages {
+		// Later volumes wait for the next slot instead of going over the
+		// rate limit
+		if i > 0 && !profile.RateLimiter.CanSend() {
+			log.Printf("Rate limit reached after %d of %d parts of %s, the rest follows later", skipped+i, skipped+len(messages), name)
+			return nil
+		}
+		if first.Attempts > 0 {
+			log.Printf("Sending %s to %s via %s (attempt %d/%d)...", msg.Subject, target, profile.Transport.Name(), first.Attempts+1, config.SendMaxAttempts)
+		} else {
+			log.Printf("Sending %s to %s via %s...", msg.Subject, target, profile.Transport.Name())
+		}
+
+		if sendErr := profile.Transport.Deliver(msg); sendErr != nil {
+			filesSendErrors.WithLabelValues(profile.Name).Inc()
+			failed := batch
+
+			// Books of a batch the transport handed over before failing
+			// count as sent; only the rest are retried
+			var partial *partialDeliveryError
+			if len(batch) > 1 && errors.As(sendErr, &partial) && partial.Delivered > 0 {
+				recordMessageSent(db, target)
+				delivered := batch[:partial.Delivered]
+				if err := markBatchSent(delivered, target, db, batchID, fmt.Sprintf("%d of %d books", len(delivered), len(batch))); err != nil {
+					return err
+				}
+				failed = batch[partial.Delivered:]
+			}
+
+			for _, p := range failed {
+				item := p.item
+				bookName := item.Metadata.DisplayName(filepath.Base(item.FilePath))
+				status, err := recordSendFailure(db, item, sendErr, config)
+				if err != nil {
+					return fmt.Errorf("failed to record send failure: %w", err)
+				}
+				if status == queueStatusDead {
+					log.Printf("Giving up on %s after %d attempts, moved to dead letter: %v", bookName, item.Attempts+1, sendErr)
+				} else {
+					sendRetriesTotal.WithLabelValues(profile.Name).Inc()
+					log.Printf("Failed to send %s (attempt %d/%d), will retry in %s: %v",
+						bookName, item.Attempts+1, config.SendMaxAttempts, retryBackoff(item.Attempts+1, config), sendErr)
+				}
+			}
+			return nil
+		}
+		recordMessageSent(db, target)
+		if len(batch) == 1 && skipped+len(messages) > 1 {
+			if err := recordVolumesSent(db, first, skipped+i+1); err != nil {
+				return fmt.Errorf("failed to record sent volume: %w", err)
+			}
+		}
+	}
+
+	if len(batch) > 1 {
+		batchesSent.WithLabelValues(profile.Name).Inc()
+	}
+	return markBatchSent(batch, target, db, batchID, name)
+}
+
+// markBatchSent records the delivery of sent books and takes them out of the
+// send queue
+func markBatchSent(batch []*preparedItem, target Target, db *sql.DB, batchID, name string) error {
+	profile := target.Profile
+	for _, p := range batch {
+		item := p.item
+		if err := markFileSent(db, item.FilePath, target, p.fileInfo, item.FileHash, item.Metadata, batchID); err != nil {
+			return fmt.Errorf("failed to mark file as sent: %w", err)
+		}
+		if err := deleteQueueItem(db, item.ID); err != nil {
+			return fmt.Errorf("failed to remove file from send queue: %w", err)
+		}
+		filesSentTotal.WithLabelValues(profile.Name).Inc()
+		recordBookSent(item.Metadata)
+		booksSentByRecipient.WithLabelValues(profile.Name, strings.ToLower(item.Recipient)).Inc()
+	}
+
+	updateRateLimitMetrics(profile)
+	log.Printf("Successfully sent %s to %s (%d/%d this hour)", name, target, profile.RateLimiter.SentThisHour(), profile.Config.MaxBooksPerHour)
+	return nil
+}
+
+// shrinkForDelivery brings an oversized book under maxSize, if shrinking is
+// enabled, returning the file or volumes to send
+func shrinkForDelivery(path string, size, maxSize int64, dir string, config *Config) ([]string, error) {
+	if !config.ShrinkOversized {
+		return nil, fmt.Errorf("shrinking is disabled")
+	}
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+
+	log.Printf("Shrinking %s (%.2f MB)...", filepath.Base(path), megabytes(size))
+	volumes, err := shrinkBook(path, maxSize, dir, config)
+	if err != nil {
+		shrinkTotal.WithLabelValues(format, "failed").Inc()
+		return nil, err
+	}
+	if len(volumes) > 1 {
+		shrinkTotal.WithLabelValues(format, "split").Inc()
+		log.Printf("Split %s into %d volumes", filepath.Base(path), len(volumes))
+	} else {
+		shrinkTotal.WithLabelValues(format, "shrunk").Inc()
+		if info, err := os.Stat(volumes[0]); err == nil {
+			log.Printf("Shrunk %s to %.2f MB", filepath.Base(path), megabytes(info.Size()))
+		}
+	}
+	return volumes, nil
+}
+
+func updateRateLimitMetrics(profile *Profile) {
+	filesSentThisHour.WithLabelValues(profile.Name).Set(float64(profile.RateLimiter.SentThisHour()))
+	filesSentToday.WithLabelValues(profile.Name).Set(float64(profile.RateLimiter.SentToday()))
+}
+
+// messageBody describes the attached book in the plain-text part
+func messageBody(fileName string, fileSize int64, meta BookMetadata) string {
+	var body strings.Builder
+	body.WriteString("Automatically sent by Kindle Sender\n\n")
+	writeBookDetails(&body, fileName, fileSize, meta)
+	return body.String()
+}
+
+// batchMessageBody lists every book of a batch
+func batchMessageBody(batch []*preparedItem) string {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Automatically sent by Kindle Sender\n\n%d books:", len(batch))
+	for _, p := range batch {
+		body.WriteString("\n\n")
+		writeBookDetails(&body, filepath.Base(p.item.FilePath), p.fileInfo.Size(), p.item.Metadata)
+	}
+	return body.String()
+}
+
+// batchSubject names the first books of a batch
+func batchSubject(batch []*preparedItem) string {
+	const shown = 3
+	var names []string
+	for _, p := range batch[:min(len(batch), shown)] {
+		names = append(names, p.item.Metadata.DisplayName(filepath.Base(p.item.FilePath)))
+	}
+	subject := "Books: " + strings.Join(names, ", ")
+	if len(batch) > shown {
+		subject += fmt.Sprintf(" and %d more", len(batch)-shown)
+	}
+	return subject
+}
+
+// newBatchID returns a random identifier for the books sent in one message
+func newBatchID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func writeBookDetails(body *strings.Builder, fileName string, fileSize int64, meta BookMetadata) {
+	if meta.Title != "" {
+		fmt.Fprintf(body, "Title: %s\n", meta.Title)
+	}
+	if meta.Author != "" {
+		fmt.Fprintf(body, "Author: %s\n", meta.Author)
+	}
+	if meta.ISBN != "" {
+		fmt.Fprintf(body, "ISBN: %s\n", meta.ISBN)
+	}
+	fmt.Fprintf(body, "File: %s\nSize: %d bytes", fileName, fileSize)
+}
+
+func recordBookSent(meta BookMetadata) {
+	lastSentBook.Reset()
+	lastSentBook.WithLabelValues(meta.Title, meta.Author).SetToCurrentTime()
+
+	language := strings.ToLower(meta.Language)
+	if language == "" {
+		language = "unknown"
+	}
+	booksSentByLanguage.WithLabelValues(language).Inc()
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendPreparedRetriesOnlyFailedVolumes(t *testing.T) {
+	config := newTestConfig(t)
+	db := newTestDB(t)
+	path := filepath.Join(config.WatchPath, "Atlas.pdf")
+	writeTestFile(t, path, "atlas")
+	var volumes []string
+	for _, part := range []string{"part1.pdf", "part2.pdf", "part3.pdf"} {
+		volume := filepath.Join(t.TempDir(), part)
+		writeTestFile(t, volume, part)
+		volumes = append(volumes, volume)
+	}
+
+	fail := true
+	transport := &recordingTransport{hook: func(msg *EmailMessage) error {
+		if fail && msg.Attachments[0].Path == volumes[1] {
+			return errors.New("connection reset")
+		}
+		return nil
+	}}
+	profile := newTestProfiles(t, config, transport).Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enqueueFile(db, path, target, info.Size(), "hash", BookMetadata{}, queueStatusPending); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(now time.Time) {
+		t.Helper()
+		item, err := nextDueQueueItem(db, now, nil)
+		if err != nil || item == nil {
+			t.Fatalf("nextDueQueueItem() = %v, %v", item, err)
+		}
+		p := &preparedItem{item: item, fileInfo: info, attachments: volumes}
+		if err := sendPrepared([]*preparedItem{p}, profile, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(time.Now())
+	if got := len(transport.Delivered()); got != 1 {
+		t.Fatalf("delivered %d volumes before the failure, want 1", got)
+	}
+	var volumesSent, attempts int
+	if err := db.QueryRow("SELECT volumes_sent, attempts FROM send_queue WHERE file_path = ?", path).Scan(&volumesSent, &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if volumesSent != 1 || attempts != 1 {
+		t.Fatalf("volumes_sent = %d, attempts = %d, want 1 and 1", volumesSent, attempts)
+	}
+
+	fail = false
+	send(time.Now().Add(time.Hour))
+	delivered := transport.Delivered()
+	if len(delivered) != 3 {
+		t.Fatalf("delivered %d messages in total, want 3", len(delivered))
+	}
+	for i, msg := range delivered {
+		if msg.Attachments[0].Path != volumes[i] {
+			t.Errorf("message %d carried %s, want %s", i, msg.Attachments[0].Path, volumes[i])
+		}
+	}
+	if sent := profile.RateLimiter.SentThisHour(); sent != 3 {
+		t.Errorf("rate limiter counted %d sends, want 3", sent)
+	}
+	if status, err := queueStatus(db, path, config.KindleEmail); err != nil || status != "" {
+		t.Errorf("queue status = %q, %v, want the item removed", status, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	config := &Config{SendRetryBaseSeconds: 60, SendRetryMaxSeconds: 3600}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempts, config); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRecordSendFailureDeadLetters(t *testing.T) {
+	config := newTestConfig(t)
+	db := newTestDB(t)
+	profile := newTestProfiles(t, config, &recordingTransport{}).Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+	path := filepath.Join(config.WatchPath, "Book.epub")
+	if _, err := enqueueFile(db, path, target, 10, "hash", BookMetadata{}, queueStatusPending); err != nil {
+		t.Fatal(err)
+	}
+
+	sendErr := &textproto.Error{Code: 451, Msg: "try again later"}
+	tests := []struct {
+		wantStatus string
+		wantDelay  time.Duration
+	}{
+		{queueStatusPending, time.Minute},
+		{queueStatusPending, 2 * time.Minute},
+		{queueStatusDead, 4 * time.Minute},
+	}
+	for i, tt := range tests {
+		item, err := scanQueueItem(db.QueryRow("SELECT "+queueItemColumns+" FROM send_queue WHERE file_path = ?", path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := time.Now()
+		status, err := recordSendFailure(db, item, sendErr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.wantStatus {
+			t.Fatalf("attempt %d: status = %q, want %q", i+1, status, tt.wantStatus)
+		}
+
+		item, err = scanQueueItem(db.QueryRow("SELECT "+queueItemColumns+" FROM send_queue WHERE file_path = ?", path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Attempts != i+1 || item.Status != tt.wantStatus || item.SMTPCode != 451 || item.LastError != sendErr.Error() {
+			t.Errorf("attempt %d: item = %+v", i+1, item)
+		}
+		if delay := item.NextAttemptAt.Sub(before.Truncate(time.Second)); delay < tt.wantDelay || delay > tt.wantDelay+2*time.Second {
+			t.Errorf("attempt %d: next attempt in %s, want %s", i+1, delay, tt.wantDelay)
+		}
+	}
+
+	// Dead-lettered items are no longer picked up
+	if item, err := nextDueQueueItem(db, time.Now().Add(24*time.Hour), nil); err != nil || item != nil {
+		t.Errorf("nextDueQueueItem() = %+v, %v, want nothing due", item, err)
+	}
+}
+
+func TestCountPendingFilesPerRecipient(t *testing.T) {
+	config := newTestConfig(t)
+	config.Routes = "**=a@kindle.com,b@kindle.com"
+	db := newTestDB(t)
+	profiles := newTestProfiles(t, config, &recordingTransport{})
+	router, err := newRouter(config, profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(config.WatchPath, "Dune.epub")
+	writeTestFile(t, path, "dune")
+	profile := profiles.Get(defaultProfile)
+
+	queue := func(recipient, status string) {
+		t.Helper()
+		target := Target{Profile: profile, Recipient: recipient}
+		if _, err := enqueueFile(db, path, target, 4, "hash", BookMetadata{}, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int {
+		t.Helper()
+		pending, err := countPendingFiles(config.WatchPath, config, db, router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pending
+	}
+
+	// One recipient held for approval, the other still waiting to be sent
+	queue("a@kindle.com", queueStatusHeld)
+	queue("b@kindle.com", queueStatusPending)
+	if got := count(); got != 1 {
+		t.Errorf("pending = %d with one recipient waiting, want 1", got)
+	}
+	if status, err := queueStatus(db, path, "a@kindle.com"); err != nil || status != queueStatusHeld {
+		t.Errorf("queueStatus(a) = %q, %v, want held", status, err)
+	}
+
+	if _, err := db.Exec("UPDATE send_queue SET status = ? WHERE recipient = ?", queueStatusDead, "b@kindle.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(); got != 0 {
+		t.Errorf("pending = %d with every recipient held or dead, want 0", got)
+	}
+}
+
+func TestRateLimiterRestoredAfterRestart(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxBooksPerHour = 5
+	db := newTestDB(t)
+	profile := newTestProfiles(t, config, &recordingTransport{}).Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+
+	// A book split into three volumes and a batch of two books: four messages
+	prepare := func(name string, attachments ...string) *preparedItem {
+		t.Helper()
+		path := filepath.Join(config.WatchPath, name)
+		writeTestFile(t, path, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := enqueueFile(db, path, target, info.Size(), name, BookMetadata{}, queueStatusPending); err != nil {
+			t.Fatal(err)
+		}
+		item, err := scanQueueItem(db.QueryRow("SELECT "+queueItemColumns+" FROM send_queue WHERE file_path = ?", path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attachments) == 0 {
+			attachments = []string{path}
+		}
+		return &preparedItem{item: item, fileInfo: info, attachments: attachments}
+	}
+	var volumes []string
+	for _, part := range []string{"part1.pdf", "part2.pdf", "part3.pdf"} {
+		volume := filepath.Join(t.TempDir(), part)
+		writeTestFile(t, volume, part)
+		volumes = append(volumes, volume)
+	}
+	if err := sendPrepared([]*preparedItem{prepare("Atlas.pdf", volumes...)}, profile, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendPrepared([]*preparedItem{prepare("Dune.epub"), prepare("Emma.epub")}, profile, db); err != nil {
+		t.Fatal(err)
+	}
+	if sent := profile.RateLimiter.SentThisHour(); sent != 4 {
+		t.Fatalf("limiter counted %d messages before the restart, want 4", sent)
+	}
+
+	// A restarted limiter sees the same four messages, leaving one slot
+	times, err := loadRecentSendTimes(db, time.Hour, defaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewRateLimiter(config.MaxBooksPerHour, 0)
+	restarted.Seed(times)
+	if sent := restarted.SentThisHour(); sent != 4 {
+		t.Errorf("limiter counts %d messages after a restart, want 4", sent)
+	}
+	if !restarted.CanSend() {
+		t.Error("CanSend() = false with one slot left")
+	}
+	restarted.RecordSend()
+	if restarted.CanSend() {
+		t.Error("CanSend() = true with the hourly limit reached")
+	}
+
+	// Other profiles' messages don't count
+	if times, err := loadRecentSendTimes(db, time.Hour, "other"); err != nil || len(times) != 0 {
+		t.Errorf("loadRecentSendTimes(other) = %v, %v, want none", times, err)
+	}
+}
+
+// queuedItem reads the queue item of path
+func queuedItem(t *testing.T, db *sql.DB, path string) *QueueItem {
+	t.Helper()
+	item, err := scanQueueItem(db.QueryRow("SELECT "+queueItemColumns+" FROM send_queue WHERE file_path = ?", path))
+	if err != nil {
+		t.Fatalf("%s: %v", filepath.Base(path), err)
+	}
+	return item
+}
+
+func TestBatchCompanions(t *testing.T) {
+	const mb = 1024 * 1024
+	config := newTestConfig(t)
+	config.BatchMaxAttachments = 3
+	config.BatchMaxSizeMB = 10
+	db := newTestDB(t)
+	profile := newTestProfiles(t, config, &recordingTransport{}).Get(defaultProfile)
+	path := func(name string) string { return filepath.Join(config.WatchPath, name) }
+	queue := func(name, recipient string, size int64) {
+		t.Helper()
+		target := Target{Profile: profile, Recipient: recipient}
+		if _, err := enqueueFile(db, path(name), target, size, name, BookMetadata{}, queueStatusPending); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queue("Dune.epub", config.KindleEmail, 4*mb)
+	queue("Emma.epub", config.KindleEmail, 5*mb)
+	// Over the batch size together with the books before it
+	queue("Atlas.pdf", config.KindleEmail, 3*mb)
+	// Over the size limit, so it will be shrunk and sent on its own
+	queue("Huge.pdf", config.KindleEmail, 60*mb)
+	// Other recipients, retries and items not yet due wait their turn
+	queue("Other.epub", "other@kindle.com", mb)
+	queue("Retry.epub", config.KindleEmail, mb)
+	queue("Later.epub", config.KindleEmail, mb)
+	queue("Walden.epub", config.KindleEmail, mb)
+	// Past the attachment limit
+	queue("Ulysses.epub", config.KindleEmail, mb)
+	if _, err := db.Exec("UPDATE send_queue SET attempts = 1 WHERE file_path = ?", path("Retry.epub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE send_queue SET next_attempt_at = ? WHERE file_path = ?", time.Now().Add(time.Hour).Unix(), path("Later.epub")); err != nil {
+		t.Fatal(err)
+	}
+
+	companions := func(name string) string {
+		t.Helper()
+		items, err := batchCompanions(db, queuedItem(t, db, path(name)), profile, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, item := range items {
+			names = append(names, filepath.Base(item.FilePath))
+		}
+		return strings.Join(names, ",")
+	}
+
+	if got := companions("Dune.epub"); got != "Emma.epub,Walden.epub" {
+		t.Errorf("batchCompanions(Dune.epub) = %s, want Emma.epub and Walden.epub", got)
+	}
+	// Retries and books over the size limit go out alone
+	if got := companions("Retry.epub"); got != "" {
+		t.Errorf("batchCompanions(Retry.epub) = %s, want none", got)
+	}
+	if got := companions("Huge.pdf"); got != "" {
+		t.Errorf("batchCompanions(Huge.pdf) = %s, want none", got)
+	}
+
+	config.BatchMaxAttachments = 1
+	if got := companions("Dune.epub"); got != "" {
+		t.Errorf("batchCompanions(Dune.epub) without batching = %s, want none", got)
+	}
+}
+
+func TestDeliverQueueItemsBatch(t *testing.T) {
+	config := newTestConfig(t)
+	config.BatchMaxAttachments = 3
+	config.BatchMaxSizeMB = 1
+	db := newTestDB(t)
+	transport := &recordingTransport{}
+	profile := newTestProfiles(t, config, transport).Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+	path := func(name string) string { return filepath.Join(config.WatchPath, name) }
+	queue := func(name string, size int) *QueueItem {
+		t.Helper()
+		writeTestFile(t, path(name), strings.Repeat("x", size))
+		if _, err := enqueueFile(db, path(name), target, int64(size), name, BookMetadata{}, queueStatusPending); err != nil {
+			t.Fatal(err)
+		}
+		return queuedItem(t, db, path(name))
+	}
+	attachments := func(msg *EmailMessage) string {
+		var names []string
+		for _, a := range msg.Attachments {
+			names = append(names, filepath.Base(a.Path))
+		}
+		return strings.Join(names, ",")
+	}
+
+	// Walden no longer fits the batch and stays queued
+	dune, emma, walden := queue("Dune.epub", 400_000), queue("Emma.epub", 500_000), queue("Walden.epub", 300_000)
+	if err := deliverQueueItems([]*QueueItem{dune, emma, walden}, profile, db, nil); err != nil {
+		t.Fatal(err)
+	}
+	delivered := transport.Delivered()
+	if len(delivered) != 1 || attachments(delivered[0]) != "Dune.epub,Emma.epub" {
+		t.Fatalf("delivered %d messages, want one carrying Dune.epub and Emma.epub", len(delivered))
+	}
+	var duneBatch, emmaBatch sql.NullString
+	if err := db.QueryRow("SELECT batch_id FROM deliveries WHERE file_path = ?", path("Dune.epub")).Scan(&duneBatch); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT batch_id FROM deliveries WHERE file_path = ?", path("Emma.epub")).Scan(&emmaBatch); err != nil {
+		t.Fatal(err)
+	}
+	if !duneBatch.Valid || duneBatch != emmaBatch {
+		t.Errorf("batch ids = %v and %v, want one shared id", duneBatch, emmaBatch)
+	}
+	if status, _ := queueStatus(db, path("Walden.epub"), config.KindleEmail); status != queueStatusPending {
+		t.Errorf("Walden.epub queue status = %q, want pending", status)
+	}
+	if item := queuedItem(t, db, path("Walden.epub")); item.Attempts != 0 {
+		t.Errorf("Walden.epub attempts = %d, want 0", item.Attempts)
+	}
+
+	// A book over the batch size goes out on its own, ahead of the rest
+	atlas := queue("Atlas.pdf", 1_200_000)
+	if err := deliverQueueItems([]*QueueItem{atlas, walden}, profile, db, nil); err != nil {
+		t.Fatal(err)
+	}
+	delivered = transport.Delivered()
+	if len(delivered) != 2 || attachments(delivered[1]) != "Atlas.pdf" {
+		t.Fatalf("delivered %d messages, want Atlas.pdf sent alone", len(delivered))
+	}
+	if status, _ := queueStatus(db, path("Walden.epub"), config.KindleEmail); status != queueStatusPending {
+		t.Errorf("Walden.epub queue status = %q, want pending", status)
+	}
+}
+
+func TestDeliverQueueItemsPartialBatch(t *testing.T) {
+	config := newTestConfig(t)
+	config.BatchMaxAttachments = 3
+	db := newTestDB(t)
+	// The transport hands over the first attachment, then the connection drops
+	transport := &recordingTransport{hook: func(msg *EmailMessage) error {
+		return &partialDeliveryError{Delivered: 1, Err: errors.New("connection reset")}
+	}}
+	profile := newTestProfiles(t, config, transport).Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+	path := func(name string) string { return filepath.Join(config.WatchPath, name) }
+
+	var items []*QueueItem
+	for _, name := range []string{"Dune.epub", "Emma.epub", "Walden.epub"} {
+		writeTestFile(t, path(name), name)
+		if _, err := enqueueFile(db, path(name), target, int64(len(name)), name, BookMetadata{}, queueStatusPending); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, queuedItem(t, db, path(name)))
+	}
+	if err := deliverQueueItems(items, profile, db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The book that went out counts as sent, and the message against the
+	// rate limit
+	if status, err := fileStatus(db, path("Dune.epub")); err != nil || status != fileStatusSent {
+		t.Errorf("fileStatus(Dune.epub) = %q, %v, want sent", status, err)
+	}
+	if status, _ := queueStatus(db, path("Dune.epub"), config.KindleEmail); status != "" {
+		t.Errorf("Dune.epub queue status = %q, want the item removed", status)
+	}
+	if sent := profile.RateLimiter.SentThisHour(); sent != 1 {
+		t.Errorf("rate limiter counted %d sends, want 1", sent)
+	}
+
+	// The rest are retried later
+	for _, name := range []string{"Emma.epub", "Walden.epub"} {
+		item := queuedItem(t, db, path(name))
+		if item.Status != queueStatusPending || item.Attempts != 1 || item.LastError != "connection reset" {
+			t.Errorf("%s = %s after %d attempts (%q), want pending after 1 with the error", name, item.Status, item.Attempts, item.LastError)
+		}
+		if delivered, err := isDelivered(db, path(name), config.KindleEmail, false); err != nil || delivered {
+			t.Errorf("isDelivered(%s) = %v, %v, want false", name, delivered, err)
+		}
+	}
+}
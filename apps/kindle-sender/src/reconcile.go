@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isUnder reports whether filePath is dir itself or lies below it
+func isUnder(filePath, dir string) bool {
+	return filePath == dir || strings.HasPrefix(filePath, dir+string(filepath.Separator))
+}
+
+func pathExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return !os.IsNotExist(err)
+}
+
+// forgetRemovedPath drops the oversized entries and queue items of a book, or
+// of every book under a folder, that was deleted or renamed away. Paths that
+// exist again by the time this runs are kept. The send history stays, so a
+// renamed book is still recognised by its content hash.
+func forgetRemovedPath(db *sql.DB, removed string) error {
+	removed = filepath.Clean(removed)
+	oversized, queued, err := pruneStaleState(db, func(filePath string) bool {
+		return isUnder(filePath, removed) && !pathExists(filePath)
+	})
+	if err != nil {
+		return err
+	}
+	if oversized > 0 || queued > 0 {
+		log.Printf("Forgot %s: %d oversized entries and %d queued sends removed", removed, oversized, queued)
+	}
+	return nil
+}
+
+// reconcileWatchPath prunes oversized entries and queue items whose files no
+// longer exist, catching removals the watcher missed or that happened while
+// the pod was down. It does nothing while WATCH_PATH itself is missing, such
+// as when a network share isn't mounted.
+func reconcileWatchPath(config *Config, db *sql.DB) error {
+	if _, err := os.Stat(config.WatchPath); err != nil {
+		return fmt.Errorf("skipped, watch path unavailable: %w", err)
+	}
+	start := time.Now()
+	oversized, queued, err := pruneStaleState(db, func(filePath string) bool {
+		return !pathExists(filePath)
+	})
+	if err != nil {
+		return err
+	}
+	if oversized > 0 || queued > 0 {
+		log.Printf("Reconciliation removed %d oversized entries and %d queued sends for missing files (%.1fs)",
+			oversized, queued, time.Since(start).Seconds())
+	}
+	return nil
+}
+
+// pruneStaleState removes oversized_files rows, with their gauge series, and
+// send_queue rows for which stale returns true
+func pruneStaleState(db *sql.DB, stale func(filePath string) bool) (int, int, error) {
+	type oversizedFile struct {
+		path, name string
+		size       int64
+	}
+	rows, err := db.Query("SELECT file_path, file_name, file_size FROM oversized_files")
+	if err != nil {
+		return 0, 0, err
+	}
+	var oversized []oversizedFile
+	for rows.Next() {
+		var f oversizedFile
+		if err := rows.Scan(&f.path, &f.name, &f.size); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		if stale(f.path) {
+			oversized = append(oversized, f)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	for _, f := range oversized {
+		if err := clearFileOversized(db, f.path, f.name, f.size); err != nil {
+			return 0, 0, err
+		}
+	}
+	stalePruned.WithLabelValues("oversized_files").Add(float64(len(oversized)))
+
+	rows, err = db.Query("SELECT id, file_path FROM send_queue")
+	if err != nil {
+		return len(oversized), 0, err
+	}
+	var queued []int64
+	for rows.Next() {
+		var id int64
+		var filePath string
+		if err := rows.Scan(&id, &filePath); err != nil {
+			rows.Close()
+			return len(oversized), 0, err
+		}
+		if stale(filePath) {
+			queued = append(queued, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return len(oversized), 0, err
+	}
+	for _, id := range queued {
+		if err := deleteQueueItem(db, id); err != nil {
+			return len(oversized), 0, err
+		}
+	}
+	stalePruned.WithLabelValues("send_queue").Add(float64(len(queued)))
+	if len(queued) > 0 {
+		updateQueueMetrics(db)
+	}
+	return len(oversized), len(queued), nil
+}
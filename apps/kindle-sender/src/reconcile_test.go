@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestForgetRemovedPath(t *testing.T) {
+	config := newTestConfig(t)
+	db := newTestDB(t)
+	profile := newTestProfiles(t, config, &recordingTransport{}).Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+	folder := filepath.Join(config.WatchPath, "Frank Herbert")
+	path := func(name string) string { return filepath.Join(folder, name) }
+	// A folder sharing the removed folder's name as a prefix is not under it
+	sibling := filepath.Join(config.WatchPath, "Frank Herbert Jr", "Manhattan.epub")
+
+	writeTestFile(t, path("Dune.epub"), "dune")
+	if err := markFileSent(db, path("Dune.epub"), target, statTestFile(t, path("Dune.epub")), "dune", BookMetadata{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path("Dune.epub"), path("Children of Dune.epub"), path("Back.epub"), sibling} {
+		if _, err := enqueueFile(db, p, target, 4, "hash", BookMetadata{}, queueStatusPending); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := markFileOversized(db, path("Atlas.pdf"), "Atlas.pdf", 100<<20, 50<<20, "too large"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The folder is removed, and one book is already back by the time the
+	// removal is handled
+	if err := os.RemoveAll(folder); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path("Back.epub"), "back")
+	if err := forgetRemovedPath(db, folder+string(filepath.Separator)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path       string
+		wantQueued bool
+	}{
+		{path("Dune.epub"), false},
+		{path("Children of Dune.epub"), false},
+		{path("Back.epub"), true},
+		{sibling, true},
+	} {
+		status, err := queueStatus(db, tt.path, config.KindleEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queued := status != ""; queued != tt.wantQueued {
+			t.Errorf("%s queued = %v, want %v", tt.path, queued, tt.wantQueued)
+		}
+	}
+	if oversized, err := isFileOversized(db, path("Atlas.pdf")); err != nil || oversized {
+		t.Errorf("isFileOversized(Atlas.pdf) = %v, %v, want the entry removed", oversized, err)
+	}
+
+	// The send history stays, so the book is recognised if it comes back
+	if status, err := fileStatus(db, path("Dune.epub")); err != nil || status != fileStatusSent {
+		t.Errorf("fileStatus(Dune.epub) = %q, %v, want sent", status, err)
+	}
+	if delivered, err := isDelivered(db, path("Dune.epub"), config.KindleEmail, false); err != nil || !delivered {
+		t.Errorf("isDelivered(Dune.epub) = %v, %v, want the delivery kept", delivered, err)
+	}
+}
+
+func TestReconcileWatchPath(t *testing.T) {
+	config := newTestConfig(t)
+	db := newTestDB(t)
+	profile := newTestProfiles(t, config, &recordingTransport{}).Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+	present := filepath.Join(config.WatchPath, "Dune.epub")
+	missing := filepath.Join(config.WatchPath, "Emma.epub")
+	writeTestFile(t, present, "dune")
+	for _, p := range []string{present, missing} {
+		if _, err := enqueueFile(db, p, target, 4, "hash", BookMetadata{}, queueStatusPending); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued := func(p string) bool {
+		t.Helper()
+		status, err := queueStatus(db, p, config.KindleEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status != ""
+	}
+
+	// Nothing is pruned while the watch path itself is missing
+	unmounted := &Config{WatchPath: filepath.Join(t.TempDir(), "unmounted")}
+	if err := reconcileWatchPath(unmounted, db); err == nil {
+		t.Error("reconcileWatchPath() with the watch path missing succeeded")
+	}
+	if !queued(missing) {
+		t.Fatal("Emma.epub pruned while the watch path was missing")
+	}
+
+	if err := reconcileWatchPath(config, db); err != nil {
+		t.Fatal(err)
+	}
+	if !queued(present) || queued(missing) {
+		t.Errorf("queued Dune.epub = %v, Emma.epub = %v, want only Dune.epub", queued(present), queued(missing))
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// imap_state remembers the last message checked in each profile's mailbox.
+// UIDs only stay valid while the mailbox keeps its UIDVALIDITY.
+const createIMAPStateSQL = `
+	CREATE TABLE IF NOT EXISTS imap_state (
+		profile TEXT NOT NULL,
+		mailbox TEXT NOT NULL,
+		uid_validity INTEGER NOT NULL,
+		last_uid INTEGER NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(profile, mailbox)
+	);
+	`
+
+const (
+	// rejectionLookback is how far back the first check of a mailbox reads
+	rejectionLookback = 7 * 24 * time.Hour
+	// rejectionMatchWindow is how long before a notice the rejected book
+	// may have been sent
+	rejectionMatchWindow = 7 * 24 * time.Hour
+	// rejectionMinNameLength keeps very short titles from matching any
+	// notice that happens to contain them
+	rejectionMinNameLength = 3
+	rejectionMaxReason     = 300
+)
+
+// rejectionSender is searched for in the From of notices; Amazon sends them
+// from addresses such as do-not-reply@amazon.com
+const rejectionSender = "amazon"
+
+var (
+	// rejectionPattern recognises the wording of Amazon's notices, such as
+	// "We couldn't send your document" or "unable to deliver the following"
+	rejectionPattern = regexp.MustCompile(`(?i)\b(couldn't|could not|unable to|can't|cannot|wasn't able to|were not able to|failed to)\b[^.\n]{0,40}\b(send|sent|deliver|delivered|process|processed|convert|converted)\b`)
+	// rejectionReasonPattern finds the line explaining why, often with an
+	// error code like E999
+	rejectionReasonPattern = regexp.MustCompile(`(?i)\b(because|reason|error|not supported|unsupported|too large|E\d{3})\b`)
+	htmlTagPattern         = regexp.MustCompile(`(?s)<(style|script)[^>]*>.*?</(style|script)>|<[^>]+>`)
+)
+
+// rejectionNotice is an email reporting that documents couldn't be delivered
+type rejectionNotice struct {
+	Subject string
+	Date    time.Time
+	Text    string
+	Reason  string
+}
+
+// parseRejectionNotice reads a message from the sender mailbox and reports
+// whether it is a rejection notice from Amazon
+func parseRejectionNotice(raw []byte) (*rejectionNotice, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	if !strings.Contains(strings.ToLower(msg.Header.Get("From")), rejectionSender) {
+		return nil, false
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	body := messageText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	text := normalizeNoticeText(subject + "\n" + body)
+	if !rejectionPattern.MatchString(text) {
+		return nil, false
+	}
+
+	notice := &rejectionNotice{Subject: subject, Text: text, Reason: subject}
+	if date, err := msg.Header.Date(); err == nil {
+		notice.Date = date
+	}
+	for _, line := range strings.Split(normalizeNoticeText(body), "\n") {
+		if rejectionReasonPattern.MatchString(line) {
+			notice.Reason = strings.TrimSpace(line)
+			break
+		}
+	}
+	if len(notice.Reason) > rejectionMaxReason {
+		notice.Reason = notice.Reason[:rejectionMaxReason]
+	}
+	return notice, true
+}
+
+// messageText returns the text of a message body, preferring the plain text
+// alternative and stripping tags from HTML
+func messageText(contentType, encoding string, body io.Reader) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var plain, htmlText string
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			partType := part.Header.Get("Content-Type")
+			text := messageText(partType, part.Header.Get("Content-Transfer-Encoding"), part)
+			if strings.HasPrefix(strings.ToLower(partType), "text/html") {
+				htmlText += text + "\n"
+			} else if !strings.HasPrefix(strings.ToLower(partType), "application/") {
+				plain += text + "\n"
+			}
+		}
+		if strings.TrimSpace(plain) != "" {
+			return plain
+		}
+		return htmlText
+	}
+	if !strings.HasPrefix(mediaType, "text/") {
+		return ""
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	}
+	data, err := io.ReadAll(io.LimitReader(body, imapMaxLiteral))
+	if err != nil && len(data) == 0 {
+		return ""
+	}
+	text := string(data)
+	if mediaType == "text/html" {
+		text = strings.NewReplacer("<br", "\n<br", "</p>", "\n</p>", "</div>", "\n</div>", "</tr>", "\n</tr>", "</li>", "\n</li>").Replace(text)
+		text = html.UnescapeString(htmlTagPattern.ReplaceAllString(text, ""))
+	}
+	return text
+}
+
+// newlineStripper drops line breaks so wrapped base64 decodes
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	kept := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[kept] = b
+			kept++
+		}
+	}
+	return kept, err
+}
+
+// normalizeNoticeText straightens typographic quotes and collapses runs of
+// spaces, keeping line breaks
+func normalizeNoticeText(text string) string {
+	text = strings.NewReplacer("’", "'", "‘", "'", "“", `"`, "”", `"`, " ", " ", "\r", "").Replace(text)
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// rejectionCandidate is a delivery a notice may refer to
+type rejectionCandidate struct {
+	filePath  string
+	recipient string
+	names     []string
+}
+
+// matchRejection picks the deliveries a notice names, by file name, file name
+// without its extension (books converted before sending keep it) or title.
+// Longer names are matched first and cut from the text, so "Dune Messiah"
+// doesn't also count as "Dune". When the notice names Kindle addresses, only
+// deliveries to those match.
+func matchRejection(text string, candidates []rejectionCandidate) []rejectionCandidate {
+	type candidateName struct {
+		name  string
+		index int
+	}
+	var names []candidateName
+	for i, c := range candidates {
+		for _, name := range c.names {
+			if name = strings.ToLower(normalizeNoticeText(name)); len(name) >= rejectionMinNameLength {
+				names = append(names, candidateName{name, i})
+			}
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool { return len(names[i].name) > len(names[j].name) })
+
+	remaining := strings.ToLower(text)
+	matched := make(map[int]bool)
+	var cut []string
+	for i, n := range names {
+		// Names of the same length are checked before any is cut, so two
+		// recipients of the same book both match
+		if i > 0 && len(n.name) < len(names[i-1].name) {
+			for _, name := range cut {
+				remaining = strings.ReplaceAll(remaining, name, " ")
+			}
+			cut = cut[:0]
+		}
+		if strings.Contains(remaining, n.name) {
+			matched[n.index] = true
+			cut = append(cut, n.name)
+		}
+	}
+
+	var matches []rejectionCandidate
+	addressed := false
+	for i := range candidates {
+		if matched[i] && strings.Contains(strings.ToLower(text), strings.ToLower(candidates[i].recipient)) {
+			addressed = true
+		}
+	}
+	for i, c := range candidates {
+		if matched[i] && (!addressed || strings.Contains(strings.ToLower(text), strings.ToLower(c.recipient))) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+// rejectionCandidates returns the books a profile sent in the window before
+// a notice arrived
+func rejectionCandidates(db *sql.DB, profile string, received time.Time) ([]rejectionCandidate, error) {
+	// sent_at is written by CURRENT_TIMESTAMP, so compare in the same UTC
+	// format, allowing for the clocks being a little apart
+	from := received.Add(-rejectionMatchWindow).UTC().Format("2006-01-02 15:04:05")
+	to := received.Add(time.Hour).UTC().Format("2006-01-02 15:04:05")
+	rows, err := db.Query(
+		`SELECT d.file_path, d.recipient, s.title FROM deliveries d
+		LEFT JOIN sent_files s ON s.file_path = d.file_path
+		WHERE d.profile = ? AND d.status = ? AND d.sent_at BETWEEN ? AND ?`,
+		profile, fileStatusSent, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []rejectionCandidate
+	for rows.Next() {
+		var c rejectionCandidate
+		var title sql.NullString
+		if err := rows.Scan(&c.filePath, &c.recipient, &title); err != nil {
+			return nil, err
+		}
+		base := filepath.Base(c.filePath)
+		c.names = []string{base, strings.TrimSuffix(base, filepath.Ext(base))}
+		if title.Valid {
+			c.names = append(c.names, title.String)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// markRejected records that Amazon couldn't deliver filePath to recipient.
+// Scans don't send it to that recipient again, while other recipients and
+// routes added later still get it; resending it through the admin API clears
+// the rejection.
+func markRejected(db *sql.DB, filePath, recipient, reason string) error {
+	_, err := db.Exec(
+		"UPDATE deliveries SET status = ?, rejection_reason = ? WHERE file_path = ? AND recipient = ?",
+		fileStatusRejected, reason, filePath, recipient,
+	)
+	return err
+}
+
+// applyRejection marks the deliveries a notice refers to as rejected and
+// returns how many it matched
+func applyRejection(db *sql.DB, profile string, notice *rejectionNotice) (int, error) {
+	received := notice.Date
+	if received.IsZero() {
+		received = time.Now()
+	}
+	candidates, err := rejectionCandidates(db, profile, received)
+	if err != nil {
+		return 0, err
+	}
+	matches := matchRejection(notice.Text, candidates)
+	for _, c := range matches {
+		if err := markRejected(db, c.filePath, c.recipient, notice.Reason); err != nil {
+			return 0, err
+		}
+		log.Printf("Amazon rejected %s for %s: %s", filepath.Base(c.filePath), c.recipient, notice.Reason)
+	}
+	return len(matches), nil
+}
+
+// RejectionPoller checks a profile's sender mailbox over IMAP for Amazon's
+// notices about documents it couldn't deliver. SMTP accepting a message only
+// means it reached Amazon.
+type RejectionPoller struct {
+	profile   *Profile
+	tlsConfig *tls.Config
+	tokens    *oauth2TokenSource
+}
+
+// newRejectionPollers returns a poller for every profile with IMAP_HOST set
+func newRejectionPollers(profiles *Profiles) ([]*RejectionPoller, error) {
+	var pollers []*RejectionPoller
+	for _, profile := range profiles.All() {
+		pc := profile.Config
+		if pc.IMAPHost == "" {
+			continue
+		}
+		switch pc.IMAPTLSMode {
+		case smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+		default:
+			return nil, fmt.Errorf("profile %s: unknown IMAP_TLS_MODE %q (expected tls, starttls or none)", profile.Name, pc.IMAPTLSMode)
+		}
+		if pc.IMAPUser == "" {
+			return nil, fmt.Errorf("profile %s: IMAP_HOST is set but IMAP_USER is not", profile.Name)
+		}
+
+		tlsConfig, err := loadTLSConfig(pc.IMAPHost, pc.SMTPCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+		p := &RejectionPoller{profile: profile, tlsConfig: tlsConfig}
+		// IMAP logs in the way SMTP does; an XOAUTH2 token is shared with
+		// the SMTP transport so a rotated refresh token isn't lost
+		if pc.SMTPAuth == smtpAuthXOAUTH2 {
+			if t, ok := profile.Transport.(*smtpTransport); ok && t.tokens != nil {
+				p.tokens = t.tokens
+			} else if pc.OAuth2ClientID != "" && pc.OAuth2RefreshToken != "" {
+				p.tokens = newOAuth2TokenSource(pc)
+			} else {
+				return nil, fmt.Errorf("profile %s: OAUTH2_CLIENT_ID and OAUTH2_REFRESH_TOKEN are required for XOAUTH2", profile.Name)
+			}
+		} else if pc.IMAPPassword == "" {
+			return nil, fmt.Errorf("profile %s: IMAP_HOST is set but IMAP_PASSWORD is not", profile.Name)
+		}
+
+		rejectionNotices.WithLabelValues(profile.Name, "matched").Add(0)
+		rejectionNotices.WithLabelValues(profile.Name, "unmatched").Add(0)
+		pollers = append(pollers, p)
+	}
+	return pollers, nil
+}
+
+// Run checks the mailbox straight away and then every interval
+func (p *RejectionPoller) Run(db *sql.DB, worker *Worker, interval time.Duration) {
+	for {
+		if err := p.poll(db, worker); err != nil {
+			log.Printf("Error checking %s for rejection notices (profile %s): %v", p.profile.Config.IMAPUser, p.profile.Name, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// poll reads the messages that arrived since the last check and applies the
+// rejection notices among them on the worker. The position in the mailbox
+// is only saved once they are applied, so a failure reads them again.
+func (p *RejectionPoller) poll(db *sql.DB, worker *Worker) error {
+	pc := p.profile.Config
+	client, err := dialIMAP(pc.IMAPHost, pc.IMAPPort, pc.IMAPTLSMode, p.tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Logout()
+
+	if p.tokens != nil {
+		token, err := p.tokens.Token()
+		if err != nil {
+			return fmt.Errorf("failed to get OAuth2 access token: %w", err)
+		}
+		if err := client.AuthenticateXOAUTH2(pc.IMAPUser, token); err != nil {
+			// The token may have been revoked early; fetch a fresh one next time
+			p.tokens.Invalidate()
+			return err
+		}
+	} else if err := client.Login(pc.IMAPUser, pc.IMAPPassword); err != nil {
+		return err
+	}
+
+	uidValidity, err := client.Examine(pc.IMAPMailbox)
+	if err != nil {
+		return err
+	}
+	var storedValidity, lastUID uint32
+	err = db.QueryRow(
+		"SELECT uid_validity, last_uid FROM imap_state WHERE profile = ? AND mailbox = ?",
+		p.profile.Name, pc.IMAPMailbox,
+	).Scan(&storedValidity, &lastUID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	criteria := fmt.Sprintf("UID %d:* FROM %s", lastUID+1, imapQuote(rejectionSender))
+	if err == sql.ErrNoRows || storedValidity != uidValidity {
+		// A new or rebuilt mailbox: read the recent past instead of
+		// everything ever received
+		lastUID = 0
+		criteria = fmt.Sprintf("SINCE %s FROM %s", time.Now().Add(-rejectionLookback).Format("2-Jan-2006"), imapQuote(rejectionSender))
+	}
+	uids, err := client.UIDSearch(criteria)
+	if err != nil {
+		return err
+	}
+
+	var notices []*rejectionNotice
+	newLastUID := lastUID
+	for _, uid := range uids {
+		// "n:*" also returns the newest message when it is older than n
+		if uid <= lastUID {
+			continue
+		}
+		raw, err := client.FetchMessage(uid)
+		if err != nil {
+			return err
+		}
+		if notice, ok := parseRejectionNotice(raw); ok {
+			notices = append(notices, notice)
+		}
+		if uid > newLastUID {
+			newLastUID = uid
+		}
+	}
+
+	return worker.Do(func() error {
+		for _, notice := range notices {
+			matched, err := applyRejection(db, p.profile.Name, notice)
+			if err != nil {
+				return err
+			}
+			if matched == 0 {
+				rejectionNotices.WithLabelValues(p.profile.Name, "unmatched").Inc()
+				log.Printf("Rejection notice %q of profile %s matches no recent delivery", notice.Subject, p.profile.Name)
+				continue
+			}
+			rejectionNotices.WithLabelValues(p.profile.Name, "matched").Inc()
+		}
+		_, err := db.Exec(
+			`INSERT INTO imap_state (profile, mailbox, uid_validity, last_uid) VALUES (?, ?, ?, ?)
+			ON CONFLICT(profile, mailbox) DO UPDATE SET
+				uid_validity = excluded.uid_validity, last_uid = excluded.last_uid, updated_at = CURRENT_TIMESTAMP`,
+			p.profile.Name, pc.IMAPMailbox, uidValidity, newLastUID,
+		)
+		return err
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// amazonNotice builds a plain-text notice as Amazon sends it
+func amazonNotice(subject, body string) string {
+	return fmt.Sprintf("From: Amazon Kindle Support <do-not-reply@amazon.com>\r\nSubject: %s\r\nDate: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+}
+
+func TestParseRejectionNotice(t *testing.T) {
+	htmlBody := base64.StdEncoding.EncodeToString([]byte(
+		"<html><body><p>We couldn&rsquo;t send your document.</p><p>Dune Messiah.epub</p>" +
+			"<p>Reason: E999 the document is too large.</p></body></html>"))
+
+	tests := []struct {
+		name       string
+		raw        string
+		wantMatch  bool
+		wantReason string
+	}{
+		{
+			name:       "plain text",
+			raw:        amazonNotice("You sent a document to your Kindle", "We couldn’t send your document\n\nDune.epub\n\nReason: E999 The format is not supported."),
+			wantMatch:  true,
+			wantReason: "Reason: E999 The format is not supported.",
+		},
+		{
+			name: "html base64",
+			raw: "From: do-not-reply@amazon.com\r\nSubject: =?utf-8?q?Delivery_failed?=\r\n" +
+				"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+				htmlBody + "\r\n--b--\r\n",
+			wantMatch:  true,
+			wantReason: "Reason: E999 the document is too large.",
+		},
+		{
+			name:      "delivered notice",
+			raw:       amazonNotice("Your document has been delivered", "Dune.epub was delivered to your Kindle library."),
+			wantMatch: false,
+		},
+		{
+			name:      "other sender",
+			raw:       "From: friend@example.com\r\nSubject: We couldn't send your document\r\n\r\nDune.epub\r\n",
+			wantMatch: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notice, ok := parseRejectionNotice([]byte(tt.raw))
+			if ok != tt.wantMatch {
+				t.Fatalf("parseRejectionNotice() matched = %v, want %v", ok, tt.wantMatch)
+			}
+			if ok && notice.Reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", notice.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestMatchRejection(t *testing.T) {
+	candidates := []rejectionCandidate{
+		{filePath: "/books/Dune.epub", recipient: "a@kindle.com", names: []string{"Dune.epub", "Dune", "Dune"}},
+		{filePath: "/books/Dune Messiah.epub", recipient: "a@kindle.com", names: []string{"Dune Messiah.epub", "Dune Messiah"}},
+		{filePath: "/books/Dune Messiah.epub", recipient: "b@kindle.com", names: []string{"Dune Messiah.epub", "Dune Messiah"}},
+	}
+
+	matches := matchRejection("We couldn't send your document Dune Messiah to a@kindle.com", candidates)
+	if len(matches) != 1 || matches[0].filePath != "/books/Dune Messiah.epub" || matches[0].recipient != "a@kindle.com" {
+		t.Fatalf("matches = %+v, want Dune Messiah for a@kindle.com", matches)
+	}
+
+	// Without an address every recipient of the book matches
+	matches = matchRejection("We couldn't send your document Dune Messiah", candidates)
+	if len(matches) != 2 {
+		t.Fatalf("matches = %+v, want both recipients of Dune Messiah", matches)
+	}
+}
+
+func TestRejectionPollerMarksOnlyThatDelivery(t *testing.T) {
+	config := newTestConfig(t)
+	path := filepath.Join(config.WatchPath, "Dune.epub")
+	writeTestFile(t, path, "dune")
+
+	worker := startTestWorker(t, config, &recordingTransport{})
+	db := worker.db
+	profile := worker.profiles.Get(defaultProfile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recipient := range []string{"a@kindle.com", "b@kindle.com"} {
+		target := Target{Profile: profile, Recipient: recipient}
+		if err := markFileSent(db, path, target, info, "hash", BookMetadata{}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := startIMAPStandIn(t, map[uint32]string{
+		1: amazonNotice("You sent a document", "We couldn't send your document Dune.epub to a@kindle.com.\nError E999: the format is not supported."),
+		2: amazonNotice("You sent a document", "We couldn't send your document Unknown Book.pdf.\nError E999."),
+		3: amazonNotice("Your document has been delivered", "Dune.epub was delivered to b@kindle.com."),
+	})
+	profile.Config.IMAPHost = "127.0.0.1"
+	profile.Config.IMAPPort = server.Port()
+	profile.Config.IMAPTLSMode = smtpTLSNone
+	profile.Config.IMAPUser = server.user
+	profile.Config.IMAPPassword = server.password
+	profile.Config.IMAPMailbox = "INBOX"
+
+	poller := &RejectionPoller{profile: profile}
+	if err := poller.poll(db, worker); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+
+	statuses := make(map[string]string)
+	rows, err := db.Query("SELECT recipient, status, COALESCE(rejection_reason, '') FROM deliveries WHERE file_path = ?", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var recipient, status, reason string
+		if err := rows.Scan(&recipient, &status, &reason); err != nil {
+			t.Fatal(err)
+		}
+		statuses[recipient] = status
+		if status == fileStatusRejected && !strings.Contains(reason, "E999") {
+			t.Errorf("rejection reason = %q, want the notice's error", reason)
+		}
+	}
+	if statuses["a@kindle.com"] != fileStatusRejected || statuses["b@kindle.com"] != fileStatusSent {
+		t.Errorf("delivery statuses = %v, want a@kindle.com rejected and b@kindle.com sent", statuses)
+	}
+
+	// The file itself stays sent, so other recipients can still get it
+	if status, err := fileStatus(db, path); err != nil || status != fileStatusSent {
+		t.Errorf("file status = %q, %v, want sent", status, err)
+	}
+
+	var lastUID uint32
+	if err := db.QueryRow("SELECT last_uid FROM imap_state WHERE profile = ?", defaultProfile).Scan(&lastUID); err != nil {
+		t.Fatal(err)
+	}
+	if lastUID != 3 {
+		t.Errorf("last_uid = %d, want 3", lastUID)
+	}
+}
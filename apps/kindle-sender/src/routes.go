@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/mail"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Target is one delivery of a book: the Kindle address and the profile
+// whose account sends to it
+type Target struct {
+	Profile   *Profile
+	Recipient string
+}
+
+func (t Target) String() string {
+	if t.Profile.Name == defaultProfile {
+		return t.Recipient
+	}
+	return fmt.Sprintf("%s (profile %s)", t.Recipient, t.Profile.Name)
+}
+
+// pathPattern matches book paths relative to WATCH_PATH
+type pathPattern struct {
+	pattern  string
+	segments []string
+}
+
+// route sends books whose path under WATCH_PATH matches pattern to its
+// targets
+type route struct {
+	pathPattern
+	targets []Target
+}
+
+// Router picks the Kindle addresses a book is delivered to. Books matching
+// several routes go to every matching recipient; books matching none go to
+// the default profile's KINDLE_EMAIL, if set. Without routes every book goes
+// to KINDLE_EMAIL, even when it is empty for transports that don't need an
+// address.
+type Router struct {
+	watchPath      string
+	routes         []route
+	defaultProfile *Profile
+}
+
+// newRouter parses ROUTES, a list of pattern=target[,target] rules separated
+// by semicolons or newlines. A target is an address, sent to from the
+// default profile, or a profile name, sent to that profile's Kindle address.
+// Patterns are parsed by parsePathPattern.
+func newRouter(config *Config, profiles *Profiles) (*Router, error) {
+	r := &Router{watchPath: filepath.Clean(config.WatchPath), defaultProfile: profiles.Get(defaultProfile)}
+
+	rules := strings.FieldsFunc(config.Routes, func(c rune) bool { return c == ';' || c == '\n' })
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		pattern, addresses, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("route %q is not of the form pattern=address", rule)
+		}
+
+		compiled, err := parsePathPattern(r.watchPath, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", rule, err)
+		}
+		pattern = compiled.pattern
+
+		var targets []Target
+		for _, entry := range splitList(addresses) {
+			if !strings.Contains(entry, "@") {
+				profile := profiles.Get(strings.ToLower(entry))
+				if profile == nil {
+					return nil, fmt.Errorf("unknown profile %q in route %q", entry, pattern)
+				}
+				if profile.Config.KindleEmail == "" {
+					return nil, fmt.Errorf("route %q sends to profile %s, which has no KINDLE_EMAIL", pattern, profile.Name)
+				}
+				targets = append(targets, Target{Profile: profile, Recipient: profile.Config.KindleEmail})
+				continue
+			}
+			if _, err := mail.ParseAddress(entry); err != nil {
+				return nil, fmt.Errorf("invalid recipient %q in route %q: %w", entry, pattern, err)
+			}
+			if r.defaultProfile == nil {
+				return nil, fmt.Errorf("route %q sends to %s, but there is no default profile to send from; name a profile instead", pattern, entry)
+			}
+			targets = append(targets, Target{Profile: r.defaultProfile, Recipient: entry})
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("route %q has no recipients", pattern)
+		}
+		r.routes = append(r.routes, route{pathPattern: compiled, targets: targets})
+	}
+	return r, nil
+}
+
+// Targets returns where filePath should be delivered, in route order without
+// duplicate addresses. Profiles that don't accept the file's format are left
+// out.
+func (r *Router) Targets(filePath string) []Target {
+	var targets []Target
+	seen := make(map[string]bool)
+
+	if segments, ok := relativeSegments(r.watchPath, filePath); ok {
+		for _, rt := range r.routes {
+			if !rt.matches(segments) {
+				continue
+			}
+			for _, target := range rt.targets {
+				if !seen[strings.ToLower(target.Recipient)] {
+					seen[strings.ToLower(target.Recipient)] = true
+					targets = append(targets, target)
+				}
+			}
+		}
+	}
+
+	if len(targets) == 0 && r.defaultProfile != nil && (r.defaultProfile.Config.KindleEmail != "" || len(r.routes) == 0) {
+		targets = append(targets, Target{Profile: r.defaultProfile, Recipient: r.defaultProfile.Config.KindleEmail})
+	}
+
+	accepted := targets[:0]
+	for _, target := range targets {
+		if isSupportedFile(filepath.Base(filePath), target.Profile.Config.FileExtensions) {
+			accepted = append(accepted, target)
+		}
+	}
+	return accepted
+}
+
+// parsePathPattern compiles a pattern relative to WATCH_PATH, or absolute
+// under it. A pattern without wildcards matches that folder or file, and **
+// matches any number of folders.
+func parsePathPattern(watchPath, pattern string) (pathPattern, error) {
+	pattern = strings.TrimSpace(pattern)
+	if filepath.IsAbs(pattern) {
+		rel, err := filepath.Rel(watchPath, filepath.Clean(pattern))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return pathPattern{}, fmt.Errorf("pattern %q is not under %s", pattern, watchPath)
+		}
+		pattern = rel
+	}
+	pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+	if pattern == "" || pattern == "." {
+		pattern = "**"
+	}
+	segments := strings.Split(pattern, "/")
+	for _, segment := range segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return pathPattern{}, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return pathPattern{pattern: pattern, segments: segments}, nil
+}
+
+// relativeSegments splits filePath below watchPath into its folder and file
+// names
+func relativeSegments(watchPath, filePath string) ([]string, bool) {
+	rel, err := filepath.Rel(watchPath, filepath.Clean(filePath))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, false
+	}
+	return strings.Split(filepath.ToSlash(rel), "/"), true
+}
+
+// matches reports whether a slash-separated relative path matches the
+// pattern. Patterns without wildcards also match everything below them.
+func (p pathPattern) matches(segments []string) bool {
+	if !strings.ContainsAny(p.pattern, "*?[") {
+		return len(segments) >= len(p.segments) && matchSegments(p.segments, segments[:len(p.segments)])
+	}
+	return matchSegments(p.segments, segments)
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// deliveries tracks which recipients received each file, so a recipient
+// added later is sent only what they are missing
+const createDeliveriesSQL = `
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_path TEXT NOT NULL,
+		recipient TEXT NOT NULL COLLATE NOCASE,
+		status TEXT NOT NULL DEFAULT 'sent',
+		sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(file_path, recipient)
+	);
+	CREATE INDEX IF NOT EXISTS idx_deliveries_recipient ON deliveries(recipient);
+	`
+
+// currentVersionSQL is the latest version of a path in file_versions; books
+// that never changed are version 1
+const currentVersionSQL = `(SELECT COALESCE(MAX(version), 1) FROM file_versions WHERE file_path = ?)`
+
+// recordDelivery notes that the current version of filePath reached the
+// target's recipient. Status is 'sent' for an actual delivery and 'moved'
+// when they already had the same content.
+func recordDelivery(db *sql.DB, filePath string, target Target, status string) error {
+	_, err := db.Exec(
+		`INSERT INTO deliveries (file_path, recipient, profile, status, version) VALUES (?, ?, ?, ?, `+currentVersionSQL+`)
+		ON CONFLICT(file_path, recipient) DO UPDATE SET
+			profile = excluded.profile, status = excluded.status, version = excluded.version, batch_id = NULL, rejection_reason = NULL, sent_at = CURRENT_TIMESTAMP`,
+		filePath, target.Recipient, target.Profile.Name, status, filePath,
+	)
+	return err
+}
+
+// isDelivered reports whether recipient has filePath. With currentOnly, a
+// delivery of an older version doesn't count.
+func isDelivered(db *sql.DB, filePath, recipient string, currentOnly bool) (bool, error) {
+	query := "SELECT COUNT(*) FROM deliveries WHERE file_path = ? AND recipient = ?"
+	args := []interface{}{filePath, recipient}
+	if currentOnly {
+		query += " AND version >= " + currentVersionSQL
+		args = append(args, filePath)
+	}
+	var count int
+	err := db.QueryRow(query, args...).Scan(&count)
+	return count > 0, err
+}
+
+// undeliveredTargets returns the targets with no delivery of filePath, or
+// with currentOnly none of its current version
+func undeliveredTargets(db *sql.DB, filePath string, targets []Target, currentOnly bool) ([]Target, error) {
+	var missing []Target
+	for _, target := range targets {
+		delivered, err := isDelivered(db, filePath, target.Recipient, currentOnly)
+		if err != nil {
+			return nil, err
+		}
+		if !delivered {
+			missing = append(missing, target)
+		}
+	}
+	return missing, nil
+}
+
+// findDeliveryByHash returns the path content with this hash was delivered
+// to recipient from, or "" if they never received it. A recipient who got an
+// earlier version of a path has that version's content, not the current one.
+func findDeliveryByHash(db *sql.DB, fileHash, recipient string) (string, error) {
+	var filePath string
+	err := db.QueryRow(
+		`SELECT d.file_path FROM deliveries d JOIN sent_files s ON s.file_path = d.file_path
+		LEFT JOIN file_versions v ON v.file_path = d.file_path AND v.version = d.version
+		WHERE COALESCE(v.file_hash, s.file_hash) = ? AND d.recipient = ? ORDER BY d.id LIMIT 1`,
+		fileHash, recipient,
+	).Scan(&filePath)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return filePath, err
+}
+
+// migrateRecipients attributes history and queue entries from before routing
+// existed to the default recipient. It only touches the history while the
+// deliveries table is still empty.
+func migrateRecipients(db *sql.DB, defaultRecipient string) error {
+	if defaultRecipient == "" {
+		return nil
+	}
+	if _, err := db.Exec("UPDATE send_queue SET recipient = ? WHERE recipient = ''", defaultRecipient); err != nil {
+		return err
+	}
+
+	var deliveries int
+	if err := db.QueryRow("SELECT COUNT(*) FROM deliveries").Scan(&deliveries); err != nil {
+		return err
+	}
+	if deliveries > 0 {
+		return nil
+	}
+	result, err := db.Exec(
+		`INSERT OR IGNORE INTO deliveries (file_path, recipient, status, sent_at)
+		SELECT file_path, ?, status, sent_at FROM sent_files WHERE status IN (?, ?)`,
+		defaultRecipient, fileStatusSent, fileStatusMoved,
+	)
+	if err != nil {
+		return err
+	}
+	if migrated, _ := result.RowsAffected(); migrated > 0 {
+		log.Printf("Recorded %d earlier deliveries for %s", migrated, defaultRecipient)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPathPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		// Plain folders match everything below them
+		{"Kids", "Kids/Gruffalo.epub", true},
+		{"Kids", "Kids/Series/Book.epub", true},
+		{"Kids", "Kidsbooks/Book.epub", false},
+		{"Kids/Series", "Kids/Book.epub", false},
+
+		// Wildcards match one segment, and patterns with them match whole
+		// paths only
+		{"*/Manga", "Anna/Manga", true},
+		{"*/Manga", "Anna/Manga/Book.epub", false},
+		{"*/Manga/*", "Anna/Manga/Book.epub", true},
+		{"*/Manga/*", "Manga/Book.epub", false},
+		{"*/Manga/*.epub", "Anna/Manga/One Piece.epub", true},
+		{"*/Manga/*.epub", "Anna/Manga/Vol 1/One Piece.epub", false},
+		{"Author ?/*", "Author A/Book.epub", true},
+		{"[AB]*/*", "Charlie/Book.epub", false},
+
+		// ** at the start, in the middle and at the end
+		{"**/*.pdf", "Book.pdf", true},
+		{"**/*.pdf", "Science/Physics/Book.pdf", true},
+		{"**/*.pdf", "Science/Book.epub", false},
+		{"Comics/**/*.cbz.epub", "Comics/Book.cbz.epub", true},
+		{"Comics/**/*.cbz.epub", "Comics/Marvel/X-Men/Book.cbz.epub", true},
+		{"Comics/**/*.cbz.epub", "Novels/Book.cbz.epub", false},
+		{"Anna/**", "Anna/Book.epub", true},
+		{"Anna/**", "Anna/Sub/Dir/Book.epub", true},
+		{"Anna/**", "Bob/Book.epub", false},
+		{"**", "Anything/At/All.epub", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			p, err := parsePathPattern("/books", tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.matches(strings.Split(tt.path, "/")); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePathPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{pattern: "/books/Kids/", want: "Kids"},
+		{pattern: " Kids/Series ", want: "Kids/Series"},
+		{pattern: "/books", want: "**"},
+		{pattern: "/elsewhere/Kids", wantErr: true},
+		{pattern: "Kids/[", wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := parsePathPattern("/books", tt.pattern)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePathPattern(%q) error = %v, want error %v", tt.pattern, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p.pattern != tt.want {
+			t.Errorf("parsePathPattern(%q) = %q, want %q", tt.pattern, p.pattern, tt.want)
+		}
+	}
+}
+
+func TestRouterTargets(t *testing.T) {
+	config := newTestConfig(t)
+	config.KindleEmail = "family@kindle.com"
+	config.Routes = "Kids=kid@kindle.com; **/*.pdf=papers@kindle.com,kid@kindle.com\nKids/Picture Books=KID@kindle.com,tablet@kindle.com"
+	profiles := newTestProfiles(t, config, &recordingTransport{})
+	router, err := newRouter(config, profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		// Matching rules contribute in rule order, without repeating an
+		// address in another case
+		{"Kids/Picture Books/Gruffalo.pdf", []string{"kid@kindle.com", "papers@kindle.com", "tablet@kindle.com"}},
+		{"Kids/Gruffalo.epub", []string{"kid@kindle.com"}},
+		{"Science/Paper.pdf", []string{"papers@kindle.com", "kid@kindle.com"}},
+		// Books no rule matches go to KINDLE_EMAIL
+		{"Novels/Dune.epub", []string{"family@kindle.com"}},
+		// Formats the profile doesn't send go nowhere
+		{"Kids/Gruffalo.mobi", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, target := range router.Targets(filepath.Join(config.WatchPath, tt.path)) {
+			got = append(got, target.Recipient)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Targets(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	for _, routes := range []string{
+		"Kids",
+		"Kids=",
+		"Kids=not an address@",
+		"Kids=unknown-profile",
+		"/elsewhere=kid@kindle.com",
+	} {
+		config := newTestConfig(t)
+		config.Routes = routes
+		if _, err := newRouter(config, newTestProfiles(t, config, &recordingTransport{})); err == nil {
+			t.Errorf("newRouter(%q) succeeded", routes)
+		}
+	}
+}
+
+func TestDeliveryTracking(t *testing.T) {
+	config := newTestConfig(t)
+	db := newTestDB(t)
+	profile := newTestProfiles(t, config, &recordingTransport{}).Get(defaultProfile)
+	path := filepath.Join(config.WatchPath, "Dune.epub")
+	writeTestFile(t, path, "dune")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := Target{Profile: profile, Recipient: "a@kindle.com"}
+	b := Target{Profile: profile, Recipient: "b@kindle.com"}
+
+	if err := markFileSent(db, path, a, info, "hash-1", BookMetadata{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recipients are compared without case
+	for _, tt := range []struct {
+		recipient string
+		want      bool
+	}{{"a@kindle.com", true}, {"A@Kindle.com", true}, {"b@kindle.com", false}} {
+		if got, err := isDelivered(db, path, tt.recipient, false); err != nil || got != tt.want {
+			t.Errorf("isDelivered(%s) = %v, %v, want %v", tt.recipient, got, err, tt.want)
+		}
+	}
+	missing, err := undeliveredTargets(db, path, []Target{a, b}, false)
+	if err != nil || len(missing) != 1 || missing[0].Recipient != b.Recipient {
+		t.Errorf("undeliveredTargets() = %v, %v, want only %s", missing, err, b.Recipient)
+	}
+
+	// The hash finds the delivered path for that recipient only
+	if got, err := findDeliveryByHash(db, "hash-1", "a@kindle.com"); err != nil || got != path {
+		t.Errorf("findDeliveryByHash(a) = %q, %v, want %s", got, err, path)
+	}
+	if got, err := findDeliveryByHash(db, "hash-1", "b@kindle.com"); err != nil || got != "" {
+		t.Errorf("findDeliveryByHash(b) = %q, %v, want none", got, err)
+	}
+
+	// After an upgrade a has an older version: delivered, but not current,
+	// and the old content is still found by its hash
+	if _, err := recordFileVersion(db, path, info.Size(), "hash-2", sql.NullInt64{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE sent_files SET file_hash = ? WHERE file_path = ?", "hash-2", path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := isDelivered(db, path, "a@kindle.com", false); !got {
+		t.Error("isDelivered(a) = false after an upgrade, want true")
+	}
+	if got, _ := isDelivered(db, path, "a@kindle.com", true); got {
+		t.Error("isDelivered(a, current only) = true after an upgrade, want false")
+	}
+	if got, _ := findDeliveryByHash(db, "hash-1", "a@kindle.com"); got != path {
+		t.Errorf("findDeliveryByHash(old hash) = %q, want %s", got, path)
+	}
+	if got, _ := findDeliveryByHash(db, "hash-2", "a@kindle.com"); got != "" {
+		t.Errorf("findDeliveryByHash(new hash) = %q, want none", got)
+	}
+
+	// A moved copy counts as delivered
+	if err := recordDelivery(db, path, b, fileStatusMoved); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := isDelivered(db, path, "b@kindle.com", true); !got {
+		t.Error("isDelivered(b) = false after recording a move, want true")
+	}
+}
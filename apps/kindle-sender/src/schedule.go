@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	// The distroless image has no zoneinfo, so DELIVERY_TIMEZONE needs the
+	// embedded database
+	_ "time/tzdata"
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// deliveryWindow is one entry of DELIVERY_WINDOWS: the days it starts on and
+// its start and end as minutes after midnight. A window ending before it
+// starts runs past midnight into the next day.
+type deliveryWindow struct {
+	days       [7]bool
+	start, end int
+}
+
+// Schedule holds the delivery windows of a profile. A nil Schedule, from an
+// empty DELIVERY_WINDOWS, is always open.
+type Schedule struct {
+	spec     string
+	windows  []deliveryWindow
+	location *time.Location
+}
+
+// parseSchedule reads DELIVERY_WINDOWS, a comma-separated list of windows
+// such as "mon-fri 07:00-22:00, sat-sun 09:00-23:30". The days are a day, a
+// range of days or "*", and may be left out for every day.
+func parseSchedule(spec, timezone string) (*Schedule, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	location := time.Local
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid DELIVERY_TIMEZONE: %w", err)
+		}
+	}
+
+	schedule := &Schedule{spec: spec, location: location}
+	for _, entry := range splitList(spec) {
+		window, err := parseDeliveryWindow(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delivery window %q: %w", entry, err)
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+	return schedule, nil
+}
+
+func parseDeliveryWindow(entry string) (deliveryWindow, error) {
+	var window deliveryWindow
+	fields := strings.Fields(entry)
+	days, times := "*", ""
+	switch len(fields) {
+	case 1:
+		times = fields[0]
+	case 2:
+		days, times = fields[0], fields[1]
+	default:
+		return window, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+
+	if days == "*" {
+		for i := range window.days {
+			window.days[i] = true
+		}
+	} else {
+		first, last, isRange := strings.Cut(days, "-")
+		from, err := parseWeekday(first)
+		if err != nil {
+			return window, err
+		}
+		to := from
+		if isRange {
+			if to, err = parseWeekday(last); err != nil {
+				return window, err
+			}
+		}
+		// A range may wrap around the week, such as fri-mon
+		for day := from; ; day = (day + 1) % 7 {
+			window.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(times, "-")
+	if !ok {
+		return window, fmt.Errorf("expected a time range like 07:00-22:00")
+	}
+	var err error
+	if window.start, err = parseClock(start); err != nil {
+		return window, err
+	}
+	if window.end, err = parseClock(end); err != nil {
+		return window, err
+	}
+	if window.start == window.end {
+		return window, fmt.Errorf("window is empty")
+	}
+	return window, nil
+}
+
+func parseWeekday(name string) (int, error) {
+	name = strings.ToLower(name)
+	for i, day := range weekdayNames {
+		if name == day || name == strings.ToLower(time.Weekday(i).String()) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q", name)
+}
+
+// parseClock returns the minutes after midnight of an HH:MM time. A window
+// ending at 00:00 runs to midnight.
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// Open reports whether t falls in one of the windows
+func (s *Schedule) Open(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	local := t.In(s.location)
+	minute := local.Hour()*60 + local.Minute()
+	day := int(local.Weekday())
+	yesterday := (day + 6) % 7
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		if (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextChange returns when the schedule next opens or closes after t, or the
+// zero time if it never does. The schedule can only change at a window's
+// start or end, or when daylight saving time shifts the clock, so those
+// instants over the coming week are checked in order.
+func (s *Schedule) NextChange(t time.Time) time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	open := s.Open(t)
+	local := t.In(s.location)
+	horizon := t.Add(8 * 24 * time.Hour)
+
+	// Clock shifts of the coming week, and the UTC offsets in force
+	var candidates []time.Time
+	_, offset := local.Zone()
+	offsets := []int{offset}
+	for shift := local; ; {
+		if _, shift = shift.ZoneBounds(); shift.IsZero() || shift.After(horizon) {
+			break
+		}
+		candidates = append(candidates, shift)
+		_, offset := shift.Zone()
+		offsets = append(offsets, offset)
+	}
+
+	// Window edges as wall clock times, starting the day before so a window
+	// running past midnight into today is included. Around a clock shift a
+	// wall time can occur twice or not at all, so each is tried at every
+	// offset and kept where that offset is the one in force.
+	year, month, day := local.Date()
+	for i := -1; i <= 8; i++ {
+		date := time.Date(year, month, day+i, 0, 0, 0, 0, time.UTC)
+		for _, w := range s.windows {
+			if !w.days[date.Weekday()] {
+				continue
+			}
+			end := date.Add(time.Duration(w.end) * time.Minute)
+			if w.end < w.start {
+				end = end.AddDate(0, 0, 1)
+			}
+			for _, wall := range []time.Time{date.Add(time.Duration(w.start) * time.Minute), end} {
+				for _, offset := range offsets {
+					edge := wall.Add(-time.Duration(offset) * time.Second).In(s.location)
+					if _, in := edge.Zone(); in == offset && edge.After(t) && !edge.After(horizon) {
+						candidates = append(candidates, edge)
+					}
+				}
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	for _, next := range candidates {
+		if s.Open(next) != open {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) String() string {
+	if s == nil {
+		return "always"
+	}
+	return fmt.Sprintf("%s (%s)", s.spec, s.location)
+}
+
+// updateDeliveryWindow exports whether profile is inside its delivery
+// windows at now, logging when it leaves or enters them. Only the worker
+// calls it.
+func updateDeliveryWindow(profile *Profile, now time.Time) bool {
+	open := profile.Schedule.Open(now)
+	if open {
+		deliveryWindowOpen.WithLabelValues(profile.Name).Set(1)
+	} else {
+		deliveryWindowOpen.WithLabelValues(profile.Name).Set(0)
+	}
+	if open == profile.windowClosed {
+		if open {
+			log.Printf("Delivery window of profile %s opened, sending queued books", profile.Name)
+		} else {
+			log.Printf("Delivery window of profile %s closed, books are queued until %s",
+				profile.Name, profile.Schedule.NextChange(now).Format("Mon 15:04 MST"))
+		}
+	}
+	profile.windowClosed = !open
+	return open
+}
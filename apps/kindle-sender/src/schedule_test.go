@@ -0,0 +1,262 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "00:00", want: 0},
+		{value: "07:30", want: 7*60 + 30},
+		{value: "7:30", want: 7*60 + 30},
+		{value: "23:59", want: 23*60 + 59},
+		{value: "24:00", wantErr: true},
+		{value: "12:60", wantErr: true},
+		{value: "22:00pm", wantErr: true},
+		{value: "7:5x", wantErr: true},
+		{value: "7:5", wantErr: true},
+		{value: "-1:00", wantErr: true},
+		{value: "0700", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseClock(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClock(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseClock(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	if schedule, err := parseSchedule("  ", "Europe/Berlin"); err != nil || schedule != nil {
+		t.Errorf("parseSchedule(empty) = %v, %v, want an always open schedule", schedule, err)
+	}
+
+	schedule, err := parseSchedule("mon-fri 07:00-09:00, fri-mon 22:00-02:00, Sunday 10:00-12:00, 13:00-14:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedule.location.String() != "Europe/Berlin" {
+		t.Errorf("location = %s, want Europe/Berlin", schedule.location)
+	}
+	want := []struct {
+		days       string
+		start, end int
+	}{
+		{"-MTWTF-", 7 * 60, 9 * 60},
+		{"SM---FS", 22 * 60, 2 * 60},
+		{"S------", 10 * 60, 12 * 60},
+		{"SMTWTFS", 13 * 60, 14 * 60},
+	}
+	if len(schedule.windows) != len(want) {
+		t.Fatalf("got %d windows, want %d", len(schedule.windows), len(want))
+	}
+	for i, w := range schedule.windows {
+		days := []byte("-------")
+		for day, on := range w.days {
+			if on {
+				days[day] = "SMTWTFS"[day]
+			}
+		}
+		if string(days) != want[i].days || w.start != want[i].start || w.end != want[i].end {
+			t.Errorf("window %d = %s %d-%d, want %s %d-%d", i, days, w.start, w.end, want[i].days, want[i].start, want[i].end)
+		}
+	}
+
+	for _, spec := range []string{
+		"mon-fri",
+		"mon-fri 07:00",
+		"mon-fri 07:00-07:00",
+		"funday 07:00-09:00",
+		"mon-fri 07:00-25:00",
+		"mon-fri 7:00pm-9:00pm",
+		"mon fri 07:00-09:00",
+	} {
+		if _, err := parseSchedule(spec, ""); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded", spec)
+		}
+	}
+	if _, err := parseSchedule("07:00-09:00", "Mars/Olympus_Mons"); err == nil {
+		t.Error("parseSchedule() with an unknown timezone succeeded")
+	}
+}
+
+func TestScheduleOpen(t *testing.T) {
+	schedule, err := parseSchedule("mon-fri 07:00-09:00, fri 22:00-02:00", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2026-10-16 is a Friday
+	tests := []struct {
+		at   string
+		want bool
+	}{
+		{"2026-10-16T06:59:00Z", false},
+		{"2026-10-16T07:00:00Z", true},
+		{"2026-10-16T08:59:59Z", true},
+		{"2026-10-16T09:00:00Z", false},
+		{"2026-10-16T22:00:00Z", true},
+		// The Friday night window runs past midnight into Saturday
+		{"2026-10-17T01:59:00Z", true},
+		{"2026-10-17T02:00:00Z", false},
+		{"2026-10-17T07:30:00Z", false},
+		{"2026-10-17T22:30:00Z", false},
+		// but Thursday night's doesn't
+		{"2026-10-16T01:00:00Z", false},
+	}
+	for _, tt := range tests {
+		at, err := time.Parse(time.RFC3339, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := schedule.Open(at); got != tt.want {
+			t.Errorf("Open(%s) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+
+	// Times are read in the schedule's timezone
+	berlin, err := parseSchedule("07:00-09:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !berlin.Open(time.Date(2026, 10, 16, 5, 30, 0, 0, time.UTC)) {
+		t.Error("05:30 UTC is 07:30 in Berlin, want open")
+	}
+
+	var always *Schedule
+	if !always.Open(time.Now()) || !always.NextChange(time.Now()).IsZero() {
+		t.Error("a nil schedule is not always open")
+	}
+}
+
+func TestScheduleNextChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		timezone string
+		at       time.Time
+		want     time.Time
+	}{
+		{
+			name:     "opens later today",
+			spec:     "07:00-09:00",
+			timezone: "UTC",
+			at:       time.Date(2026, 10, 16, 5, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 10, 16, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "closes past midnight",
+			spec:     "fri 22:00-02:00",
+			timezone: "UTC",
+			at:       time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 10, 17, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "opens next week",
+			spec:     "fri 22:00-02:00",
+			timezone: "UTC",
+			at:       time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 10, 23, 22, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "adjacent windows don't change",
+			spec:     "07:00-12:00, 12:00-18:00",
+			timezone: "UTC",
+			at:       time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "never changes",
+			spec:     "20:00-08:00, 07:00-21:00",
+			timezone: "UTC",
+			at:       time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			// Berlin skips from 02:00 to 03:00 on 29 March 2026, so a
+			// window ending at 02:30 closes at the shift
+			name:     "closes at spring forward",
+			spec:     "01:00-02:30",
+			timezone: "Europe/Berlin",
+			at:       time.Date(2026, 3, 29, 0, 30, 0, 0, time.UTC),
+			want:     time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "opens at spring forward",
+			spec:     "02:30-04:00",
+			timezone: "Europe/Berlin",
+			at:       time.Date(2026, 3, 28, 23, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			// Berlin goes back from 03:00 to 02:00 on 25 October 2026, so
+			// a window ending at 02:30 opens again for half an hour
+			name:     "reopens at fall back",
+			spec:     "00:00-02:30",
+			timezone: "Europe/Berlin",
+			at:       time.Date(2026, 10, 25, 0, 45, 0, 0, time.UTC),
+			want:     time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "closes after the repeated hour",
+			spec:     "00:00-02:30",
+			timezone: "Europe/Berlin",
+			at:       time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC),
+			want:     time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parseSchedule(tt.spec, tt.timezone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.NextChange(tt.at); !got.Equal(tt.want) {
+				t.Errorf("NextChange(%s) = %s, want %s", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestScheduleNextChangeMatchesScan checks NextChange against a minute by
+// minute scan over the weeks of both daylight saving shifts
+func TestScheduleNextChangeMatchesScan(t *testing.T) {
+	scan := func(s *Schedule, at time.Time) time.Time {
+		open := s.Open(at)
+		for next := at.Add(time.Minute); next.Before(at.AddDate(0, 0, 8)); next = next.Add(time.Minute) {
+			if s.Open(next) != open {
+				return next
+			}
+		}
+		return time.Time{}
+	}
+	for _, spec := range []string{
+		"mon-fri 07:00-09:00, sat-sun 09:00-23:30",
+		"fri-mon 22:00-02:30",
+		"01:30-02:30, 02:45-03:15",
+		"sun 02:00-03:00",
+	} {
+		schedule, err := parseSchedule(spec, "Europe/Berlin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, week := range []time.Time{
+			time.Date(2026, 3, 26, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 10, 22, 0, 0, 0, 0, time.UTC),
+		} {
+			for at := week; at.Before(week.AddDate(0, 0, 4)); at = at.Add(53 * time.Minute) {
+				if got, want := schedule.NextChange(at), scan(schedule, at); !got.Equal(want) {
+					t.Errorf("%s: NextChange(%s) = %s, scan finds %s", spec, at, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// settleEntry is a file waiting to stop changing
+type settleEntry struct {
+	due   time.Time
+	since time.Time
+	snap  fileSnapshot
+}
+
+// settleQueue holds files reported by the watcher until their size, mtime
+// and inode have held for SETTLE_SECONDS, then hands them to the worker.
+// Every new event for a file restarts its wait, and a file still changing
+// when it is due is checked again later instead of being skipped until the
+// next scan.
+type settleQueue struct {
+	mu      sync.Mutex
+	pending map[string]*settleEntry
+	settle  time.Duration
+	worker  *Worker
+	wake    chan struct{}
+}
+
+func newSettleQueue(config *Config, worker *Worker) *settleQueue {
+	return &settleQueue{
+		pending: make(map[string]*settleEntry),
+		settle:  time.Duration(config.SettleSeconds) * time.Second,
+		worker:  worker,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Add (re)starts the wait for a file. Safe to call from any goroutine.
+func (q *settleQueue) Add(filePath string) {
+	now := time.Now()
+	snap, _ := statSnapshot(filePath)
+
+	q.mu.Lock()
+	entry, ok := q.pending[filePath]
+	if !ok {
+		entry = &settleEntry{since: now}
+		q.pending[filePath] = entry
+	}
+	entry.due = now.Add(q.settle)
+	entry.snap = snap
+	filesSettling.Set(float64(len(q.pending)))
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks due files until the process exits
+func (q *settleQueue) Run() {
+	timer := time.NewTimer(q.settle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		}
+		next := q.checkDue(time.Now())
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// checkDue hands every due file that stopped changing to the worker and
+// returns how long to wait for the next one
+func (q *settleQueue) checkDue(now time.Time) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	next := q.settle
+	for filePath, entry := range q.pending {
+		if wait := entry.due.Sub(now); wait > 0 {
+			next = min(next, wait)
+			continue
+		}
+
+		snap, err := statSnapshot(filePath)
+		if err != nil {
+			// Gone, e.g. a download client's temporary file moved away
+			delete(q.pending, filePath)
+			continue
+		}
+		if snap != entry.snap {
+			// Still being written; look again after another settle period
+			entry.snap = snap
+			entry.due = now.Add(q.settle)
+			continue
+		}
+
+		delete(q.pending, filePath)
+		if waited := now.Sub(entry.since); waited > 2*q.settle {
+			log.Printf("%s settled after %s", filepath.Base(filePath), waited.Round(time.Second))
+		}
+		q.worker.Enqueue(filePath)
+	}
+	filesSettling.Set(float64(len(q.pending)))
+	return max(next, 100*time.Millisecond)
+}
+
+func statSnapshot(filePath string) (fileSnapshot, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fileSnapshot{}, err
+	}
+	if info.IsDir() {
+		return fileSnapshot{}, fmt.Errorf("%s is a directory", filePath)
+	}
+	return snapshotOf(info), nil
+}
+
+// validateIgnorePatterns checks IGNORE_PATTERNS for malformed globs
+func validateIgnorePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignore pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// isIgnoredPath reports whether any file or folder name on filePath below
+// WATCH_PATH matches one of IGNORE_PATTERNS, such as a download client's
+// temporary suffix or unpack folder
+func isIgnoredPath(filePath string, config *Config) bool {
+	if len(config.IgnorePatterns) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(config.WatchPath), filepath.Clean(filePath))
+	if err != nil || rel == "." {
+		return false
+	}
+	for _, name := range strings.Split(filepath.ToSlash(rel), "/") {
+		for _, pattern := range config.IgnorePatterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSettleQueueCheckDue(t *testing.T) {
+	config := newTestConfig(t)
+	config.SettleSeconds = 10
+	settle := 10 * time.Second
+	worker := NewWorker(config, newTestDB(t), newTestProfiles(t, config, &recordingTransport{}), nil, nil, nil)
+	q := newSettleQueue(config, worker)
+
+	dune := filepath.Join(config.WatchPath, "Dune.epub")
+	partial := filepath.Join(config.WatchPath, "Emma.epub.part")
+	writeTestFile(t, dune, "du")
+	writeTestFile(t, partial, "emma")
+	added := time.Now()
+	q.Add(dune)
+	q.Add(partial)
+	start := time.Now()
+
+	queued := func() int {
+		t.Helper()
+		return worker.paths.Len()
+	}
+
+	// Nothing is due yet; the wait is what's left of the settle period
+	if next := q.checkDue(start.Add(4 * time.Second)); next <= 5*time.Second || next > 6*time.Second {
+		t.Errorf("checkDue() before anything is due = %s, want about 6s", next)
+	}
+	if queued() != 0 || len(q.pending) != 2 {
+		t.Fatalf("%d queued, %d pending before anything is due, want 0 and 2", queued(), len(q.pending))
+	}
+
+	// Dune.epub is still being written when due: it is re-armed for another
+	// settle period. The temporary file moved away is dropped.
+	writeTestFile(t, dune, "dune")
+	if err := os.Remove(partial); err != nil {
+		t.Fatal(err)
+	}
+	due := start.Add(settle + time.Second)
+	if next := q.checkDue(due); next != settle {
+		t.Errorf("checkDue() after re-arming = %s, want %s", next, settle)
+	}
+	if queued() != 0 {
+		t.Fatal("a file still changing was handed to the worker")
+	}
+	entry, ok := q.pending[dune]
+	if !ok || len(q.pending) != 1 {
+		t.Fatalf("pending = %v, want only Dune.epub", q.pending)
+	}
+	if !entry.due.Equal(due.Add(settle)) || entry.snap != snapshotOf(statTestFile(t, dune)) {
+		t.Errorf("re-armed entry = %+v, want due %s with the new snapshot", entry, due.Add(settle))
+	}
+	if entry.since.Before(added) || entry.since.After(start) {
+		t.Errorf("re-arming moved since to %s, want the first event's time", entry.since)
+	}
+
+	// Not due again until the new settle period is over
+	q.checkDue(due.Add(settle / 2))
+	if queued() != 0 {
+		t.Fatal("Dune.epub was handed over before its new settle period ended")
+	}
+
+	// Unchanged once due, it goes to the worker
+	if next := q.checkDue(due.Add(settle)); next != settle {
+		t.Errorf("checkDue() with nothing pending = %s, want %s", next, settle)
+	}
+	if path, _, ok := worker.paths.Pop(); !ok || path != dune {
+		t.Fatalf("worker got %q, want Dune.epub", path)
+	}
+	if len(q.pending) != 0 {
+		t.Errorf("pending = %v after settling, want nothing", q.pending)
+	}
+
+	// An overdue check is never scheduled sooner than 100ms
+	q.Add(dune)
+	if next := q.checkDue(q.pending[dune].due.Add(-time.Millisecond)); next != 100*time.Millisecond {
+		t.Errorf("checkDue() just before due = %s, want 100ms", next)
+	}
+}
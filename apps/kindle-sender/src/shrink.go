@@ -0,0 +1,440 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PDF shrink steps, tried in the order given by SHRINK_PDF_STEPS
+const (
+	pdfStepCompress  = "compress"
+	pdfStepRasterize = "rasterize"
+	pdfStepSplit     = "split"
+)
+
+// maxShrinkPixels skips decoding images so large that they would exhaust
+// memory; they are copied unchanged. A decoded image takes up to 4 bytes per
+// pixel, so this keeps one under about 100 MB.
+const maxShrinkPixels = 25_000_000
+
+// scaleBandRows is how many source rows scaleImage converts at a time
+const scaleBandRows = 64
+
+// shrinkBook tries to bring path under maxSize, writing the result into dir.
+// A book that can't be shrunk as a whole may come back as several volumes.
+func shrinkBook(path string, maxSize int64, dir string, config *Config) ([]string, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".epub":
+		out, err := shrinkEPUB(path, maxSize, dir, config)
+		if err != nil {
+			return nil, err
+		}
+		return []string{out}, nil
+	case ".pdf":
+		return shrinkPDF(path, maxSize, dir, config)
+	default:
+		return nil, fmt.Errorf("shrinking %s files is not supported", ext)
+	}
+}
+
+// canShrink reports whether a book of this format can be shrunk, directly or
+// after conversion to EPUB. PDFs need Ghostscript or qpdf for at least one
+// of the SHRINK_PDF_STEPS.
+func canShrink(filePath string, config *Config) bool {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".epub":
+		return true
+	case ".pdf":
+		return len(availablePDFSteps(config)) > 0
+	}
+	return config.Converter != "none" && needsConversion(filePath, config)
+}
+
+// availablePDFSteps returns the SHRINK_PDF_STEPS whose tool is installed
+func availablePDFSteps(config *Config) []string {
+	var steps []string
+	for _, step := range config.ShrinkPDFSteps {
+		tool := config.GhostscriptPath
+		if step == pdfStepSplit {
+			tool = config.QPDFPath
+		}
+		if _, err := exec.LookPath(tool); err == nil {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+func validateShrinkConfig(config *Config) error {
+	for _, step := range config.ShrinkPDFSteps {
+		switch step {
+		case pdfStepCompress, pdfStepRasterize, pdfStepSplit:
+		default:
+			return fmt.Errorf("unknown PDF shrink step %q (expected compress, rasterize or split)", step)
+		}
+	}
+	return nil
+}
+
+// epubShrinkPass is one attempt at shrinking an EPUB, each more aggressive
+// than the last
+type epubShrinkPass struct {
+	maxDimension int
+	quality      int
+	stripFonts   bool
+}
+
+func shrinkEPUB(path string, maxSize int64, dir string, config *Config) (string, error) {
+	passes := []epubShrinkPass{
+		{maxDimension: config.ShrinkMaxImageDimension, quality: config.ShrinkJPEGQuality},
+		{maxDimension: config.ShrinkMaxImageDimension, quality: config.ShrinkJPEGQuality, stripFonts: true},
+		{maxDimension: config.ShrinkMaxImageDimension / 2, quality: config.ShrinkJPEGQuality * 2 / 3, stripFonts: true},
+	}
+
+	// The source may itself live in dir (a converted book), so write the
+	// result to its own subdirectory
+	outDir, err := os.MkdirTemp(dir, "shrink-")
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(outDir, filepath.Base(path))
+
+	var size int64
+	for _, pass := range passes {
+		if size, err = rewriteEPUB(path, out, pass); err != nil {
+			return "", fmt.Errorf("failed to rewrite EPUB: %w", err)
+		}
+		if size <= maxSize {
+			return out, nil
+		}
+	}
+	return "", fmt.Errorf("EPUB is still %.2f MB after recompressing images and stripping fonts", megabytes(size))
+}
+
+var (
+	fontFacePattern = regexp.MustCompile(`(?is)@font-face\s*\{[^}]*\}`)
+	opfItemPattern  = regexp.MustCompile(`(?is)<item\s[^>]*>`)
+	hrefPattern     = regexp.MustCompile(`(?is)href\s*=\s*["']([^"']*)["']`)
+)
+
+func isFontFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ttf", ".otf", ".woff", ".woff2":
+		return true
+	}
+	return false
+}
+
+// rewriteEPUB copies src to dst, recompressing images and optionally
+// dropping embedded fonts. It returns the size of dst.
+func rewriteEPUB(src, dst string, pass epubShrinkPass) (int64, error) {
+	archive, err := zip.OpenReader(src)
+	if err != nil {
+		return 0, err
+	}
+	defer archive.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	writer := zip.NewWriter(out)
+
+	// The mimetype entry must come first and be stored uncompressed
+	mimetype, err := writer.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	mimetype.Write([]byte("application/epub+zip"))
+
+	for _, f := range archive.File {
+		if f.Name == "mimetype" || (pass.stripFonts && isFontFile(f.Name)) {
+			continue
+		}
+
+		ext := strings.ToLower(filepath.Ext(f.Name))
+		var transform func([]byte) []byte
+		switch {
+		case ext == ".jpg" || ext == ".jpeg" || ext == ".png":
+			transform = func(data []byte) []byte { return shrinkImage(data, pass) }
+		case pass.stripFonts && ext == ".css":
+			transform = func(data []byte) []byte { return fontFacePattern.ReplaceAll(data, nil) }
+		case pass.stripFonts && ext == ".opf":
+			transform = removeFontItems
+		}
+
+		if transform == nil {
+			// Copy untouched entries without recompressing them
+			raw, err := f.OpenRaw()
+			if err != nil {
+				return 0, err
+			}
+			w, err := writer.CreateRaw(&f.FileHeader)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := io.Copy(w, raw); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return 0, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return 0, err
+		}
+		w, err := writer.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified})
+		if err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(transform(data)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	info, err := out.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// removeFontItems drops font entries from the OPF manifest
+func removeFontItems(opf []byte) []byte {
+	return opfItemPattern.ReplaceAllFunc(opf, func(item []byte) []byte {
+		href := hrefPattern.FindSubmatch(item)
+		if href != nil && isFontFile(string(href[1])) {
+			return nil
+		}
+		return item
+	})
+}
+
+// shrinkImage downscales and re-encodes a JPEG or PNG image, keeping the
+// original when that doesn't make it smaller
+func shrinkImage(data []byte, pass epubShrinkPass) []byte {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") || cfg.Width*cfg.Height > maxShrinkPixels {
+		return data
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+
+	if longest := max(cfg.Width, cfg.Height); pass.maxDimension > 0 && longest > pass.maxDimension {
+		scale := float64(pass.maxDimension) / float64(longest)
+		width := max(1, int(math.Round(float64(cfg.Width)*scale)))
+		height := max(1, int(math.Round(float64(cfg.Height)*scale)))
+		img = scaleImage(img, width, height)
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: pass.quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil || buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// scaleImage downsamples src to width x height by averaging the source
+// pixels that fall into each destination pixel. Source rows are converted a
+// band at a time, so no full-size copy of the image is made.
+func scaleImage(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	var in *image.RGBA
+	bandStart, bandEnd := 0, 0
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, (y+1)*srcHeight/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		// Convert the next band when the rows of this pixel aren't in it
+		if y0 < bandStart || y1 > bandEnd {
+			bandStart, bandEnd = y0, min(srcHeight, y0+max(scaleBandRows, y1-y0))
+			band := image.Rect(0, 0, srcWidth, bandEnd-bandStart)
+			if in == nil || in.Rect.Dy() < band.Dy() {
+				in = image.NewRGBA(band)
+			}
+			draw.Draw(in, band, src, image.Pt(bounds.Min.X, bounds.Min.Y+bandStart), draw.Src)
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, (x+1)*srcWidth/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := in.Pix[(sy-bandStart)*in.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					sum[0] += int(p[0])
+					sum[1] += int(p[1])
+					sum[2] += int(p[2])
+					sum[3] += int(p[3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			o := out.Pix[y*out.Stride+x*4:]
+			for i := range sum {
+				o[i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return out
+}
+
+// shrinkPDF runs the SHRINK_PDF_STEPS in order until the PDF fits
+func shrinkPDF(path string, maxSize int64, dir string, config *Config) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	current, size := path, info.Size()
+	timeout := time.Duration(config.ConvertTimeout) * time.Second
+
+	var failures []string
+	for _, step := range availablePDFSteps(config) {
+		if step == pdfStepSplit {
+			volumes, err := splitPDF(current, size, maxSize, dir, config)
+			if err == nil {
+				return volumes, nil
+			}
+			failures = append(failures, fmt.Sprintf("split: %v", err))
+			continue
+		}
+
+		out := filepath.Join(dir, step+".pdf")
+		args := []string{"-q", "-dSAFER", "-o", out}
+		if step == pdfStepCompress {
+			args = append(args, "-sDEVICE=pdfwrite", "-dPDFSETTINGS=/ebook", "-dCompatibilityLevel=1.5")
+		} else {
+			// Render every page to a JPEG image, which also flattens heavy
+			// vector artwork and embedded fonts
+			args = append(args, "-sDEVICE=pdfimage8", "-r150", "-sCompression=JPEG", "-dJPEGQ="+strconv.Itoa(config.ShrinkJPEGQuality))
+		}
+		if _, err := runTool(timeout, nil, config.GhostscriptPath, append(args, current)...); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", step, err))
+			continue
+		}
+
+		info, err := os.Stat(out)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", step, err))
+			continue
+		}
+		if info.Size() < size {
+			current, size = out, info.Size()
+		}
+		if size <= maxSize {
+			return []string{current}, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: still %.2f MB", step, megabytes(size)))
+	}
+	if len(failures) == 0 {
+		return nil, fmt.Errorf("no PDF shrink step can run; Ghostscript (%s) and qpdf (%s) are not installed", config.GhostscriptPath, config.QPDFPath)
+	}
+	return nil, fmt.Errorf("%s", strings.Join(failures, "; "))
+}
+
+// splitPDF cuts a PDF into page ranges that each fit under maxSize
+func splitPDF(path string, size, maxSize int64, dir string, config *Config) ([]string, error) {
+	timeout := time.Duration(config.ConvertTimeout) * time.Second
+	output, err := runTool(timeout, nil, config.QPDFPath, "--show-npages", path)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil || pages < 1 {
+		return nil, fmt.Errorf("failed to count pages: %q", strings.TrimSpace(string(output)))
+	}
+
+	// Aim for volumes at 90% of the limit, then halve the page count per
+	// volume whenever one still comes out too large
+	volumes := int(math.Ceil(float64(size) / (float64(maxSize) * 0.9)))
+	perVolume := int(math.Ceil(float64(pages) / float64(volumes)))
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	for {
+		if (pages+perVolume-1)/perVolume > config.ShrinkMaxVolumes {
+			return nil, fmt.Errorf("would need more than %d volumes", config.ShrinkMaxVolumes)
+		}
+
+		splitDir, err := os.MkdirTemp(dir, "split-")
+		if err != nil {
+			return nil, err
+		}
+		var parts []string
+		tooLarge := false
+		for first := 1; first <= pages; first += perVolume {
+			last := min(first+perVolume-1, pages)
+			part := filepath.Join(splitDir, fmt.Sprintf("part%03d.pdf", len(parts)+1))
+			pageRange := fmt.Sprintf("%d-%d", first, last)
+			if _, err := runTool(timeout, nil, config.QPDFPath, "--empty", "--pages", path, pageRange, "--", part); err != nil {
+				return nil, err
+			}
+			info, err := os.Stat(part)
+			if err != nil {
+				return nil, err
+			}
+			if info.Size() > maxSize {
+				if perVolume == 1 {
+					return nil, fmt.Errorf("page %d alone is %.2f MB", first, megabytes(info.Size()))
+				}
+				tooLarge = true
+				break
+			}
+			parts = append(parts, part)
+		}
+		if tooLarge {
+			os.RemoveAll(splitDir)
+			perVolume = (perVolume + 1) / 2
+			continue
+		}
+
+		// Name the volumes after the book now that their number is known
+		for i, part := range parts {
+			named := filepath.Join(splitDir, fmt.Sprintf("%s (%d of %d).pdf", stem, i+1, len(parts)))
+			if err := os.Rename(part, named); err != nil {
+				return nil, err
+			}
+			parts[i] = named
+		}
+		return parts, nil
+	}
+}
+
+func megabytes(size int64) float64 {
+	return float64(size) / (1024 * 1024)
+}
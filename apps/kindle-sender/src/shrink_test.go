@@ -0,0 +1,73 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestScaleImage(t *testing.T) {
+	// Taller than several bands, with a colour change that doesn't fall on
+	// a band boundary
+	const width, height, split = 300, 500, 230
+	src := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio444)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			yy, cb, cr := color.RGBToYCbCr(200, 30, 30)
+			if y >= split {
+				yy, cb, cr = color.RGBToYCbCr(30, 30, 200)
+			}
+			src.Y[src.YOffset(x, y)], src.Cb[src.COffset(x, y)], src.Cr[src.COffset(x, y)] = yy, cb, cr
+		}
+	}
+
+	out := scaleImage(src, 30, 50)
+	if got := out.Bounds(); got != image.Rect(0, 0, 30, 50) {
+		t.Fatalf("bounds = %v, want 30x50", got)
+	}
+	for _, tt := range []struct {
+		y    int
+		want color.RGBA
+	}{
+		{0, color.RGBA{200, 30, 30, 255}},
+		{22, color.RGBA{200, 30, 30, 255}},
+		{23, color.RGBA{30, 30, 200, 255}},
+		{49, color.RGBA{30, 30, 200, 255}},
+	} {
+		got := color.RGBAModel.Convert(out.At(15, tt.y)).(color.RGBA)
+		if diff(got.R, tt.want.R) > 3 || diff(got.G, tt.want.G) > 3 || diff(got.B, tt.want.B) > 3 || got.A != 255 {
+			t.Errorf("pixel at row %d = %v, want %v", tt.y, got, tt.want)
+		}
+	}
+}
+
+func diff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestCanShrinkNeedsPDFTools(t *testing.T) {
+	config := &Config{
+		ShrinkPDFSteps:  []string{pdfStepCompress, pdfStepSplit},
+		GhostscriptPath: "/nonexistent/gs",
+		QPDFPath:        "/nonexistent/qpdf",
+		Converter:       "none",
+	}
+	if canShrink("book.pdf", config) {
+		t.Error("canShrink(book.pdf) = true without Ghostscript or qpdf")
+	}
+	if !canShrink("book.epub", config) {
+		t.Error("canShrink(book.epub) = false; EPUBs are shrunk natively")
+	}
+
+	// Either tool is enough for the steps that use it
+	config.QPDFPath = "sh"
+	if got := availablePDFSteps(config); len(got) != 1 || got[0] != pdfStepSplit {
+		t.Errorf("availablePDFSteps() = %v, want [split]", got)
+	}
+	if !canShrink("book.pdf", config) {
+		t.Error("canShrink(book.pdf) = false with qpdf available")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTP TLS modes
+const (
+	smtpTLSStartTLS = "starttls"
+	smtpTLSImplicit = "tls"
+	smtpTLSNone     = "none"
+)
+
+// SMTP authentication mechanisms
+const (
+	smtpAuthPlain   = "plain"
+	smtpAuthXOAUTH2 = "xoauth2"
+	smtpAuthNone    = "none"
+)
+
+const (
+	smtpDialTimeout = 30 * time.Second
+	// smtpSessionTimeout bounds a whole delivery so a stalled relay can't
+	// block the worker
+	smtpSessionTimeout = 10 * time.Minute
+)
+
+// smtpTransport emails the book through the configured SMTP relay
+type smtpTransport struct {
+	config    *Config
+	tlsConfig *tls.Config
+	tokens    *oauth2TokenSource
+}
+
+func newSMTPTransport(config *Config) (*smtpTransport, error) {
+	switch config.SMTPTLSMode {
+	case smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+	default:
+		return nil, fmt.Errorf("unknown SMTP_TLS_MODE %q (expected starttls, tls or none)", config.SMTPTLSMode)
+	}
+
+	tlsConfig, err := loadTLSConfig(config.SMTPHost, config.SMTPCAFile)
+	if err != nil {
+		return nil, err
+	}
+	t := &smtpTransport{config: config, tlsConfig: tlsConfig}
+
+	switch config.SMTPAuth {
+	case smtpAuthPlain, smtpAuthNone:
+	case smtpAuthXOAUTH2:
+		if config.OAuth2ClientID == "" || config.OAuth2RefreshToken == "" {
+			return nil, fmt.Errorf("OAUTH2_CLIENT_ID and OAUTH2_REFRESH_TOKEN are required for XOAUTH2")
+		}
+		t.tokens = newOAuth2TokenSource(config)
+	default:
+		return nil, fmt.Errorf("unknown SMTP_AUTH %q (expected plain, xoauth2 or none)", config.SMTPAuth)
+	}
+	return t, nil
+}
+
+// loadTLSConfig verifies serverName against the system roots, plus the
+// certificates in caFile if set (e.g. for a relay with a private CA)
+func loadTLSConfig(serverName, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+func (t *smtpTransport) Name() string { return "smtp" }
+
+func (t *smtpTransport) Deliver(msg *EmailMessage) error {
+	// Open the attachments before connecting so a missing file fails fast
+	attachments, closeAttachments, err := openAttachments(msg)
+	if err != nil {
+		return err
+	}
+	defer closeAttachments()
+
+	client, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := t.authenticate(client); err != nil {
+		return err
+	}
+	if err := client.Mail(msg.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	// Stream the message straight into the DATA command so memory use does
+	// not grow with the size of the book
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if err := writeMessage(data, msg, attachments); err != nil {
+		data.Close()
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// dial connects to the relay and sets up TLS according to SMTP_TLS_MODE
+func (t *smtpTransport) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(t.config.SMTPHost, t.config.SMTPPort)
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+
+	var conn net.Conn
+	var err error
+	if t.config.SMTPTLSMode == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(smtpSessionTimeout))
+
+	client, err := smtp.NewClient(conn, t.config.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if t.config.SMTPTLSMode == smtpTLSStartTLS {
+		// Never fall back to plaintext when STARTTLS was asked for
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("SMTP server %s does not offer STARTTLS", addr)
+		}
+		if err := client.StartTLS(t.tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (t *smtpTransport) authenticate(client *smtp.Client) error {
+	if t.config.SMTPAuth == smtpAuthNone {
+		return nil
+	}
+	// Never send unauthenticated when credentials are configured
+	if ok, _ := client.Extension("AUTH"); !ok {
+		return fmt.Errorf("SMTP server %s does not offer AUTH; set SMTP_AUTH=none to send without authenticating", t.config.SMTPHost)
+	}
+
+	if t.config.SMTPAuth != smtpAuthXOAUTH2 {
+		return client.Auth(smtp.PlainAuth("", t.config.SMTPUser, t.config.SMTPPassword, t.config.SMTPHost))
+	}
+
+	token, err := t.tokens.Token()
+	if err != nil {
+		return fmt.Errorf("failed to get OAuth2 access token: %w", err)
+	}
+	err = client.Auth(&xoauth2Auth{username: t.config.SMTPUser, token: token})
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && tpErr.Code == 535 {
+		// The token may have been revoked early; fetch a fresh one next time
+		t.tokens.Invalidate()
+	}
+	return err
+}
+
+// xoauth2Auth implements the SASL XOAUTH2 mechanism used by Gmail and
+// Microsoft 365
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like PlainAuth, refuse to send the bearer token in the clear
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	resp := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.username, a.token)
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sends a JSON error as a challenge; an empty response
+		// completes the exchange so it can report the failure
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// oauth2TokenSource exchanges a refresh token for access tokens and caches
+// them until shortly before they expire
+type oauth2TokenSource struct {
+	clientID     string
+	clientSecret string
+	tokenURL     string
+	client       *http.Client
+
+	mu           sync.Mutex
+	refreshToken string
+	accessToken  string
+	expiry       time.Time
+}
+
+func newOAuth2TokenSource(config *Config) *oauth2TokenSource {
+	return &oauth2TokenSource{
+		clientID:     config.OAuth2ClientID,
+		clientSecret: config.OAuth2ClientSecret,
+		refreshToken: config.OAuth2RefreshToken,
+		tokenURL:     config.OAuth2TokenURL,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Token returns a valid access token, refreshing it if needed
+func (s *oauth2TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.accessToken != "" && time.Now().Add(time.Minute).Before(s.expiry) {
+		return s.accessToken, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.refreshToken},
+		"client_id":     {s.clientID},
+	}
+	if s.clientSecret != "" {
+		form.Set("client_secret", s.clientSecret)
+	}
+
+	resp, err := s.client.PostForm(s.tokenURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned status %d: %s %s", resp.StatusCode, result.Error, result.ErrorDescription)
+	}
+
+	if result.ExpiresIn <= 0 {
+		result.ExpiresIn = 3600
+	}
+	s.accessToken = result.AccessToken
+	s.expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	// Some providers rotate the refresh token on every use
+	if result.RefreshToken != "" {
+		s.refreshToken = result.RefreshToken
+	}
+	return s.accessToken, nil
+}
+
+// Invalidate drops the cached access token
+func (s *oauth2TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessToken = ""
+}
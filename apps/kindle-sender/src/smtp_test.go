@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpStandIn is a minimal SMTP server accepting one message per session
+type smtpStandIn struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	implicit  bool
+	startTLS  bool
+	// auth lists the advertised mechanisms; AUTH is not offered when empty
+	auth string
+
+	mu       sync.Mutex
+	authLine string
+	usedTLS  bool
+	data     string
+}
+
+func startSMTPStandIn(t *testing.T, tlsConfig *tls.Config, implicit, startTLS bool, auth string) *smtpStandIn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: listener, tlsConfig: tlsConfig, implicit: implicit, startTLS: startTLS, auth: auth}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) Port() string {
+	return fmt.Sprint(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	secure := s.implicit
+	if secure {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 127.0.0.1 ESMTP stand-in")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			extensions := []string{"127.0.0.1", "8BITMIME"}
+			if s.startTLS && !secure {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if s.auth != "" {
+				extensions = append(extensions, "AUTH "+s.auth)
+			}
+			for i, ext := range extensions {
+				sep := "-"
+				if i == len(extensions)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, ext)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 Ready to start TLS")
+			conn = tls.Server(conn, s.tlsConfig)
+			tp = textproto.NewConn(conn)
+			secure = true
+		case "AUTH":
+			s.mu.Lock()
+			s.authLine = args
+			s.mu.Unlock()
+			tp.PrintfLine("235 2.7.0 Accepted")
+		case "MAIL", "RCPT":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.data = string(data)
+			s.usedTLS = secure
+			s.mu.Unlock()
+			tp.PrintfLine("250 Queued")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+// received returns the AUTH arguments and message of the last session
+func (s *smtpStandIn) received() (authLine, data string, usedTLS bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authLine, s.data, s.usedTLS
+}
+
+func newTestSMTPConfig(t *testing.T, port, mode, caFile, auth string) *Config {
+	t.Helper()
+	return &Config{
+		SMTPHost:     "127.0.0.1",
+		SMTPPort:     port,
+		SMTPUser:     "sender@example.com",
+		SMTPPassword: "secret",
+		SMTPTLSMode:  mode,
+		SMTPCAFile:   caFile,
+		SMTPAuth:     auth,
+	}
+}
+
+func newTestSMTPMessage(t *testing.T) *EmailMessage {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "book.epub")
+	writeTestFile(t, path, "book contents")
+	return &EmailMessage{
+		From:        "sender@example.com",
+		To:          "reader@kindle.com",
+		Subject:     "Book: Test",
+		Body:        "Automatically sent by Kindle Sender",
+		Attachments: []EmailAttachment{{Path: path, ContentType: "application/epub+zip"}},
+	}
+}
+
+func TestSMTPTransportTLSModes(t *testing.T) {
+	serverTLS, caFile := newTestCertificate(t)
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("refresh_token") != "refresh" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"access","expires_in":3600}`)
+	}))
+	defer tokenServer.Close()
+
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00sender@example.com\x00secret"))
+	xoauth2 := base64.StdEncoding.EncodeToString([]byte("user=sender@example.com\x01auth=Bearer access\x01\x01"))
+
+	tests := []struct {
+		name     string
+		mode     string
+		auth     string
+		wantAuth string
+		wantTLS  bool
+	}{
+		{name: "starttls plain", mode: smtpTLSStartTLS, auth: smtpAuthPlain, wantAuth: "PLAIN " + plain, wantTLS: true},
+		{name: "implicit tls plain", mode: smtpTLSImplicit, auth: smtpAuthPlain, wantAuth: "PLAIN " + plain, wantTLS: true},
+		{name: "none plain", mode: smtpTLSNone, auth: smtpAuthPlain, wantAuth: "PLAIN " + plain},
+		{name: "starttls xoauth2", mode: smtpTLSStartTLS, auth: smtpAuthXOAUTH2, wantAuth: "XOAUTH2 " + xoauth2, wantTLS: true},
+		{name: "none without auth", mode: smtpTLSNone, auth: smtpAuthNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startSMTPStandIn(t, serverTLS, tt.mode == smtpTLSImplicit, tt.mode == smtpTLSStartTLS, "PLAIN XOAUTH2")
+			config := newTestSMTPConfig(t, server.Port(), tt.mode, caFile, tt.auth)
+			config.OAuth2ClientID = "client"
+			config.OAuth2RefreshToken = "refresh"
+			config.OAuth2TokenURL = tokenServer.URL
+
+			transport, err := newSMTPTransport(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := transport.Deliver(newTestSMTPMessage(t)); err != nil {
+				t.Fatalf("Deliver: %v", err)
+			}
+
+			authLine, data, usedTLS := server.received()
+			if authLine != tt.wantAuth {
+				t.Errorf("AUTH %q, want %q", authLine, tt.wantAuth)
+			}
+			if usedTLS != tt.wantTLS {
+				t.Errorf("message sent over TLS = %v, want %v", usedTLS, tt.wantTLS)
+			}
+			if !strings.Contains(data, "Subject: Book: Test\n") {
+				t.Errorf("message missing subject:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestSMTPTransportRequiresAuth(t *testing.T) {
+	serverTLS, caFile := newTestCertificate(t)
+	server := startSMTPStandIn(t, serverTLS, false, true, "")
+	config := newTestSMTPConfig(t, server.Port(), smtpTLSStartTLS, caFile, smtpAuthPlain)
+
+	transport, err := newSMTPTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transport.Deliver(newTestSMTPMessage(t))
+	if err == nil || !strings.Contains(err.Error(), "does not offer AUTH") {
+		t.Fatalf("Deliver() error = %v, want missing AUTH", err)
+	}
+	if _, data, _ := server.received(); data != "" {
+		t.Fatal("message was sent without authenticating")
+	}
+}
+
+func TestSMTPTransportRequiresSTARTTLS(t *testing.T) {
+	serverTLS, caFile := newTestCertificate(t)
+	server := startSMTPStandIn(t, serverTLS, false, false, "PLAIN")
+	config := newTestSMTPConfig(t, server.Port(), smtpTLSStartTLS, caFile, smtpAuthPlain)
+
+	transport, err := newSMTPTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transport.Deliver(newTestSMTPMessage(t))
+	if err == nil || !strings.Contains(err.Error(), "does not offer STARTTLS") {
+		t.Fatalf("Deliver() error = %v, want missing STARTTLS", err)
+	}
+	if authLine, _, _ := server.received(); authLine != "" {
+		t.Fatal("credentials were sent in the clear")
+	}
+}
+
+func TestOAuth2TokenSourceRefresh(t *testing.T) {
+	var mu sync.Mutex
+	var used []string
+	valid, issued, rotate, expiresIn := "refresh-1", 0, true, 3600
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		refresh := r.FormValue("refresh_token")
+		used = append(used, refresh)
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if refresh != valid {
+			http.Error(w, `{"error":"invalid_grant","error_description":"refresh token revoked"}`, http.StatusBadRequest)
+			return
+		}
+		issued++
+		reply := map[string]interface{}{"access_token": fmt.Sprintf("access-%d", issued), "expires_in": expiresIn}
+		if rotate {
+			valid = fmt.Sprintf("refresh-%d", issued+1)
+			reply["refresh_token"] = valid
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+	}))
+	defer tokenServer.Close()
+
+	source := newOAuth2TokenSource(&Config{
+		OAuth2ClientID:     "client",
+		OAuth2ClientSecret: "secret",
+		OAuth2RefreshToken: "refresh-1",
+		OAuth2TokenURL:     tokenServer.URL,
+	})
+	token := func(want string) {
+		t.Helper()
+		got, err := source.Token()
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if got != want {
+			t.Errorf("Token() = %q, want %q", got, want)
+		}
+	}
+	requests := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Join(used, ",") != strings.Join(want, ",") {
+			t.Errorf("refresh tokens used = %v, want %v", used, want)
+		}
+	}
+
+	// The access token is cached until it is invalidated
+	token("access-1")
+	token("access-1")
+	requests("refresh-1")
+
+	// and the next refresh uses the rotated refresh token
+	source.Invalidate()
+	token("access-2")
+	requests("refresh-1", "refresh-2")
+
+	// A response without a refresh token keeps the current one
+	mu.Lock()
+	rotate = false
+	mu.Unlock()
+	source.Invalidate()
+	token("access-3")
+	source.Invalidate()
+	token("access-4")
+	requests("refresh-1", "refresh-2", "refresh-3", "refresh-3")
+
+	// Tokens expiring within a minute are refreshed straight away
+	mu.Lock()
+	expiresIn = 30
+	mu.Unlock()
+	source.Invalidate()
+	token("access-5")
+	token("access-6")
+
+	// A revoked refresh token fails with the provider's error and isn't
+	// replaced, so a fixed grant works again
+	mu.Lock()
+	valid = "refresh-new"
+	mu.Unlock()
+	if _, err := source.Token(); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("Token() with a revoked refresh token: %v, want invalid_grant", err)
+	}
+	mu.Lock()
+	valid = "refresh-3"
+	mu.Unlock()
+	token("access-7")
+}
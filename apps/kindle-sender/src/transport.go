@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Transport delivers a prepared message to its destination
+type Transport interface {
+	// Name identifies the transport in logs
+	Name() string
+	// Deliver sends the message and its attachments. A transport handing
+	// attachments over one by one returns a *partialDeliveryError when it
+	// fails after some of them went out.
+	Deliver(msg *EmailMessage) error
+}
+
+// partialDeliveryError is a delivery that failed after the first Delivered
+// attachments of the message went out
+type partialDeliveryError struct {
+	Delivered int
+	Err       error
+}
+
+func (e *partialDeliveryError) Error() string { return e.Err.Error() }
+
+func (e *partialDeliveryError) Unwrap() error { return e.Err }
+
+// newTransport builds the transport selected by TRANSPORT
+func newTransport(config *Config) (Transport, error) {
+	switch config.Transport {
+	case "smtp":
+		t, err := newSMTPTransport(config)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case "maildir":
+		if config.TransportPath == "" {
+			return nil, fmt.Errorf("TRANSPORT_PATH is required for the maildir transport")
+		}
+		return &maildirTransport{path: config.TransportPath}, nil
+	case "mbox":
+		if config.TransportPath == "" {
+			return nil, fmt.Errorf("TRANSPORT_PATH is required for the mbox transport")
+		}
+		return &mboxTransport{path: config.TransportPath}, nil
+	case "directory":
+		if config.TransportPath == "" {
+			return nil, fmt.Errorf("TRANSPORT_PATH is required for the directory transport")
+		}
+		return &directoryTransport{path: config.TransportPath}, nil
+	case "webhook":
+		if config.WebhookURL == "" {
+			return nil, fmt.Errorf("TRANSPORT_WEBHOOK_URL is required for the webhook transport")
+		}
+		return &webhookTransport{
+			url:    config.WebhookURL,
+			token:  config.WebhookToken,
+			client: &http.Client{Timeout: time.Duration(config.WebhookTimeout) * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q (expected smtp, maildir, mbox, directory or webhook)", config.Transport)
+	}
+}
+
+// maildirTransport writes each message as a file in a Maildir, useful for
+// testing without a mail server and for archival
+type maildirTransport struct {
+	path string
+}
+
+var maildirCounter uint64
+
+func (t *maildirTransport) Name() string { return "maildir" }
+
+func (t *maildirTransport) Deliver(msg *EmailMessage) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.path, sub), 0755); err != nil {
+			return fmt.Errorf("failed to create maildir: %w", err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().Unix(), os.Getpid(), atomic.AddUint64(&maildirCounter, 1), hostname)
+	tmpPath := filepath.Join(t.path, "tmp", name)
+
+	// Maildir delivery: write to tmp/ then rename into new/ once complete
+	if err := writeMessageFile(tmpPath, msg); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(t.path, "new", name))
+}
+
+// mboxTransport appends each message to a single mboxrd file
+type mboxTransport struct {
+	path string
+}
+
+func (t *mboxTransport) Name() string { return "mbox" }
+
+func (t *mboxTransport) Deliver(msg *EmailMessage) error {
+	attachments, closeAttachments, err := openAttachments(msg)
+	if err != nil {
+		return err
+	}
+	defer closeAttachments()
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("failed to create mbox directory: %w", err)
+	}
+	mbox, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open mbox: %w", err)
+	}
+	defer mbox.Close()
+
+	// Remember where this message starts so a failed write can be rolled back
+	info, err := mbox.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat mbox: %w", err)
+	}
+	start := info.Size()
+
+	if err := t.writeMessage(mbox, msg, attachments); err != nil {
+		mbox.Truncate(start)
+		return err
+	}
+	return mbox.Sync()
+}
+
+func (t *mboxTransport) writeMessage(mbox io.Writer, msg *EmailMessage, attachments []io.Reader) error {
+	out := bufio.NewWriter(mbox)
+	fmt.Fprintf(out, "From %s %s\n", msg.From, time.Now().UTC().Format(time.ANSIC))
+
+	// Convert the CRLF message to LF line endings and quote "From " lines
+	// as it streams through
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeMessage(pw, msg, attachments))
+	}()
+	reader := bufio.NewReader(pr)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				out.WriteString(">")
+			}
+			out.Write(line)
+			out.WriteString("\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pr.CloseWithError(err)
+			return fmt.Errorf("failed to write mbox message: %w", err)
+		}
+	}
+	out.WriteString("\n")
+
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("failed to write mbox: %w", err)
+	}
+	return nil
+}
+
+// directoryTransport copies the books into a target directory, e.g. a folder
+// synced to another e-reader
+type directoryTransport struct {
+	path string
+}
+
+func (t *directoryTransport) Name() string { return "directory" }
+
+func (t *directoryTransport) Deliver(msg *EmailMessage) error {
+	if err := os.MkdirAll(t.path, 0755); err != nil {
+		return fmt.Errorf("failed to create target directory: %w", err)
+	}
+	for i, attachment := range msg.Attachments {
+		if err := t.copy(attachment.Path); err != nil {
+			return &partialDeliveryError{Delivered: i, Err: err}
+		}
+	}
+	return nil
+}
+
+func (t *directoryTransport) copy(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open attachment: %w", err)
+	}
+	defer src.Close()
+
+	// Copy under a temporary name so readers never see a partial file
+	dst, err := os.CreateTemp(t.path, ".kindle-sender-*")
+	if err != nil {
+		return fmt.Errorf("failed to create target file: %w", err)
+	}
+	defer os.Remove(dst.Name())
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	return os.Rename(dst.Name(), filepath.Join(t.path, filepath.Base(path)))
+}
+
+// webhookTransport POSTs each raw book to an HTTP endpoint with the message
+// details in headers
+type webhookTransport struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (t *webhookTransport) Name() string { return "webhook" }
+
+func (t *webhookTransport) Deliver(msg *EmailMessage) error {
+	for i, attachment := range msg.Attachments {
+		if err := t.post(msg, attachment); err != nil {
+			return &partialDeliveryError{Delivered: i, Err: err}
+		}
+	}
+	return nil
+}
+
+func (t *webhookTransport) post(msg *EmailMessage, attachment EmailAttachment) error {
+	file, err := os.Open(attachment.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open attachment: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat attachment: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", t.url, file)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", attachment.ContentType)
+	req.Header.Set("X-Kindle-Sender-Filename", filepath.Base(attachment.Path))
+	req.Header.Set("X-Kindle-Sender-Subject", msg.Subject)
+	req.Header.Set("X-Kindle-Sender-To", msg.To)
+	if t.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.token))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// writeMessageFile writes the full MIME message to path
+func writeMessageFile(path string, msg *EmailMessage) error {
+	attachments, closeAttachments, err := openAttachments(msg)
+	if err != nil {
+		return err
+	}
+	defer closeAttachments()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create message file: %w", err)
+	}
+	if err := writeMessage(out, msg, attachments); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// openAttachments opens every attachment of msg, so a missing file fails
+// before anything is sent. The returned function closes them.
+func openAttachments(msg *EmailMessage) ([]io.Reader, func(), error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	readers := make([]io.Reader, 0, len(msg.Attachments))
+	for _, attachment := range msg.Attachments {
+		file, err := os.Open(attachment.Path)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to open attachment: %w", err)
+		}
+		files = append(files, file)
+		readers = append(readers, file)
+	}
+	return readers, closeAll, nil
+}
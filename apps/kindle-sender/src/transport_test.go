@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestTransportMessage returns a message attaching a file for each name,
+// holding the name as its content. Names starting with "missing" are not
+// created.
+func newTestTransportMessage(t *testing.T, body string, names ...string) *EmailMessage {
+	t.Helper()
+	dir := t.TempDir()
+	msg := &EmailMessage{
+		From:    "sender@example.com",
+		To:      "reader@kindle.com",
+		Subject: "Book: Test",
+		Body:    body,
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if !strings.HasPrefix(name, "missing") {
+			writeTestFile(t, path, name)
+		}
+		msg.Attachments = append(msg.Attachments, EmailAttachment{Path: path, ContentType: "application/epub+zip"})
+	}
+	return msg
+}
+
+// readDirNames lists the names in dir, or nil if it doesn't exist
+func readDirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestNewTransportErrors(t *testing.T) {
+	for _, config := range []*Config{
+		{Transport: "maildir"},
+		{Transport: "mbox"},
+		{Transport: "directory"},
+		{Transport: "webhook"},
+		{Transport: "carrier-pigeon"},
+	} {
+		if _, err := newTransport(config); err == nil {
+			t.Errorf("newTransport(%s) succeeded", config.Transport)
+		}
+	}
+}
+
+func TestMaildirTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	transport, err := newTransport(&Config{Transport: "maildir", TransportPath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := transport.Deliver(newTestTransportMessage(t, "Enjoy", "Dune.epub")); err != nil {
+			t.Fatalf("Deliver: %v", err)
+		}
+	}
+	// A missing attachment fails before anything is written
+	if err := transport.Deliver(newTestTransportMessage(t, "Enjoy", "missing.epub")); err == nil {
+		t.Error("Deliver with a missing attachment succeeded")
+	}
+
+	delivered := readDirNames(t, filepath.Join(dir, "new"))
+	if len(delivered) != 2 || delivered[0] == delivered[1] {
+		t.Fatalf("new/ holds %v, want two messages", delivered)
+	}
+	if leftover := readDirNames(t, filepath.Join(dir, "tmp")); len(leftover) != 0 {
+		t.Errorf("tmp/ holds %v, want nothing", leftover)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "new", delivered[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: reader@kindle.com\r\n", "Subject: Book: Test\r\n", "filename=Dune.epub\r\n", "RHVuZS5lcHVi\r\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("message does not contain %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestMboxTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail", "kindle.mbox")
+	transport, err := newTransport(&Config{Transport: "mbox", TransportPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines starting with "From " in a message are quoted
+	for i := 0; i < 2; i++ {
+		if err := transport.Deliver(newTestTransportMessage(t, "From the author\n>From the editor", "Dune.epub")); err != nil {
+			t.Fatalf("Deliver: %v", err)
+		}
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.Deliver(newTestTransportMessage(t, "Enjoy", "Emma.epub", "missing.epub")); err == nil {
+		t.Error("Deliver with a missing attachment succeeded")
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Error("a failed delivery changed the mbox")
+	}
+
+	mbox := string(after)
+	if strings.Contains(mbox, "\r") {
+		t.Error("mbox has CRLF line endings")
+	}
+	if n := strings.Count("\n"+mbox, "\nFrom sender@example.com "); n != 2 {
+		t.Errorf("mbox has %d message separators, want 2:\n%s", n, mbox)
+	}
+	if n := strings.Count(mbox, "\n>From the author\n"); n != 2 {
+		t.Errorf("mbox quotes %d From lines, want 2:\n%s", n, mbox)
+	}
+	if n := strings.Count(mbox, "\n>>From the editor\n"); n != 2 {
+		t.Errorf("mbox quotes %d quoted From lines, want 2:\n%s", n, mbox)
+	}
+}
+
+func TestDirectoryTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Books")
+	transport, err := newTransport(&Config{Transport: "directory", TransportPath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := transport.Deliver(newTestTransportMessage(t, "", "Dune.epub", "Emma.epub")); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if got := strings.Join(readDirNames(t, dir), ","); got != "Dune.epub,Emma.epub" {
+		t.Errorf("directory holds %s, want both books", got)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "Dune.epub")); err != nil || string(data) != "Dune.epub" {
+		t.Errorf("Dune.epub = %q, %v, want the book's content", data, err)
+	}
+
+	// The second book is missing: the first went out, the third wasn't tried
+	err = transport.Deliver(newTestTransportMessage(t, "", "Ulysses.epub", "missing.epub", "Walden.epub"))
+	var partial *partialDeliveryError
+	if !errors.As(err, &partial) || partial.Delivered != 1 {
+		t.Fatalf("Deliver error = %v, want a partial delivery of 1", err)
+	}
+	if got := strings.Join(readDirNames(t, dir), ","); got != "Dune.epub,Emma.epub,Ulysses.epub" {
+		t.Errorf("directory holds %s, want Ulysses but not Walden added, and no temporary files", got)
+	}
+}
+
+func TestWebhookTransport(t *testing.T) {
+	type request struct {
+		auth, contentType, filename, subject, to, body string
+	}
+	var mu sync.Mutex
+	var received []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, request{
+			auth:        r.Header.Get("Authorization"),
+			contentType: r.Header.Get("Content-Type"),
+			filename:    r.Header.Get("X-Kindle-Sender-Filename"),
+			subject:     r.Header.Get("X-Kindle-Sender-Subject"),
+			to:          r.Header.Get("X-Kindle-Sender-To"),
+			body:        string(body),
+		})
+		if strings.HasPrefix(string(body), "Broken") {
+			http.Error(w, "cannot store the book", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	transport, err := newTransport(&Config{Transport: "webhook", WebhookURL: server.URL, WebhookToken: "token", WebhookTimeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.Deliver(newTestTransportMessage(t, "", "Dune.epub", "Emma.epub")); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	mu.Lock()
+	got := append([]request(nil), received...)
+	received = nil
+	mu.Unlock()
+	want := []request{
+		{"Bearer token", "application/epub+zip", "Dune.epub", "Book: Test", "reader@kindle.com", "Dune.epub"},
+		{"Bearer token", "application/epub+zip", "Emma.epub", "Book: Test", "reader@kindle.com", "Emma.epub"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("requests = %+v, want %+v", got, want)
+	}
+
+	// The endpoint rejects the second book: the first went out, the third
+	// wasn't tried
+	err = transport.Deliver(newTestTransportMessage(t, "", "Ulysses.epub", "Broken.epub", "Walden.epub"))
+	var partial *partialDeliveryError
+	if !errors.As(err, &partial) || partial.Delivered != 1 {
+		t.Fatalf("Deliver error = %v, want a partial delivery of 1", err)
+	}
+	if !strings.Contains(err.Error(), "status 500") {
+		t.Errorf("Deliver error = %v, want the status", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Errorf("endpoint got %d requests, want 2", len(received))
+	}
+}
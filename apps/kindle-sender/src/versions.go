@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// file_versions keeps every content seen at a sent path, numbered from 1.
+// deliveries.version is the version each recipient last received.
+const createFileVersionsSQL = `
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_path TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		file_hash TEXT NOT NULL,
+		file_size INTEGER NOT NULL,
+		file_mtime INTEGER,
+		detected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(file_path, version)
+	);
+	`
+
+// recordFileVersion returns the version number of the content at filePath,
+// adding a version when it differs from the latest one
+func recordFileVersion(db *sql.DB, filePath string, fileSize int64, fileHash string, mtime sql.NullInt64) (int, error) {
+	var latest int
+	var latestHash string
+	err := db.QueryRow(
+		"SELECT version, file_hash FROM file_versions WHERE file_path = ? ORDER BY version DESC LIMIT 1",
+		filePath,
+	).Scan(&latest, &latestHash)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == nil && latestHash == fileHash {
+		return latest, nil
+	}
+	_, err = db.Exec(
+		"INSERT INTO file_versions (file_path, version, file_hash, file_size, file_mtime) VALUES (?, ?, ?, ?, ?)",
+		filePath, latest+1, fileHash, fileSize, mtime,
+	)
+	return latest + 1, err
+}
+
+// checkFileVersion compares a sent book with what sent_files recorded for its
+// path. The file is only hashed when its size or mtime differs, and a new
+// version is recorded when the content did change. It returns the new
+// version, or 0 if the content is the same.
+func checkFileVersion(db *sql.DB, filePath string, fileInfo os.FileInfo) (int, error) {
+	var recordedSize int64
+	var recordedMTime sql.NullInt64
+	var recordedHash sql.NullString
+	err := db.QueryRow(
+		"SELECT file_size, file_mtime, file_hash FROM sent_files WHERE file_path = ?", filePath,
+	).Scan(&recordedSize, &recordedMTime, &recordedHash)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	mtime := sql.NullInt64{Int64: fileInfo.ModTime().UnixNano(), Valid: true}
+	if recordedSize == fileInfo.Size() && (!recordedMTime.Valid || recordedMTime.Int64 == mtime.Int64) {
+		// Rows from before mtimes were recorded take the current one
+		if !recordedMTime.Valid {
+			_, err = db.Exec("UPDATE sent_files SET file_mtime = ? WHERE file_path = ?", mtime, filePath)
+		}
+		return 0, err
+	}
+
+	fileHash, err := hashFile(filePath)
+	if err != nil {
+		return 0, err
+	}
+	updateSQL := "UPDATE sent_files SET file_size = ?, file_hash = ?, file_mtime = ? WHERE file_path = ?"
+	if !recordedHash.Valid || recordedHash.String == fileHash {
+		// Touched, or copied over with the same content
+		_, err = db.Exec(updateSQL, fileInfo.Size(), fileHash, mtime, filePath)
+		return 0, err
+	}
+
+	// Books sent before versions were tracked get the content they were
+	// sent with as their first version
+	if _, err := recordFileVersion(db, filePath, recordedSize, recordedHash.String, recordedMTime); err != nil {
+		return 0, err
+	}
+	version, err := recordFileVersion(db, filePath, fileInfo.Size(), fileHash, mtime)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(updateSQL, fileInfo.Size(), fileHash, mtime, filePath); err != nil {
+		return 0, err
+	}
+	contentChanges.Inc()
+	log.Printf("Content of %s changed, recorded as version %d", filepath.Base(filePath), version)
+	return version, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordFileVersion(t *testing.T) {
+	db := newTestDB(t)
+	path := "/books/Dune.epub"
+
+	// Each new content gets the next version, the same content keeps it,
+	// and going back to an earlier content is a new version too
+	for i, step := range []struct {
+		hash string
+		want int
+	}{
+		{"a", 1},
+		{"a", 1},
+		{"b", 2},
+		{"a", 3},
+	} {
+		version, err := recordFileVersion(db, path, 10, step.hash, sql.NullInt64{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != step.want {
+			t.Errorf("step %d: recordFileVersion(%s) = %d, want %d", i, step.hash, version, step.want)
+		}
+	}
+	if version, err := recordFileVersion(db, "/books/Emma.epub", 10, "a", sql.NullInt64{}); err != nil || version != 1 {
+		t.Errorf("recordFileVersion(other path) = %d, %v, want 1", version, err)
+	}
+
+	var history []string
+	rows, err := db.Query("SELECT file_hash FROM file_versions WHERE file_path = ? ORDER BY version", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, hash)
+	}
+	if len(history) != 3 || history[0] != "a" || history[1] != "b" || history[2] != "a" {
+		t.Errorf("version history = %v, want [a b a]", history)
+	}
+}
+
+func TestCheckFileVersion(t *testing.T) {
+	config := newTestConfig(t)
+	db := newTestDB(t)
+	profile := newTestProfiles(t, config, &recordingTransport{}).Get(defaultProfile)
+	target := Target{Profile: profile, Recipient: config.KindleEmail}
+	path := filepath.Join(config.WatchPath, "Dune.epub")
+
+	// Not sent yet: nothing to compare with
+	writeTestFile(t, path, "first edition")
+	info := statTestFile(t, path)
+	if version, err := checkFileVersion(db, path, info); err != nil || version != 0 {
+		t.Fatalf("checkFileVersion(unsent) = %d, %v, want 0", version, err)
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := markFileSent(db, path, target, info, hash, BookMetadata{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := checkFileVersion(db, path, info); err != nil || version != 0 {
+		t.Errorf("checkFileVersion(unchanged) = %d, %v, want 0", version, err)
+	}
+
+	// Copied over with the same content
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := checkFileVersion(db, path, statTestFile(t, path)); err != nil || version != 0 {
+		t.Errorf("checkFileVersion(touched) = %d, %v, want 0", version, err)
+	}
+
+	// Replaced by an upgrade
+	writeTestFile(t, path, "second edition, revised")
+	if version, err := checkFileVersion(db, path, statTestFile(t, path)); err != nil || version != 2 {
+		t.Errorf("checkFileVersion(upgraded) = %d, %v, want 2", version, err)
+	}
+	// and the change is only reported once
+	if version, err := checkFileVersion(db, path, statTestFile(t, path)); err != nil || version != 0 {
+		t.Errorf("checkFileVersion(upgraded again) = %d, %v, want 0", version, err)
+	}
+	if delivered, err := isDelivered(db, path, target.Recipient, true); err != nil || delivered {
+		t.Errorf("isDelivered(current only) = %v, %v after an upgrade, want false", delivered, err)
+	}
+}
+
+func TestResendOnUpgrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		resend   bool
+		content  string
+		wantSend bool
+	}{
+		{name: "same content", resend: true, content: "first edition"},
+		{name: "upgrade", resend: true, content: "second edition, revised", wantSend: true},
+		{name: "upgrade without resend", resend: false, content: "second edition, revised"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newTestConfig(t)
+			config.ResendOnUpgrade = tt.resend
+			db := newTestDB(t)
+			profiles := newTestProfiles(t, config, &recordingTransport{})
+			router, err := newRouter(config, profiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			approver, err := newApprover(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := Target{Profile: profiles.Get(defaultProfile), Recipient: config.KindleEmail}
+			path := filepath.Join(config.WatchPath, "Dune.epub")
+
+			writeTestFile(t, path, "first edition")
+			hash, err := hashFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := markFileSent(db, path, target, statTestFile(t, path), hash, BookMetadata{}, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// Written again at the same path
+			writeTestFile(t, path, tt.content)
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(path, later, later); err != nil {
+				t.Fatal(err)
+			}
+			if err := processFile(path, config, db, router, approver, BookMetadata{}); err != nil {
+				t.Fatal(err)
+			}
+
+			status, err := queueStatus(db, path, target.Recipient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sent := status == queueStatusPending; sent != tt.wantSend {
+				t.Errorf("queued for resend = %v (status %q), want %v", sent, status, tt.wantSend)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotify is the default on Linux: it reports when a writer closes a file,
+// which fsnotify doesn't expose
+const defaultWatchMode = watchModeInotify
+
+// Files are created empty, closed after writing, or moved in complete (or
+// hard-linked, which only creates them). Deletes and moves away clean up.
+const inotifyMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_DELETE | unix.IN_MOVED_FROM
+
+// inotifyWatcher watches every folder under WATCH_PATH with one inotify
+// instance
+type inotifyWatcher struct {
+	fd      int
+	config  *Config
+	worker  *Worker
+	settle  *settleQueue
+	watches map[int]string
+}
+
+func watchDirectoryInotify(watchPath string, config *Config, worker *Worker, settle *settleQueue) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to create inotify instance: %w", err)
+	}
+	defer unix.Close(fd)
+
+	w := &inotifyWatcher{fd: fd, config: config, worker: worker, settle: settle, watches: make(map[int]string)}
+	if err := w.addTree(watchPath, false); err != nil {
+		return fmt.Errorf("failed to add watch paths: %w", err)
+	}
+
+	log.Printf("Watching directory: %s (inotify, %d folders)", watchPath, len(w.watches))
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read inotify events: %w", err)
+		}
+		w.handleEvents(buf[:n])
+	}
+}
+
+func (w *inotifyWatcher) handleEvents(buf []byte) {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + unix.SizeofInotifyEvent
+		offset = nameStart + int(event.Len)
+		name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			log.Printf("Watcher error: inotify queue overflowed, the next scan picks up missed files")
+			continue
+		}
+		if event.Mask&unix.IN_IGNORED != 0 {
+			// The folder is gone and the kernel dropped its watch
+			delete(w.watches, int(event.Wd))
+			continue
+		}
+		dir, ok := w.watches[int(event.Wd)]
+		if !ok || name == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+
+		if event.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0 {
+			w.removed(path, event.Mask)
+			continue
+		}
+		if isIgnoredPath(path, w.config) {
+			continue
+		}
+
+		if event.Mask&unix.IN_ISDIR != 0 {
+			// A folder moved in brings its books along, and files can land
+			// in a new folder before its watch is added
+			if err := w.addTree(path, true); err != nil {
+				log.Printf("Error watching %s: %v", path, err)
+			}
+			continue
+		}
+		if !isSupportedFile(name, w.config.FileExtensions) {
+			continue
+		}
+
+		switch {
+		case event.Mask&unix.IN_CLOSE_WRITE != 0:
+			watchEventsTotal.WithLabelValues(watchCloseWrite).Inc()
+		case event.Mask&unix.IN_MOVED_TO != 0:
+			watchEventsTotal.WithLabelValues(watchMovedTo).Inc()
+		default:
+			watchEventsTotal.WithLabelValues(watchCreate).Inc()
+		}
+		w.settle.Add(path)
+	}
+}
+
+// removed handles a file or folder deleted or moved away. A folder's watches
+// are dropped, since their paths are stale; if it was renamed within the
+// tree, IN_MOVED_TO adds it again under the new name.
+func (w *inotifyWatcher) removed(path string, mask uint32) {
+	if mask&unix.IN_ISDIR != 0 {
+		for wd, dir := range w.watches {
+			if isUnder(dir, path) {
+				// Fails harmlessly when the kernel already dropped it
+				unix.InotifyRmWatch(w.fd, uint32(wd))
+				delete(w.watches, wd)
+			}
+		}
+	} else if !isSupportedFile(path, w.config.FileExtensions) {
+		return
+	}
+
+	if mask&unix.IN_MOVED_FROM != 0 {
+		watchEventsTotal.WithLabelValues(watchMovedFrom).Inc()
+	} else {
+		watchEventsTotal.WithLabelValues(watchDelete).Inc()
+	}
+	w.worker.Removed(path)
+}
+
+// addTree watches root and every folder below it that isn't ignored. With
+// queueFiles, books already inside are handed to the settle queue.
+func (w *inotifyWatcher) addTree(root string, queueFiles bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed while walking
+			if errors.Is(err, fs.ErrNotExist) && path != root {
+				return nil
+			}
+			return err
+		}
+		if isIgnoredPath(path, w.config) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			if queueFiles && isSupportedFile(d.Name(), w.config.FileExtensions) {
+				w.settle.Add(path)
+			}
+			return nil
+		}
+
+		wd, err := unix.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err == unix.ENOSPC {
+			return fmt.Errorf("%s: out of inotify watches; raise fs.inotify.max_user_watches or use WATCH_MODE=poll", path)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		w.watches[wd] = path
+		return nil
+	})
+}
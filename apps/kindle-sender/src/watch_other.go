@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+const defaultWatchMode = watchModeFsnotify
+
+func watchDirectoryInotify(watchPath string, config *Config, worker *Worker, settle *settleQueue) error {
+	return errors.New("WATCH_MODE=inotify is only available on Linux; use fsnotify or poll")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Bookshelf (Readarr) webhook event types
+const (
+	bookshelfEventTest     = "Test"
+	bookshelfEventDownload = "Download"
+)
+
+// bookshelfPayload is the subset of a Bookshelf webhook we use. Both "On
+// Release Import" and "On Upgrade" arrive as a Download event, the latter
+// with isUpgrade set and the replaced files in deletedFiles.
+type bookshelfPayload struct {
+	EventType string `json:"eventType"`
+	Author    struct {
+		Name string `json:"name"`
+	} `json:"author"`
+	Book struct {
+		Title string `json:"title"`
+	} `json:"book"`
+	BookFiles    []bookshelfFile `json:"bookFiles"`
+	DeletedFiles []bookshelfFile `json:"deletedFiles"`
+	IsUpgrade    bool            `json:"isUpgrade"`
+}
+
+type bookshelfFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// bookshelfWebhook queues the files Bookshelf reports as imported, with the
+// author and title from its library, and answers straight away instead of
+// waiting behind a send. The worker processes them like files found by the
+// watcher, so a book the watcher got to first isn't sent twice.
+func (a *adminAPI) bookshelfWebhook(w http.ResponseWriter, r *http.Request) {
+	var payload bookshelfPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	webhookEventsTotal.WithLabelValues(payload.EventType).Inc()
+
+	switch payload.EventType {
+	case bookshelfEventTest:
+		log.Println("Bookshelf webhook: test event received")
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	case bookshelfEventDownload:
+	default:
+		// Other notifications are acknowledged so Bookshelf doesn't report
+		// the connection as failing
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "event_type": payload.EventType})
+		return
+	}
+
+	meta := BookMetadata{
+		Title:  strings.TrimSpace(payload.Book.Title),
+		Author: strings.TrimSpace(payload.Author.Name),
+	}
+
+	queued := make([]string, 0, len(payload.BookFiles))
+	skipped := make(map[string]string)
+	for _, file := range payload.BookFiles {
+		filePath := filepath.Clean(file.Path)
+		if reason := a.webhookSkipReason(filePath); reason != "" {
+			skipped[file.Path] = reason
+			continue
+		}
+		a.worker.EnqueueKnown(filePath, meta)
+		queued = append(queued, filePath)
+	}
+
+	// An upgrade replaces the old files, which are forgotten like any
+	// other deleted book
+	for _, file := range payload.DeletedFiles {
+		filePath := filepath.Clean(file.Path)
+		if isUnder(filePath, filepath.Clean(a.config.WatchPath)) {
+			a.worker.Removed(filePath)
+		}
+	}
+
+	kind := "import"
+	if payload.IsUpgrade {
+		kind = "upgrade"
+	}
+	log.Printf("Bookshelf webhook: %s of %s, %d files queued, %d skipped",
+		kind, meta.DisplayName("unknown book"), len(queued), len(skipped))
+	for filePath, reason := range skipped {
+		log.Printf("Bookshelf webhook: skipped %s: %s", filePath, reason)
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"status": "accepted", "queued": queued, "skipped": skipped})
+}
+
+// webhookSkipReason checks a file reported by Bookshelf the way the watcher
+// would, returning why it can't be processed or "" if it can
+func (a *adminAPI) webhookSkipReason(filePath string) string {
+	if !isUnder(filePath, filepath.Clean(a.config.WatchPath)) {
+		return fmt.Sprintf("not under %s", a.config.WatchPath)
+	}
+	if isIgnoredPath(filePath, a.config) {
+		return "matches IGNORE_PATTERNS"
+	}
+	if !isSupportedFile(filePath, a.config.FileExtensions) {
+		return "unsupported format"
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Sprintf("file not found: %v", err)
+	}
+	if info.IsDir() {
+		return "is a directory"
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// postWebhook sends a Bookshelf payload to the handler and decodes the reply
+func postWebhook(t *testing.T, api *adminAPI, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/webhooks/bookshelf", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	api.bookshelfWebhook(rec, req)
+	var reply map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("reply %q is not JSON: %v", rec.Body.String(), err)
+	}
+	return rec.Code, reply
+}
+
+func TestBookshelfWebhookEvents(t *testing.T) {
+	config := newTestConfig(t)
+	worker := startTestWorker(t, config, &recordingTransport{})
+	api := &adminAPI{config: config, db: worker.db, worker: worker}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantCode   int
+		wantStatus string
+	}{
+		{name: "test event", body: `{"eventType":"Test"}`, wantCode: http.StatusOK, wantStatus: "ok"},
+		{name: "other event", body: `{"eventType":"Grab","book":{"title":"Dune"}}`, wantCode: http.StatusOK, wantStatus: "ignored"},
+		{name: "malformed body", body: `{"eventType":`, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reply := postWebhook(t, api, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %v", code, tt.wantCode, reply)
+			}
+			if tt.wantStatus != "" && reply["status"] != tt.wantStatus {
+				t.Errorf("reply status = %v, want %q", reply["status"], tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestBookshelfWebhookQueuesImports(t *testing.T) {
+	config := newTestConfig(t)
+	config.IgnorePatterns = []string{"_UNPACK_*"}
+	transport := &recordingTransport{}
+	worker := startTestWorker(t, config, transport)
+	api := &adminAPI{config: config, db: worker.db, worker: worker}
+
+	book := filepath.Join(config.WatchPath, "Frank Herbert", "Dune.epub")
+	writeTestFile(t, book, "dune")
+	unpacking := filepath.Join(config.WatchPath, "_UNPACK_Dune", "Dune.epub")
+	writeTestFile(t, unpacking, "dune")
+	unsupported := filepath.Join(config.WatchPath, "Frank Herbert", "Dune.txt")
+	writeTestFile(t, unsupported, "dune")
+	outside := filepath.Join(t.TempDir(), "Dune.epub")
+	writeTestFile(t, outside, "dune")
+	missing := filepath.Join(config.WatchPath, "Frank Herbert", "Missing.epub")
+
+	// The upgrade replaced an older copy that was still waiting to be sent
+	replaced := filepath.Join(config.WatchPath, "Frank Herbert", "Dune (old).epub")
+	target := Target{Profile: worker.profiles.Get(defaultProfile), Recipient: config.KindleEmail}
+	if err := worker.Do(func() error {
+		_, err := enqueueFile(worker.db, replaced, target, 10, "old", BookMetadata{}, queueStatusHeld)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := func(paths ...string) string {
+		var entries []string
+		for _, path := range paths {
+			entries = append(entries, fmt.Sprintf(`{"path":%q,"size":4}`, path))
+		}
+		return "[" + strings.Join(entries, ",") + "]"
+	}
+	body := fmt.Sprintf(`{"eventType":"Download","isUpgrade":true,"author":{"name":" Frank Herbert "},"book":{"title":"Dune"},
+		"bookFiles":%s,"deletedFiles":%s}`, files(book, unpacking, unsupported, outside, missing), files(replaced))
+
+	code, reply := postWebhook(t, api, body)
+	if code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %v", code, http.StatusAccepted, reply)
+	}
+	if queued, _ := reply["queued"].([]interface{}); len(queued) != 1 || queued[0] != book {
+		t.Errorf("queued = %v, want only %s", reply["queued"], book)
+	}
+	skipped, _ := reply["skipped"].(map[string]interface{})
+	for path, want := range map[string]string{
+		unpacking:   "matches IGNORE_PATTERNS",
+		unsupported: "unsupported format",
+		outside:     "not under",
+		missing:     "file not found",
+	} {
+		if reason, _ := skipped[path].(string); !strings.Contains(reason, want) {
+			t.Errorf("skip reason for %s = %q, want %q", path, reason, want)
+		}
+	}
+
+	// The book goes out with Bookshelf's author and title
+	waitFor(t, "the imported book to be sent", func() bool { return len(transport.Delivered()) == 1 })
+	if subject := transport.Delivered()[0].Subject; subject != "Book: Dune by Frank Herbert" {
+		t.Errorf("subject = %q, want Bookshelf's title and author", subject)
+	}
+
+	// The replaced file is forgotten
+	waitFor(t, "the replaced file to leave the queue", func() bool {
+		var count int
+		err := worker.db.QueryRow("SELECT COUNT(*) FROM send_queue WHERE file_path = ?", replaced).Scan(&count)
+		return err == nil && count == 0
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// pathBatchSize bounds how many queued paths are processed before the worker
+// checks for other work, so a full library scan can't starve API actions
+const pathBatchSize = 50
+
+// pathQueue is a deduplicating FIFO of file paths waiting to be processed,
+// each with the metadata its event source knew. A path already waiting is
+// not added twice.
+type pathQueue struct {
+	mu      sync.Mutex
+	pending map[string]BookMetadata
+	order   []string
+	ready   chan struct{}
+}
+
+func newPathQueue() *pathQueue {
+	return &pathQueue{
+		pending: make(map[string]BookMetadata),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Push adds a path unless it is already waiting. Known metadata replaces
+// what a waiting path was queued with, so a webhook's title isn't lost to a
+// watcher event that came first.
+func (q *pathQueue) Push(path string, known BookMetadata) {
+	q.mu.Lock()
+	if _, ok := q.pending[path]; ok {
+		if known != (BookMetadata{}) {
+			q.pending[path] = known
+		}
+		q.mu.Unlock()
+		return
+	}
+	q.pending[path] = known
+	q.order = append(q.order, path)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// Pop removes and returns the oldest waiting path and its metadata
+func (q *pathQueue) Pop() (string, BookMetadata, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.order) == 0 {
+		return "", BookMetadata{}, false
+	}
+	path := q.order[0]
+	q.order = q.order[1:]
+	known := q.pending[path]
+	delete(q.pending, path)
+	return path, known, true
+}
+
+func (q *pathQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.order)
+}
+
+// Ready is signalled whenever paths are waiting
+func (q *pathQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+func (q *pathQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Worker is the single consumer for all file processing. The scanner, the
+// watcher and the admin API only hand it paths or actions; it alone owns the
+// rate limiters and writes to the database, so a file can't be processed or
+// sent twice concurrently.
+type Worker struct {
+	config    *Config
+	db        *sql.DB
+	profiles  *Profiles
+	converter Converter
+	router    *Router
+	approver  *Approver
+	paths     *pathQueue
+	actions   chan func()
+	wake      chan struct{}
+}
+
+func NewWorker(config *Config, db *sql.DB, profiles *Profiles, converter Converter, router *Router, approver *Approver) *Worker {
+	return &Worker{
+		config:    config,
+		db:        db,
+		profiles:  profiles,
+		converter: converter,
+		router:    router,
+		approver:  approver,
+		paths:     newPathQueue(),
+		actions:   make(chan func()),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Enqueue schedules a path for processing. Safe to call from any goroutine.
+func (w *Worker) Enqueue(path string) {
+	w.paths.Push(path, BookMetadata{})
+}
+
+// EnqueueKnown schedules a path for processing with metadata from the event
+// source, such as Bookshelf, which takes precedence over the file's own
+func (w *Worker) EnqueueKnown(path string, known BookMetadata) {
+	w.paths.Push(path, known)
+}
+
+// Do runs fn on the worker goroutine and waits for its result. Safe to call
+// from any goroutine except the worker itself.
+func (w *Worker) Do(fn func() error) error {
+	done := make(chan error, 1)
+	w.actions <- func() { done <- fn() }
+	return <-done
+}
+
+// Removed forgets state kept for a deleted or renamed-away path. It returns
+// straight away, so a watcher isn't held up while the worker is sending.
+func (w *Worker) Removed(path string) {
+	go func() {
+		if err := w.Do(func() error { return forgetRemovedPath(w.db, path) }); err != nil {
+			log.Printf("Error forgetting removed path %s: %v", path, err)
+		}
+	}()
+}
+
+// Run processes paths, actions and the send queue until the process exits
+func (w *Worker) Run() {
+	ticker := time.NewTicker(time.Duration(w.config.QueuePollInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case fn := <-w.actions:
+			fn()
+		case <-w.paths.Ready():
+			w.processPaths()
+		case <-w.wake:
+		case <-ticker.C:
+		}
+
+		// Send at most one book per iteration so actions and new paths are
+		// picked up between deliveries
+		if w.sendNext() {
+			w.signalWake()
+		}
+	}
+}
+
+func (w *Worker) signalWake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// processPaths handles a batch of waiting paths
+func (w *Worker) processPaths() {
+	for i := 0; i < pathBatchSize; i++ {
+		path, known, ok := w.paths.Pop()
+		if !ok {
+			break
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if !isSupportedFile(info.Name(), w.config.FileExtensions) || isIgnoredPath(path, w.config) {
+			continue
+		}
+		if err := processFile(path, w.config, w.db, w.router, w.approver, known); err != nil {
+			log.Printf("Error processing file %s: %v", path, err)
+		}
+	}
+
+	if w.paths.Len() > 0 {
+		w.paths.signal()
+	}
+	updateQueueMetrics(w.db)
+}
+
+// sendNext delivers the next due queue item whose profile is within its rate
+// limit. It reports whether another item may be ready straight away.
+func (w *Worker) sendNext() bool {
+	// Keep the sliding window gauges current even when nothing is sent.
+	// Outside its delivery windows a profile's books wait in the queue.
+	now := time.Now()
+	var excluded []string
+	for _, profile := range w.profiles.All() {
+		updateRateLimitMetrics(profile)
+		if profile.rateLimited && profile.RateLimiter.CanSend() {
+			profile.rateLimited = false
+			filesRateLimited.WithLabelValues(profile.Name).Set(0)
+		}
+		if !updateDeliveryWindow(profile, now) {
+			excluded = append(excluded, profile.Name)
+		}
+	}
+
+	// A rate-limited profile doesn't hold up the others
+	for {
+		item, err := nextDueQueueItem(w.db, now, excluded)
+		if err != nil {
+			log.Printf("Error reading send queue: %v", err)
+			return false
+		}
+		if item == nil {
+			return false
+		}
+
+		profile := w.profiles.Get(item.Profile)
+		if profile == nil {
+			// The profile was removed from the configuration since queueing
+			reason := fmt.Errorf("profile %s is not configured", item.Profile)
+			if err := markQueueItemDead(w.db, item, reason); err != nil {
+				log.Printf("Error updating send queue: %v", err)
+				return false
+			}
+			log.Printf("Cannot send %s to %s, moved to dead letter: %v", item.FilePath, item.Recipient, reason)
+			updateQueueMetrics(w.db)
+			continue
+		}
+
+		if !profile.RateLimiter.CanSend() {
+			if !profile.rateLimited {
+				log.Printf("Rate limit of profile %s reached (%d/%d this hour, %d today). Next slot in %.0f minutes",
+					profile.Name, profile.RateLimiter.SentThisHour(), profile.Config.MaxBooksPerHour,
+					profile.RateLimiter.SentToday(), profile.RateLimiter.TimeUntilNextSlot().Minutes())
+			}
+			profile.rateLimited = true
+			filesRateLimited.WithLabelValues(profile.Name).Set(1)
+			excluded = append(excluded, profile.Name)
+			continue
+		}
+
+		// With batching, books due for the same recipient go out together
+		items := []*QueueItem{item}
+		more, err := batchCompanions(w.db, item, profile, now)
+		if err != nil {
+			log.Printf("Error reading send queue: %v", err)
+			return false
+		}
+		items = append(items, more...)
+
+		defer updateQueueMetrics(w.db)
+		if err := deliverQueueItems(items, profile, w.db, w.converter); err != nil {
+			log.Printf("Error delivering %s: %v", item.FilePath, err)
+			return false
+		}
+		return true
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPathQueueDeduplicates(t *testing.T) {
+	q := newPathQueue()
+	q.Push("/books/a.epub", BookMetadata{})
+	q.Push("/books/b.epub", BookMetadata{})
+	q.Push("/books/a.epub", BookMetadata{})
+
+	if got := q.Len(); got != 2 {
+		t.Fatalf("Len() = %d, want 2", got)
+	}
+	for _, want := range []string{"/books/a.epub", "/books/b.epub"} {
+		if got, _, ok := q.Pop(); !ok || got != want {
+			t.Fatalf("Pop() = %q, %v, want %q", got, ok, want)
+		}
+	}
+	if _, _, ok := q.Pop(); ok {
+		t.Fatal("Pop() on an empty queue returned a path")
+	}
+
+	// A path taken off the queue can wait again
+	q.Push("/books/a.epub", BookMetadata{})
+	if got := q.Len(); got != 1 {
+		t.Fatalf("Len() after re-push = %d, want 1", got)
+	}
+}
+
+func TestPathQueueKeepsKnownMetadata(t *testing.T) {
+	q := newPathQueue()
+	known := BookMetadata{Title: "Dune", Author: "Frank Herbert"}
+	q.Push("/books/a.epub", BookMetadata{})
+	q.Push("/books/a.epub", known)
+	q.Push("/books/a.epub", BookMetadata{})
+
+	if path, got, ok := q.Pop(); !ok || path != "/books/a.epub" || got != known {
+		t.Fatalf("Pop() = %q, %+v, %v, want /books/a.epub with %+v", path, got, ok, known)
+	}
+}
+
+func TestPathQueueSignalsReady(t *testing.T) {
+	q := newPathQueue()
+	q.Push("/books/a.epub", BookMetadata{})
+	q.Push("/books/b.epub", BookMetadata{})
+
+	select {
+	case <-q.Ready():
+	default:
+		t.Fatal("Ready() not signalled after Push")
+	}
+	select {
+	case <-q.Ready():
+		t.Fatal("Ready() signalled twice for one wake-up")
+	default:
+	}
+}
+
+func TestPathQueueConcurrentPush(t *testing.T) {
+	q := newPathQueue()
+	const pushers, paths = 8, 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < paths; j++ {
+				q.Push(fmt.Sprintf("/books/%d.epub", j), BookMetadata{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for {
+		path, _, ok := q.Pop()
+		if !ok {
+			break
+		}
+		if seen[path] {
+			t.Fatalf("%s popped twice", path)
+		}
+		seen[path] = true
+	}
+	if len(seen) != paths {
+		t.Fatalf("popped %d paths, want %d", len(seen), paths)
+	}
+}
+
+// startTestWorker runs a worker with a single profile around transport
+func startTestWorker(t *testing.T, config *Config, transport Transport) *Worker {
+	t.Helper()
+	db := newTestDB(t)
+	profiles := newTestProfiles(t, config, transport)
+	router, err := newRouter(config, profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	approver, err := newApprover(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := NewWorker(config, db, profiles, nil, router, approver)
+	go worker.Run()
+	return worker
+}
+
+func TestWorkerSendsOnceWhenEnqueuedDuringSend(t *testing.T) {
+	config := newTestConfig(t)
+	path := filepath.Join(config.WatchPath, "book.epub")
+	writeTestFile(t, path, "book")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	transport := &recordingTransport{hook: func(*EmailMessage) error {
+		once.Do(func() { close(started) })
+		<-release
+		return nil
+	}}
+	worker := startTestWorker(t, config, transport)
+
+	worker.Enqueue(path)
+	<-started
+
+	// The watcher and scanner keep reporting the file while it is being sent
+	for i := 0; i < 5; i++ {
+		worker.Enqueue(path)
+	}
+	close(release)
+
+	waitFor(t, "the delivery to be recorded", func() bool {
+		delivered, err := isDelivered(worker.db, path, config.KindleEmail, false)
+		return err == nil && delivered
+	})
+	// Draining the paths enqueued during the send must not queue it again
+	err := worker.Do(func() error {
+		worker.processPaths()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.Do(func() error { return nil })
+
+	if got := len(transport.Delivered()); got != 1 {
+		t.Fatalf("delivered %d times, want 1", got)
+	}
+	status, err := queueStatus(worker.db, path, config.KindleEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "" {
+		t.Fatalf("book still queued as %s after delivery", status)
+	}
+}
+
+func TestWorkerConcurrentEnqueues(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxBooksPerHour = 1000
+	const books = 20
+
+	var paths []string
+	for i := 0; i < books; i++ {
+		path := filepath.Join(config.WatchPath, fmt.Sprintf("book-%02d.epub", i))
+		writeTestFile(t, path, fmt.Sprintf("book %d", i))
+		paths = append(paths, path)
+	}
+
+	transport := &recordingTransport{}
+	worker := startTestWorker(t, config, transport)
+
+	// The watcher, the scanner and the admin API report the same files at
+	// the same time
+	var wg sync.WaitGroup
+	for source := 0; source < 3; source++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 3; round++ {
+				for _, path := range paths {
+					worker.Enqueue(path)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, "every book to be delivered", func() bool {
+		return len(transport.Delivered()) >= books
+	})
+	// Let the worker finish what it still has waiting
+	for worker.paths.Len() > 0 {
+		worker.Do(func() error { return nil })
+	}
+	worker.Do(func() error { return nil })
+
+	sent := make(map[string]int)
+	for _, msg := range transport.Delivered() {
+		sent[msg.Attachments[0].Path]++
+	}
+	for _, path := range paths {
+		if sent[path] != 1 {
+			t.Errorf("%s delivered %d times, want 1", filepath.Base(path), sent[path])
+		}
+	}
+}